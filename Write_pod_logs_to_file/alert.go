@@ -0,0 +1,277 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/tools/reference"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"sigs.k8s.io/yaml"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AlertRule describes a pattern to look for in the streamed logs.
+// An alert fires once Threshold lines match within Window, and the same rule
+// doesn't fire again for the same container until Dedupe has passed.
+type AlertRule struct {
+	Name      string          `json:"name"`
+	Pattern   string          `json:"pattern,omitempty"`
+	Contains  string          `json:"contains,omitempty"`
+	Threshold int             `json:"threshold,omitempty"`
+	Window    metav1.Duration `json:"window,omitempty"`
+	Dedupe    metav1.Duration `json:"dedupe,omitempty"`
+	Reason    string          `json:"reason,omitempty"`
+
+	re *regexp.Regexp
+}
+
+// AlertRules is the format of the file passed with -alert-rules
+type AlertRules struct {
+	Rules []AlertRule `json:"rules"`
+}
+
+func (r *AlertRule) matches(line string) bool {
+	if r.re != nil {
+		return r.re.MatchString(line)
+	}
+	return strings.Contains(line, r.Contains)
+}
+
+// loadAlertRules reads the rules file and fills in the defaults
+func loadAlertRules(filename string) ([]AlertRule, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var rules AlertRules
+	if err := yaml.UnmarshalStrict(data, &rules); err != nil {
+		return nil, fmt.Errorf("failed to parse alert rules: %w", err)
+	}
+	for i := range rules.Rules {
+		r := &rules.Rules[i]
+		if r.Name == "" {
+			return nil, fmt.Errorf("alert rule %d has no name", i)
+		}
+		if (r.Pattern == "") == (r.Contains == "") {
+			return nil, fmt.Errorf("alert rule %s needs exactly one of pattern or contains", r.Name)
+		}
+		if r.Pattern != "" {
+			re, err := regexp.Compile(r.Pattern)
+			if err != nil {
+				return nil, fmt.Errorf("alert rule %s has an invalid pattern: %w", r.Name, err)
+			}
+			r.re = re
+		}
+		if r.Threshold <= 0 {
+			r.Threshold = 1
+		}
+		if r.Window.Duration <= 0 {
+			r.Window.Duration = time.Minute
+		}
+		if r.Dedupe.Duration <= 0 {
+			r.Dedupe.Duration = 10 * time.Minute
+		}
+		if r.Reason == "" {
+			r.Reason = "LogPatternMatched"
+		}
+	}
+	return rules.Rules, nil
+}
+
+// ruleState tracks the recent matches of a rule for a single container
+type ruleState struct {
+	matches   []time.Time
+	lastAlert time.Time
+}
+
+// alertPayload is the body posted to the alert webhook
+type alertPayload struct {
+	Rule      string    `json:"rule"`
+	Reason    string    `json:"reason"`
+	Cluster   string    `json:"cluster,omitempty"`
+	Namespace string    `json:"namespace"`
+	Pod       string    `json:"pod"`
+	Container string    `json:"container"`
+	Node      string    `json:"node,omitempty"`
+	Matches   int       `json:"matches"`
+	Window    string    `json:"window"`
+	Line      string    `json:"line"`
+	Time      time.Time `json:"time"`
+}
+
+// alerter evaluates the alert rules against every streamed line and raises a Warning event
+// on the pod, and optionally calls a webhook, when a rule fires
+type alerter struct {
+	rules       []AlertRule
+	webhookURL  string
+	client      *http.Client
+	broadcaster record.EventBroadcaster
+	recorder    record.EventRecorder
+	// webhooks tracks the webhook calls in flight
+	webhooks sync.WaitGroup
+
+	mu     sync.Mutex
+	pods   map[string]*v1.ObjectReference
+	states map[string]*ruleState
+	now    func() time.Time
+}
+
+func newAlerter(clientSet kubernetes.Interface, rules []AlertRule, webhookURL string) *alerter {
+	broadcaster := record.NewBroadcaster()
+	broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: clientSet.CoreV1().Events("")})
+	return &alerter{
+		rules:       rules,
+		webhookURL:  webhookURL,
+		client:      &http.Client{Timeout: 10 * time.Second},
+		broadcaster: broadcaster,
+		recorder:    broadcaster.NewRecorder(scheme.Scheme, v1.EventSource{Component: "pod-log-collector"}),
+		pods:        map[string]*v1.ObjectReference{},
+		states:      map[string]*ruleState{},
+		now:         time.Now,
+	}
+}
+
+// addPod registers the pod the events for its lines are recorded on
+func (a *alerter) addPod(pod *v1.Pod) {
+	ref, err := reference.GetReference(scheme.Scheme, pod)
+	if err != nil {
+		log.Println(err, "Failed to get reference of pod", pod.Name)
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.pods[pod.Namespace+"/"+pod.Name] = ref
+}
+
+// observe checks a single line streamed from the container described by src
+func (a *alerter) observe(line string, src *LogEntry) {
+	line = strings.TrimRight(line, "\r\n")
+	for i := range a.rules {
+		rule := &a.rules[i]
+		if !rule.matches(line) {
+			continue
+		}
+		if matches, fire := a.record(rule, src); fire {
+			a.fire(rule, src, line, matches)
+		}
+	}
+}
+
+// record adds a match for the rule and reports whether the rule should fire
+func (a *alerter) record(rule *AlertRule, src *LogEntry) (int, bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	key := rule.Name + "/" + src.Namespace + "/" + src.Pod + "/" + src.Container
+	state, ok := a.states[key]
+	if !ok {
+		state = &ruleState{}
+		a.states[key] = state
+	}
+
+	now := a.now()
+	// drop the matches that fell out of the window
+	cutoff := now.Add(-rule.Window.Duration)
+	kept := state.matches[:0]
+	for _, t := range state.matches {
+		if t.After(cutoff) {
+			kept = append(kept, t)
+		}
+	}
+	state.matches = append(kept, now)
+
+	if len(state.matches) < rule.Threshold {
+		return len(state.matches), false
+	}
+	if !state.lastAlert.IsZero() && now.Sub(state.lastAlert) < rule.Dedupe.Duration {
+		return len(state.matches), false
+	}
+	state.lastAlert = now
+	matches := len(state.matches)
+	state.matches = state.matches[:0]
+	return matches, true
+}
+
+func (a *alerter) fire(rule *AlertRule, src *LogEntry, line string, matches int) {
+	message := fmt.Sprintf("Log rule %s matched %d times in %s in container %s: %s",
+		rule.Name, matches, rule.Window.Duration, src.Container, truncate(line, 512))
+	log.Println(message)
+
+	a.mu.Lock()
+	ref, ok := a.pods[src.Namespace+"/"+src.Pod]
+	a.mu.Unlock()
+	if ok {
+		ref = ref.DeepCopy()
+		ref.FieldPath = fmt.Sprintf("spec.containers{%s}", src.Container)
+		a.recorder.Event(ref, v1.EventTypeWarning, rule.Reason, message)
+	}
+
+	if a.webhookURL != "" {
+		payload := alertPayload{
+			Rule:      rule.Name,
+			Reason:    rule.Reason,
+			Cluster:   src.Cluster,
+			Namespace: src.Namespace,
+			Pod:       src.Pod,
+			Container: src.Container,
+			Node:      src.Node,
+			Matches:   matches,
+			Window:    rule.Window.Duration.String(),
+			Line:      line,
+			Time:      a.now(),
+		}
+		a.webhooks.Add(1)
+		go func() {
+			defer a.webhooks.Done()
+			a.callWebhook(payload)
+		}()
+	}
+}
+
+func (a *alerter) callWebhook(payload alertPayload) {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		log.Println(err, "Failed to encode alert")
+		return
+	}
+	req, err := http.NewRequestWithContext(context.Background(), http.MethodPost, a.webhookURL, bytes.NewReader(body))
+	if err != nil {
+		log.Println(err, "Failed to create alert webhook request")
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := a.client.Do(req)
+	if err != nil {
+		log.Println(err, "Failed to call alert webhook")
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		log.Println("Alert webhook returned", resp.Status)
+	}
+}
+
+// Close waits for the webhook calls in flight and stops recording events
+func (a *alerter) Close() {
+	a.webhooks.Wait()
+	a.broadcaster.Shutdown()
+}
+
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	return s[:n] + "..."
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/tools/record"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestAlerterRecord(t *testing.T) {
+	rule := &AlertRule{Name: "oom", Threshold: 3}
+	rule.Window.Duration = time.Minute
+	rule.Dedupe.Duration = 10 * time.Minute
+	src := &LogEntry{Namespace: "shop", Pod: "api-7d9f", Container: "api"}
+	other := &LogEntry{Namespace: "shop", Pod: "api-7d9f", Container: "sidecar"}
+
+	type match struct {
+		after time.Duration
+		src   *LogEntry
+		fire  bool
+		count int
+	}
+	tests := []struct {
+		name    string
+		matches []match
+	}{
+		{
+			name: "threshold within the window",
+			matches: []match{
+				{after: 0, src: src, count: 1},
+				{after: 10 * time.Second, src: src, count: 2},
+				{after: 10 * time.Second, src: src, fire: true, count: 3},
+			},
+		},
+		{
+			name: "matches falling out of the window",
+			matches: []match{
+				{after: 0, src: src, count: 1},
+				{after: 40 * time.Second, src: src, count: 2},
+				{after: 40 * time.Second, src: src, count: 2},
+				{after: 10 * time.Second, src: src, fire: true, count: 3},
+			},
+		},
+		{
+			name: "containers are counted separately",
+			matches: []match{
+				{after: 0, src: src, count: 1},
+				{after: time.Second, src: other, count: 1},
+				{after: time.Second, src: src, count: 2},
+				{after: time.Second, src: other, count: 2},
+			},
+		},
+		{
+			name: "dedupe",
+			matches: []match{
+				{after: 0, src: src, count: 1},
+				{after: 0, src: src, count: 2},
+				{after: 0, src: src, fire: true, count: 3},
+				{after: time.Minute, src: src, count: 1},
+				{after: 0, src: src, count: 2},
+				{after: 0, src: src, count: 3},
+				{after: 0, src: src, count: 4},
+			},
+		},
+		{
+			name: "fires again after dedupe",
+			matches: []match{
+				{after: 0, src: src, count: 1},
+				{after: 0, src: src, count: 2},
+				{after: 0, src: src, fire: true, count: 3},
+				{after: 10 * time.Minute, src: src, count: 1},
+				{after: 0, src: src, count: 2},
+				{after: 0, src: src, fire: true, count: 3},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			now := time.Date(2024, 3, 1, 10, 0, 0, 0, time.UTC)
+			a := &alerter{states: map[string]*ruleState{}, now: func() time.Time { return now }}
+			for i, m := range tt.matches {
+				now = now.Add(m.after)
+				count, fire := a.record(rule, m.src)
+				if fire != m.fire || count != m.count {
+					t.Errorf("match %d: expected fire %v with %d matches, got fire %v with %d", i, m.fire, m.count, fire, count)
+				}
+			}
+		})
+	}
+}
+
+func TestAlerterCloseWaitsForWebhooks(t *testing.T) {
+	var delivered atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(100 * time.Millisecond)
+		delivered.Add(1)
+	}))
+	defer server.Close()
+
+	a := &alerter{
+		rules:       []AlertRule{{Name: "panic", Contains: "panic:", Threshold: 1}},
+		webhookURL:  server.URL,
+		client:      server.Client(),
+		broadcaster: record.NewBroadcaster(),
+		pods:        map[string]*v1.ObjectReference{},
+		states:      map[string]*ruleState{},
+		now:         time.Now,
+	}
+	a.observe("panic: runtime error", &LogEntry{Namespace: "shop", Pod: "api-7d9f", Container: "api"})
+	a.Close()
+	if n := delivered.Load(); n != 1 {
+		t.Errorf("expected the webhook call to finish before Close returned, got %d calls", n)
+	}
+}
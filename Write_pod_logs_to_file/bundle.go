@@ -0,0 +1,497 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	appsv1 "k8s.io/api/apps/v1"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/clientcmd"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sigs.k8s.io/yaml"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// runBundle implements the `bundle` command which collects everything needed to debug an
+// incident for the pods matching a selector into a single tar.gz file
+func runBundle(args []string) {
+	fs := flag.NewFlagSet("bundle", flag.ExitOnError)
+	kubeconfig := kubeconfigFlag(fs)
+	ns := fs.String("namespace", namespace, "namespace of the pods")
+	selector := fs.String("selector", label, "label selector of the pods")
+	outDir := fs.String("out", ".", "directory to write the bundle to")
+	tailLines := fs.Int64("tail", 0, "only collect the last N lines of every log (default: all)")
+	_ = fs.Parse(args)
+
+	config, err := clientcmd.BuildConfigFromFlags("", *kubeconfig)
+	if err != nil {
+		log.Println(err, "Failed to build config from flags")
+		os.Exit(1)
+	}
+	clientSet, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		log.Println(err, "Failed to create clientset from the given config")
+		os.Exit(1)
+	}
+
+	filename, err := collectSupportBundle(context.TODO(), clientSet, *ns, *selector, *outDir, *tailLines)
+	if err != nil {
+		log.Println(err, "Failed to collect support bundle")
+		os.Exit(1)
+	}
+	fmt.Printf("Support bundle written to %s\n", filename)
+}
+
+// bundleWriter writes files into a tar archive below a common root directory
+type bundleWriter struct {
+	tw   *tar.Writer
+	root string
+	now  time.Time
+	// errs records the failures that didn't abort the collection
+	errs []string
+}
+
+func (b *bundleWriter) add(name string, data []byte) error {
+	err := b.tw.WriteHeader(&tar.Header{
+		Name:    path.Join(b.root, name),
+		Mode:    0644,
+		Size:    int64(len(data)),
+		ModTime: b.now,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = b.tw.Write(data)
+	return err
+}
+
+// addObject writes obj as YAML with managedFields stripped and apiVersion/kind filled in
+func (b *bundleWriter) addObject(name string, obj runtime.Object) error {
+	obj = obj.DeepCopyObject()
+	if gvks, _, err := scheme.Scheme.ObjectKinds(obj); err == nil && len(gvks) > 0 {
+		obj.GetObjectKind().SetGroupVersionKind(gvks[0])
+	}
+	if accessor, ok := obj.(metav1.Object); ok {
+		accessor.SetManagedFields(nil)
+	}
+	data, err := yaml.Marshal(obj)
+	if err != nil {
+		return err
+	}
+	return b.add(name, data)
+}
+
+func (b *bundleWriter) recordError(format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	log.Println(msg)
+	b.errs = append(b.errs, msg)
+}
+
+func collectSupportBundle(ctx context.Context, clientSet kubernetes.Interface, ns, selector, outDir string, tailLines int64) (string, error) {
+	pods, err := clientSet.CoreV1().Pods(ns).List(ctx, metav1.ListOptions{LabelSelector: selector})
+	if err != nil {
+		return "", fmt.Errorf("failed to list pods: %w", err)
+	}
+
+	now := time.Now()
+	root := fmt.Sprintf("support-bundle-%s-%s", ns, now.UTC().Format("20060102-150405"))
+	filename := filepath.Join(outDir, root+".tar.gz")
+	// write to a temporary file that is only renamed once the bundle is complete, so that a
+	// failure doesn't leave a truncated archive behind
+	file, err := os.CreateTemp(outDir, root+"-*.tar.gz.tmp")
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		file.Close()
+		os.Remove(file.Name())
+	}()
+	gz := gzip.NewWriter(file)
+	tw := tar.NewWriter(gz)
+	b := &bundleWriter{tw: tw, root: root, now: now}
+
+	if err := collectBundleObjects(ctx, clientSet, b, ns, selector, pods.Items, tailLines); err != nil {
+		return "", err
+	}
+
+	if len(b.errs) > 0 {
+		if err := b.add("errors.txt", []byte(strings.Join(b.errs, "\n")+"\n")); err != nil {
+			return "", err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return "", err
+	}
+	if err := gz.Close(); err != nil {
+		return "", err
+	}
+	if err := file.Close(); err != nil {
+		return "", err
+	}
+	return filename, os.Rename(file.Name(), filename)
+}
+
+func collectBundleObjects(ctx context.Context, clientSet kubernetes.Interface, b *bundleWriter, ns, selector string, pods []v1.Pod, tailLines int64) error {
+	var describe bytes.Buffer
+	nodes := map[string]bool{}
+	secrets := map[string]bool{}
+	deployments := map[string]bool{}
+	statefulSets := map[string]bool{}
+	// involved objects used to pick the relevant events, keyed by kind/name
+	involved := map[string]bool{}
+
+	for i := range pods {
+		pod := &pods[i]
+		involved["Pod/"+pod.Name] = true
+		if pod.Spec.NodeName != "" {
+			nodes[pod.Spec.NodeName] = true
+		}
+		for _, name := range podSecretNames(&pod.Spec) {
+			secrets[name] = true
+		}
+		for _, owner := range pod.OwnerReferences {
+			involved[owner.Kind+"/"+owner.Name] = true
+			switch owner.Kind {
+			case "StatefulSet":
+				statefulSets[owner.Name] = true
+			case "ReplicaSet":
+				rs, err := clientSet.AppsV1().ReplicaSets(ns).Get(ctx, owner.Name, metav1.GetOptions{})
+				if err != nil {
+					b.recordError("failed to get replicaset %s: %v", owner.Name, err)
+					continue
+				}
+				for _, rsOwner := range rs.OwnerReferences {
+					if rsOwner.Kind == "Deployment" {
+						deployments[rsOwner.Name] = true
+					}
+				}
+			}
+		}
+
+		if err := b.addObject(path.Join("pods", pod.Name, "pod.yaml"), pod); err != nil {
+			return err
+		}
+		containers := append(append([]v1.Container{}, pod.Spec.InitContainers...), pod.Spec.Containers...)
+		for _, container := range containers {
+			if err := collectContainerLogs(ctx, clientSet, b, pod, container.Name, false, tailLines); err != nil {
+				return err
+			}
+			if restartCount(pod, container.Name) > 0 {
+				if err := collectContainerLogs(ctx, clientSet, b, pod, container.Name, true, tailLines); err != nil {
+					return err
+				}
+			}
+		}
+		describePod(&describe, pod)
+	}
+
+	// workloads matching the selector are included even if they currently have no pods
+	deploymentList, err := clientSet.AppsV1().Deployments(ns).List(ctx, metav1.ListOptions{LabelSelector: selector})
+	if err != nil {
+		b.recordError("failed to list deployments: %v", err)
+	} else {
+		for _, d := range deploymentList.Items {
+			deployments[d.Name] = true
+		}
+	}
+	statefulSetList, err := clientSet.AppsV1().StatefulSets(ns).List(ctx, metav1.ListOptions{LabelSelector: selector})
+	if err != nil {
+		b.recordError("failed to list statefulsets: %v", err)
+	} else {
+		for _, s := range statefulSetList.Items {
+			statefulSets[s.Name] = true
+		}
+	}
+
+	for _, name := range sortedKeys(deployments) {
+		involved["Deployment/"+name] = true
+		d, err := clientSet.AppsV1().Deployments(ns).Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			b.recordError("failed to get deployment %s: %v", name, err)
+			continue
+		}
+		if err := b.addObject(path.Join("deployments", name+".yaml"), d); err != nil {
+			return err
+		}
+		describeDeployment(&describe, d)
+	}
+	for _, name := range sortedKeys(statefulSets) {
+		involved["StatefulSet/"+name] = true
+		s, err := clientSet.AppsV1().StatefulSets(ns).Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			b.recordError("failed to get statefulset %s: %v", name, err)
+			continue
+		}
+		if err := b.addObject(path.Join("statefulsets", name+".yaml"), s); err != nil {
+			return err
+		}
+		describeStatefulSet(&describe, s)
+	}
+
+	for _, name := range sortedKeys(secrets) {
+		secret, err := clientSet.CoreV1().Secrets(ns).Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			b.recordError("failed to get secret %s: %v", name, err)
+			continue
+		}
+		if err := b.addObject(path.Join("secrets", name+".yaml"), redactSecret(secret)); err != nil {
+			return err
+		}
+	}
+
+	events, err := clientSet.CoreV1().Events(ns).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		b.recordError("failed to list events: %v", err)
+	} else {
+		var relevant []v1.Event
+		for _, e := range events.Items {
+			if involved[e.InvolvedObject.Kind+"/"+e.InvolvedObject.Name] {
+				relevant = append(relevant, e)
+			}
+		}
+		sort.Slice(relevant, func(i, j int) bool {
+			return eventTime(&relevant[i]).Before(eventTime(&relevant[j]))
+		})
+		if err := b.add("events.txt", []byte(formatEvents(relevant))); err != nil {
+			return err
+		}
+	}
+
+	for _, name := range sortedKeys(nodes) {
+		node, err := clientSet.CoreV1().Nodes().Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			b.recordError("failed to get node %s: %v", name, err)
+			continue
+		}
+		describeNode(&describe, node)
+	}
+
+	return b.add("describe.txt", describe.Bytes())
+}
+
+func collectContainerLogs(ctx context.Context, clientSet kubernetes.Interface, b *bundleWriter, pod *v1.Pod, container string, previous bool, tailLines int64) error {
+	opts := &v1.PodLogOptions{
+		Container: container,
+		Previous:  previous,
+	}
+	if tailLines > 0 {
+		opts.TailLines = &tailLines
+	}
+	name := container + ".log"
+	if previous {
+		name = container + ".previous.log"
+	}
+	data, err := clientSet.CoreV1().Pods(pod.Namespace).GetLogs(pod.Name, opts).DoRaw(ctx)
+	if err != nil {
+		b.recordError("failed to get logs of %s/%s (previous=%t): %v", pod.Name, container, previous, err)
+		return nil
+	}
+	return b.add(path.Join("pods", pod.Name, name), data)
+}
+
+// podSecretNames returns the names of the secrets a pod references through volumes, env and image pull secrets
+func podSecretNames(spec *v1.PodSpec) []string {
+	names := map[string]bool{}
+	for _, vol := range spec.Volumes {
+		if vol.Secret != nil {
+			names[vol.Secret.SecretName] = true
+		}
+		if vol.Projected != nil {
+			for _, src := range vol.Projected.Sources {
+				if src.Secret != nil {
+					names[src.Secret.Name] = true
+				}
+			}
+		}
+	}
+	containers := append(append([]v1.Container{}, spec.InitContainers...), spec.Containers...)
+	for _, c := range containers {
+		for _, env := range c.Env {
+			if env.ValueFrom != nil && env.ValueFrom.SecretKeyRef != nil {
+				names[env.ValueFrom.SecretKeyRef.Name] = true
+			}
+		}
+		for _, envFrom := range c.EnvFrom {
+			if envFrom.SecretRef != nil {
+				names[envFrom.SecretRef.Name] = true
+			}
+		}
+	}
+	for _, ref := range spec.ImagePullSecrets {
+		names[ref.Name] = true
+	}
+	return sortedKeys(names)
+}
+
+// redactSecret replaces every value of the secret with its size and drops the
+// last-applied-configuration annotation which contains the data as well.
+// The placeholders are put in stringData so that they stay readable in the YAML.
+func redactSecret(secret *v1.Secret) *v1.Secret {
+	redacted := secret.DeepCopy()
+	redacted.StringData = map[string]string{}
+	for k, v := range secret.Data {
+		redacted.StringData[k] = fmt.Sprintf("REDACTED (%d bytes)", len(v))
+	}
+	for k, v := range secret.StringData {
+		redacted.StringData[k] = fmt.Sprintf("REDACTED (%d bytes)", len(v))
+	}
+	redacted.Data = nil
+	delete(redacted.Annotations, v1.LastAppliedConfigAnnotation)
+	return redacted
+}
+
+func restartCount(pod *v1.Pod, container string) int32 {
+	statuses := append(append([]v1.ContainerStatus{}, pod.Status.InitContainerStatuses...), pod.Status.ContainerStatuses...)
+	for _, s := range statuses {
+		if s.Name == container {
+			return s.RestartCount
+		}
+	}
+	return 0
+}
+
+func sortedKeys(m map[string]bool) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func eventTime(e *v1.Event) time.Time {
+	if !e.LastTimestamp.IsZero() {
+		return e.LastTimestamp.Time
+	}
+	if !e.EventTime.IsZero() {
+		return e.EventTime.Time
+	}
+	return e.CreationTimestamp.Time
+}
+
+func formatEvents(events []v1.Event) string {
+	var buf bytes.Buffer
+	w := tabwriter.NewWriter(&buf, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "LAST SEEN\tTYPE\tREASON\tOBJECT\tCOUNT\tMESSAGE")
+	for _, e := range events {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s/%s\t%d\t%s\n",
+			eventTime(&e).UTC().Format(time.RFC3339), e.Type, e.Reason,
+			strings.ToLower(e.InvolvedObject.Kind), e.InvolvedObject.Name, e.Count, strings.TrimSpace(e.Message))
+	}
+	_ = w.Flush()
+	return buf.String()
+}
+
+func describePod(out io.Writer, pod *v1.Pod) {
+	w := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(w, "Pod:\t%s/%s\n", pod.Namespace, pod.Name)
+	fmt.Fprintf(w, "Node:\t%s\n", pod.Spec.NodeName)
+	fmt.Fprintf(w, "Phase:\t%s\n", pod.Status.Phase)
+	if pod.Status.Reason != "" {
+		fmt.Fprintf(w, "Reason:\t%s\n", pod.Status.Reason)
+	}
+	fmt.Fprintf(w, "IP:\t%s\n", pod.Status.PodIP)
+	if pod.Status.StartTime != nil {
+		fmt.Fprintf(w, "Start Time:\t%s\n", pod.Status.StartTime.UTC().Format(time.RFC3339))
+	}
+	fmt.Fprintf(w, "Labels:\t%s\n", formatLabels(pod.Labels))
+	fmt.Fprintln(w, "Conditions:")
+	for _, c := range pod.Status.Conditions {
+		fmt.Fprintf(w, "  %s\t%s\t%s\n", c.Type, c.Status, c.Reason)
+	}
+	fmt.Fprintln(w, "Containers:")
+	statuses := append(append([]v1.ContainerStatus{}, pod.Status.InitContainerStatuses...), pod.Status.ContainerStatuses...)
+	for _, s := range statuses {
+		fmt.Fprintf(w, "  %s:\t%s\n", s.Name, s.Image)
+		fmt.Fprintf(w, "    State:\t%s\n", formatContainerState(s.State))
+		if s.LastTerminationState.Terminated != nil {
+			fmt.Fprintf(w, "    Last State:\t%s\n", formatContainerState(s.LastTerminationState))
+		}
+		fmt.Fprintf(w, "    Ready:\t%t\n", s.Ready)
+		fmt.Fprintf(w, "    Restart Count:\t%d\n", s.RestartCount)
+	}
+	fmt.Fprintln(w)
+	_ = w.Flush()
+}
+
+func formatContainerState(state v1.ContainerState) string {
+	switch {
+	case state.Running != nil:
+		return fmt.Sprintf("Running (since %s)", state.Running.StartedAt.UTC().Format(time.RFC3339))
+	case state.Waiting != nil:
+		return fmt.Sprintf("Waiting (%s) %s", state.Waiting.Reason, state.Waiting.Message)
+	case state.Terminated != nil:
+		return fmt.Sprintf("Terminated (%s, exit code %d) at %s", state.Terminated.Reason, state.Terminated.ExitCode,
+			state.Terminated.FinishedAt.UTC().Format(time.RFC3339))
+	}
+	return "Unknown"
+}
+
+func describeDeployment(out io.Writer, d *appsv1.Deployment) {
+	w := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(w, "Deployment:\t%s/%s\n", d.Namespace, d.Name)
+	replicas := int32(1)
+	if d.Spec.Replicas != nil {
+		replicas = *d.Spec.Replicas
+	}
+	fmt.Fprintf(w, "Replicas:\t%d desired | %d updated | %d ready | %d available | %d unavailable\n",
+		replicas, d.Status.UpdatedReplicas, d.Status.ReadyReplicas, d.Status.AvailableReplicas, d.Status.UnavailableReplicas)
+	fmt.Fprintln(w, "Conditions:")
+	for _, c := range d.Status.Conditions {
+		fmt.Fprintf(w, "  %s\t%s\t%s\t%s\n", c.Type, c.Status, c.Reason, c.Message)
+	}
+	fmt.Fprintln(w)
+	_ = w.Flush()
+}
+
+func describeStatefulSet(out io.Writer, s *appsv1.StatefulSet) {
+	w := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(w, "StatefulSet:\t%s/%s\n", s.Namespace, s.Name)
+	replicas := int32(1)
+	if s.Spec.Replicas != nil {
+		replicas = *s.Spec.Replicas
+	}
+	fmt.Fprintf(w, "Replicas:\t%d desired | %d current | %d updated | %d ready\n",
+		replicas, s.Status.CurrentReplicas, s.Status.UpdatedReplicas, s.Status.ReadyReplicas)
+	fmt.Fprintf(w, "Revisions:\tcurrent %s, update %s\n", s.Status.CurrentRevision, s.Status.UpdateRevision)
+	fmt.Fprintln(w)
+	_ = w.Flush()
+}
+
+func describeNode(out io.Writer, node *v1.Node) {
+	w := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(w, "Node:\t%s\n", node.Name)
+	fmt.Fprintf(w, "Unschedulable:\t%t\n", node.Spec.Unschedulable)
+	fmt.Fprintln(w, "Conditions:")
+	for _, c := range node.Status.Conditions {
+		fmt.Fprintf(w, "  %s\t%s\t%s\t%s\t%s\n", c.Type, c.Status, c.LastTransitionTime.UTC().Format(time.RFC3339), c.Reason, c.Message)
+	}
+	fmt.Fprintln(w)
+	_ = w.Flush()
+}
+
+func formatLabels(labels map[string]string) string {
+	if len(labels) == 0 {
+		return "<none>"
+	}
+	pairs := make([]string, 0, len(labels))
+	for k, v := range labels {
+		pairs = append(pairs, k+"="+v)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/yaml"
+	"strings"
+	"testing"
+)
+
+func TestRedactSecret(t *testing.T) {
+	secret := &v1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: "db-credentials",
+			Annotations: map[string]string{
+				v1.LastAppliedConfigAnnotation: `{"data":{"password":"czNjcjN0"}}`,
+				"team":                         "payments",
+			},
+		},
+		Data:       map[string][]byte{"password": []byte("s3cr3t"), "user": []byte("app")},
+		StringData: map[string]string{"token": "abcdef0123"},
+	}
+
+	redacted := redactSecret(secret)
+	want := map[string]string{
+		"password": "REDACTED (6 bytes)",
+		"user":     "REDACTED (3 bytes)",
+		"token":    "REDACTED (10 bytes)",
+	}
+	if len(redacted.StringData) != len(want) {
+		t.Errorf("expected %v, got %v", want, redacted.StringData)
+	}
+	for k, v := range want {
+		if redacted.StringData[k] != v {
+			t.Errorf("expected %s to be %q, got %q", k, v, redacted.StringData[k])
+		}
+	}
+	if redacted.Data != nil {
+		t.Errorf("expected no data, got %v", redacted.Data)
+	}
+	if _, ok := redacted.Annotations[v1.LastAppliedConfigAnnotation]; ok {
+		t.Error("expected the last-applied-configuration annotation to be dropped")
+	}
+	if redacted.Annotations["team"] != "payments" {
+		t.Error("expected the other annotations to be kept")
+	}
+
+	data, err := yaml.Marshal(redacted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, value := range []string{"s3cr3t", "czNjcjN0", "abcdef0123"} {
+		if strings.Contains(string(data), value) {
+			t.Errorf("the redacted secret still contains %q:\n%s", value, data)
+		}
+	}
+	if string(secret.Data["password"]) != "s3cr3t" || secret.Annotations[v1.LastAppliedConfigAnnotation] == "" {
+		t.Error("expected the original secret to be left unchanged")
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// elasticsearchSink indexes entries through the Elasticsearch/OpenSearch _bulk API
+type elasticsearchSink struct {
+	url      string
+	index    string
+	username string
+	password string
+	client   *http.Client
+}
+
+func newElasticsearchSink(url, index, username, password string) *elasticsearchSink {
+	return &elasticsearchSink{
+		url:      strings.TrimSuffix(url, "/") + "/_bulk",
+		index:    index,
+		username: username,
+		password: password,
+		client:   &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+func (s *elasticsearchSink) Name() string {
+	return "elasticsearch"
+}
+
+type bulkResponse struct {
+	Errors bool `json:"errors"`
+	Items  []map[string]struct {
+		Status int `json:"status"`
+		Error  *struct {
+			Type   string `json:"type"`
+			Reason string `json:"reason"`
+		} `json:"error"`
+	} `json:"items"`
+}
+
+func (s *elasticsearchSink) Send(ctx context.Context, batch []LogEntry) error {
+	var body bytes.Buffer
+	enc := json.NewEncoder(&body)
+	for i := range batch {
+		// add @timestamp so the documents can be used in time based index patterns
+		doc, err := json.Marshal(struct {
+			Timestamp string `json:"@timestamp"`
+			*LogEntry
+		}{
+			Timestamp: entryTime(&batch[i]).Format(time.RFC3339Nano),
+			LogEntry:  &batch[i],
+		})
+		if err != nil {
+			return err
+		}
+		// the _id is derived from the document, so that retrying a batch in which only some items
+		// failed overwrites the items that were indexed instead of duplicating them
+		sum := sha256.Sum256(doc)
+		action := map[string]interface{}{
+			"index": map[string]string{"_index": s.indexFor(&batch[i]), "_id": hex.EncodeToString(sum[:])},
+		}
+		if err := enc.Encode(action); err != nil {
+			return err
+		}
+		body.Write(doc)
+		body.WriteByte('\n')
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	if s.username != "" {
+		req.SetBasicAuth(s.username, s.password)
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("bulk request failed with status %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+
+	var result bulkResponse
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return fmt.Errorf("failed to decode bulk response: %w", err)
+	}
+	if result.Errors {
+		for _, item := range result.Items {
+			for _, r := range item {
+				if r.Error != nil {
+					return fmt.Errorf("bulk request had failed items, first: %s: %s", r.Error.Type, r.Error.Reason)
+				}
+			}
+		}
+		return fmt.Errorf("bulk request had failed items")
+	}
+	return nil
+}
+
+// indexFor expands the date in the index name, e.g. `pod-logs-%Y.%m.%d`
+func (s *elasticsearchSink) indexFor(entry *LogEntry) string {
+	t := entryTime(entry).UTC()
+	return strings.NewReplacer(
+		"%Y", t.Format("2006"),
+		"%m", t.Format("01"),
+		"%d", t.Format("02"),
+	).Replace(s.index)
+}
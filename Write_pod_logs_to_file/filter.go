@@ -0,0 +1,196 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// stringSliceFlag collects the values of a flag that may be repeated
+type stringSliceFlag []string
+
+func (s *stringSliceFlag) String() string {
+	return strings.Join(*s, ",")
+}
+
+func (s *stringSliceFlag) Set(value string) error {
+	*s = append(*s, value)
+	return nil
+}
+
+// fieldFilter is a single field expression such as `level=error`, `user!=admin`,
+// `path=~^/api` or `msg!~healthz`
+type fieldFilter struct {
+	field string
+	op    string
+	value string
+	re    *regexp.Regexp
+}
+
+func parseFieldFilter(expr string) (fieldFilter, error) {
+	// check the two character operators first so that `!=` isn't read as `=`
+	for _, op := range []string{"=~", "!~", "!=", "="} {
+		idx := strings.Index(expr, op)
+		if idx <= 0 {
+			continue
+		}
+		f := fieldFilter{
+			field: strings.TrimSpace(expr[:idx]),
+			op:    op,
+			value: strings.TrimSpace(expr[idx+len(op):]),
+		}
+		if op == "=~" || op == "!~" {
+			re, err := regexp.Compile(f.value)
+			if err != nil {
+				return fieldFilter{}, fmt.Errorf("invalid regex in field expression %q: %v", expr, err)
+			}
+			f.re = re
+		}
+		return f, nil
+	}
+	return fieldFilter{}, fmt.Errorf("invalid field expression %q, expected one of field=value, field!=value, field=~regex, field!~regex", expr)
+}
+
+func (f fieldFilter) matches(entry *LogEntry) bool {
+	value, found := lookupField(entry, f.field)
+	switch f.op {
+	case "=":
+		return found && value == f.value
+	case "!=":
+		return !found || value != f.value
+	case "=~":
+		return found && f.re.MatchString(value)
+	case "!~":
+		return !found || !f.re.MatchString(value)
+	}
+	return false
+}
+
+// lookupField resolves a field name against the normalized entry.
+// The well-known names refer to the entry itself, `labels.<key>` to a pod label
+// and anything else to the parsed fields of the line.
+func lookupField(entry *LogEntry, field string) (string, bool) {
+	switch field {
+	case "time":
+		return entry.Time, entry.Time != ""
+	case "level":
+		return entry.Level, entry.Level != ""
+	case "msg", "message":
+		return entry.Message, true
+	case "cluster":
+		return entry.Cluster, entry.Cluster != ""
+	case "namespace":
+		return entry.Namespace, true
+	case "pod":
+		return entry.Pod, true
+	case "container":
+		return entry.Container, true
+	case "node":
+		return entry.Node, entry.Node != ""
+	}
+	if key, ok := strings.CutPrefix(field, "labels."); ok {
+		v, found := entry.Labels[key]
+		return v, found
+	}
+	v, found := entry.Fields[field]
+	if !found {
+		return "", false
+	}
+	if s, ok := v.(string); ok {
+		return s, true
+	}
+	raw, _ := json.Marshal(v)
+	return string(raw), true
+}
+
+// logProcessor parses, filters and normalizes the lines read from the pod log streams
+type logProcessor struct {
+	format   string
+	minLevel int
+	match    *regexp.Regexp
+	where    []fieldFilter
+}
+
+func newLogProcessor(format, minLevel, match string, where []string) (*logProcessor, error) {
+	p := &logProcessor{format: format}
+	switch format {
+	case formatRaw, formatJSON, formatLogfmt, formatKlog, formatAuto:
+	default:
+		return nil, fmt.Errorf("unknown log format %q", format)
+	}
+	if minLevel != "" {
+		p.minLevel = parseLevel(minLevel)
+		if p.minLevel == levelUnknown {
+			return nil, fmt.Errorf("unknown log level %q", minLevel)
+		}
+	}
+	if match != "" {
+		re, err := regexp.Compile(match)
+		if err != nil {
+			return nil, fmt.Errorf("invalid match regex: %v", err)
+		}
+		p.match = re
+	}
+	for _, expr := range where {
+		f, err := parseFieldFilter(expr)
+		if err != nil {
+			return nil, err
+		}
+		p.where = append(p.where, f)
+	}
+	if format == formatRaw && (p.minLevel != levelUnknown || len(p.where) > 0) {
+		return nil, fmt.Errorf("level and field filters require a log format to be set")
+	}
+	return p, nil
+}
+
+// process returns the normalized entry and the bytes to write for a single line,
+// or false if the line is filtered out. ts is the time the kubelet received the line,
+// used when the line itself has no timestamp.
+// Without a format the raw line is passed through, otherwise a JSON line is produced.
+func (p *logProcessor) process(line string, ts time.Time, src *LogEntry) (LogEntry, []byte, bool) {
+	if p.match != nil && !p.match.MatchString(line) {
+		return LogEntry{}, nil, false
+	}
+
+	var entry LogEntry
+	if p.format == formatRaw {
+		entry.Message = strings.TrimRight(line, "\r\n")
+	} else {
+		entry, _ = parseLine(p.format, line)
+	}
+	if entry.Time == "" {
+		entry.Time = ts.UTC().Format(time.RFC3339Nano)
+	}
+	entry.Cluster = src.Cluster
+	entry.Namespace = src.Namespace
+	entry.Pod = src.Pod
+	entry.Container = src.Container
+	entry.Node = src.Node
+	entry.Labels = src.Labels
+
+	if p.format == formatRaw {
+		// tag raw lines with their cluster when collecting from several clusters
+		if src.Cluster != "" {
+			line = "[" + src.Cluster + "] " + line
+		}
+		return entry, []byte(line), true
+	}
+
+	if p.minLevel != levelUnknown && parseLevel(entry.Level) < p.minLevel {
+		return LogEntry{}, nil, false
+	}
+	for _, f := range p.where {
+		if !f.matches(&entry) {
+			return LogEntry{}, nil, false
+		}
+	}
+
+	out, err := json.Marshal(entry)
+	if err != nil {
+		return LogEntry{}, nil, false
+	}
+	return entry, append(out, '\n'), true
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFieldFilter(t *testing.T) {
+	entry := &LogEntry{
+		Level:     "error",
+		Message:   "GET /api/v1/users failed",
+		Namespace: "shop",
+		Pod:       "api-7d9f",
+		Container: "api",
+		Labels:    map[string]string{"app": "api"},
+		Fields:    map[string]interface{}{"user": "admin", "status": float64(500), "path": "/api/v1/users"},
+	}
+	tests := []struct {
+		expr string
+		want bool
+	}{
+		{expr: "level=error", want: true},
+		{expr: "level=warn", want: false},
+		{expr: "user=admin", want: true},
+		{expr: "status=500", want: true},
+		{expr: "labels.app=api", want: true},
+		{expr: "missing=value", want: false},
+		{expr: "user!=admin", want: false},
+		{expr: "user!=guest", want: true},
+		{expr: "missing!=value", want: true},
+		{expr: "path=~^/api/", want: true},
+		{expr: "msg=~healthz", want: false},
+		{expr: "missing=~.*", want: false},
+		{expr: "msg!~healthz", want: true},
+		{expr: "pod!~^api-", want: false},
+		{expr: "missing!~.*", want: true},
+		{expr: "path=~^/api/v1/users=", want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			f, err := parseFieldFilter(tt.expr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := f.matches(entry); got != tt.want {
+				t.Errorf("expected %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestParseFieldFilterErrors(t *testing.T) {
+	tests := []struct {
+		expr    string
+		wantErr string
+	}{
+		{expr: "level", wantErr: "invalid field expression"},
+		{expr: "=error", wantErr: "invalid field expression"},
+		{expr: "path=~[", wantErr: "invalid regex"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			_, err := parseFieldFilter(tt.expr)
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("expected an error containing %q, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestLogProcessor(t *testing.T) {
+	src := &LogEntry{Namespace: "shop", Pod: "api-7d9f", Container: "api"}
+	ts := time.Date(2024, 3, 1, 10, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name     string
+		minLevel string
+		where    []string
+		line     string
+		want     bool
+	}{
+		{name: "no filter", line: `{"level":"debug","msg":"tick"}`, want: true},
+		{name: "below the level", minLevel: "info", line: `{"level":"debug","msg":"tick"}`, want: false},
+		{name: "at the level", minLevel: "warn", line: `{"level":"warning","msg":"slow"}`, want: true},
+		{name: "every filter matches", where: []string{"level=error", "user!=admin"}, line: `{"level":"error","user":"guest"}`, want: true},
+		{name: "one filter fails", where: []string{"level=error", "user!=admin"}, line: `{"level":"error","user":"admin"}`, want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := newLogProcessor(formatJSON, tt.minLevel, "", tt.where)
+			if err != nil {
+				t.Fatal(err)
+			}
+			entry, out, ok := p.process(tt.line, ts, src)
+			if ok != tt.want {
+				t.Fatalf("expected %v, got %v", tt.want, ok)
+			}
+			if !ok {
+				return
+			}
+			if entry.Pod != src.Pod || entry.Time != "2024-03-01T10:00:00Z" {
+				t.Errorf("expected the pod and the kubelet time to be filled in, got %+v", entry)
+			}
+			if !strings.HasSuffix(string(out), "\n") {
+				t.Errorf("expected a JSON line, got %q", out)
+			}
+		})
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var invalidLokiLabelChars = regexp.MustCompile(`[^a-zA-Z0-9_]`)
+
+// lokiSink pushes entries to Loki's HTTP push API, one stream per container
+type lokiSink struct {
+	url    string
+	client *http.Client
+}
+
+func newLokiSink(url string) *lokiSink {
+	return &lokiSink{
+		url:    strings.TrimSuffix(url, "/") + "/loki/api/v1/push",
+		client: &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+func (s *lokiSink) Name() string {
+	return "loki"
+}
+
+type lokiStream struct {
+	Stream map[string]string `json:"stream"`
+	Values [][2]string       `json:"values"`
+}
+
+type lokiPushRequest struct {
+	Streams []*lokiStream `json:"streams"`
+}
+
+func (s *lokiSink) Send(ctx context.Context, batch []LogEntry) error {
+	streams := map[string]*lokiStream{}
+	var keys []string
+	for i := range batch {
+		labels := lokiLabels(&batch[i])
+		key := lokiStreamKey(labels)
+		stream, ok := streams[key]
+		if !ok {
+			stream = &lokiStream{Stream: labels}
+			streams[key] = stream
+			keys = append(keys, key)
+		}
+		line, err := json.Marshal(&batch[i])
+		if err != nil {
+			return err
+		}
+		ts := entryTime(&batch[i])
+		stream.Values = append(stream.Values, [2]string{strconv.FormatInt(ts.UnixNano(), 10), string(line)})
+	}
+
+	req := lokiPushRequest{}
+	for _, key := range keys {
+		req.Streams = append(req.Streams, streams[key])
+	}
+	body, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	resp, err := s.client.Do(httpReq)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("loki push failed with status %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
+
+// lokiLabels builds the stream labels from the pod metadata.
+// Pod label keys are sanitized to the characters Loki accepts in label names.
+func lokiLabels(entry *LogEntry) map[string]string {
+	labels := map[string]string{}
+	for k, v := range entry.Labels {
+		labels[invalidLokiLabelChars.ReplaceAllString(k, "_")] = v
+	}
+	if entry.Cluster != "" {
+		labels["cluster"] = entry.Cluster
+	}
+	labels["namespace"] = entry.Namespace
+	labels["pod"] = entry.Pod
+	labels["container"] = entry.Container
+	if entry.Node != "" {
+		labels["node"] = entry.Node
+	}
+	return labels
+}
+
+func lokiStreamKey(labels map[string]string) string {
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var sb strings.Builder
+	for _, k := range keys {
+		sb.WriteString(k)
+		sb.WriteByte('=')
+		sb.WriteString(labels[k])
+		sb.WriteByte(',')
+	}
+	return sb.String()
+}
+
+// entryTime returns the parsed time of the entry, or the current time if the line had none
+func entryTime(entry *LogEntry) time.Time {
+	if entry.Time != "" {
+		if t, err := time.Parse(time.RFC3339Nano, entry.Time); err == nil {
+			return t
+		}
+	}
+	return time.Now()
+}
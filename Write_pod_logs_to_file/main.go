@@ -4,6 +4,7 @@ import (
 	"bufio"
 	"context"
 	"flag"
+	"fmt"
 	"io"
 	v1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
@@ -13,7 +14,11 @@ import (
 	"k8s.io/client-go/util/homedir"
 	"log"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
 )
 
 const (
@@ -23,36 +28,200 @@ const (
 )
 
 func main() {
-	// parse the .kubeconfig file
-	var kubeconfig *string
-	if home := homedir.HomeDir(); home != "" {
-		kubeconfig = flag.String("kubeconfig", filepath.Join(home, ".kube", "config"), "(optional) absolute path to the kubeconfig file")
-	} else {
-		kubeconfig = flag.String("kubeconfig", "", "absolute path to the kubeconfig file")
+	if len(os.Args) > 1 && os.Args[1] == "bundle" {
+		runBundle(os.Args[2:])
+		return
 	}
+
+	// parse the .kubeconfig file
+	kubeconfig := kubeconfigFlag(flag.CommandLine)
+	format := flag.String("parse", "", "parse each line as json, logfmt, klog or auto and write normalized JSON lines (default: write raw lines)")
+	level := flag.String("level", "", "drop parsed lines below this level (trace, debug, info, warn, error, fatal)")
+	match := flag.String("match", "", "only keep lines matching this regex")
+	var where stringSliceFlag
+	flag.Var(&where, "where", "only keep parsed lines matching a field expression: field=value, field!=value, field=~regex or field!~regex (repeatable)")
+	var sinkConfig sinkFlags
+	flag.StringVar(&sinkConfig.lokiURL, "loki-url", "", "push logs to the Loki instance at this base URL")
+	flag.StringVar(&sinkConfig.esURL, "es-url", "", "index logs into the Elasticsearch/OpenSearch cluster at this URL")
+	flag.StringVar(&sinkConfig.esIndex, "es-index", "pod-logs-%Y.%m.%d", "Elasticsearch index, %Y, %m and %d are replaced with the log date")
+	flag.StringVar(&sinkConfig.esUsername, "es-username", "", "Elasticsearch username, the password is read from $ES_PASSWORD")
+	flag.StringVar(&sinkConfig.s3Endpoint, "s3-endpoint", "", "upload logs to the S3-compatible endpoint at this URL, credentials are read from $AWS_ACCESS_KEY_ID and $AWS_SECRET_ACCESS_KEY")
+	flag.StringVar(&sinkConfig.s3Bucket, "s3-bucket", "", "bucket to upload logs to")
+	flag.StringVar(&sinkConfig.s3Prefix, "s3-prefix", "pod-logs", "object key prefix for uploaded logs")
+	flag.StringVar(&sinkConfig.s3Region, "s3-region", "us-east-1", "region used to sign S3 requests")
+	var sinkOpts sinkOptions
+	flag.IntVar(&sinkOpts.batchSize, "batch-size", 500, "maximum number of lines sent to a sink at once")
+	flag.DurationVar(&sinkOpts.batchWait, "batch-wait", 5*time.Second, "maximum time to wait before sending a partial batch")
+	flag.IntVar(&sinkOpts.retries, "retries", 5, "number of retries before a batch is spooled to disk")
+	flag.StringVar(&sinkOpts.spoolDir, "spool-dir", "", "directory to spool batches to while a sink is unavailable")
+	alertRulesFile := flag.String("alert-rules", "", "YAML file with log patterns that raise a Warning event on the pod when matched")
+	alertWebhook := flag.String("alert-webhook", "", "URL to POST a JSON alert to whenever an alert rule fires")
+	contexts := flag.String("contexts", "", "comma separated kubeconfig contexts to collect logs from, every line is tagged with its context (default: the current context)")
+	reorderWindow := flag.Duration("reorder-window", 2*time.Second, "how long lines are held back to be sorted by timestamp across pods and clusters")
+	reorderBuffer := flag.Int("reorder-buffer", 10000, "maximum number of lines held back for sorting")
 	flag.Parse()
 
-	// use the current context in kubeconfig
-	ctx := context.TODO()
-	config, err := clientcmd.BuildConfigFromFlags("", *kubeconfig)
+	processor, err := newLogProcessor(*format, *level, *match, where)
 	if err != nil {
-		log.Println(err, "Failed to build config from flags")
+		log.Println(err, "Invalid filter options")
 		return
 	}
 
-	err = collectApplicationLogs(ctx, config, "/home/raka/logs.txt")
+	var alertRules []AlertRule
+	if *alertRulesFile != "" {
+		alertRules, err = loadAlertRules(*alertRulesFile)
+		if err != nil {
+			log.Println(err, "Invalid alert rules")
+			return
+		}
+	}
+
+	sinks, err := sinkConfig.sinks()
+	if err != nil {
+		log.Println(err, "Invalid sink options")
+		return
+	}
+	// sinks keep running after the log streams are cancelled so that the last batches are flushed
+	var writers []*sinkWriter
+	for _, sink := range sinks {
+		w := newSinkWriter(sink, sinkOpts)
+		go w.Run(context.Background())
+		writers = append(writers, w)
+	}
+	defer func() {
+		for _, w := range writers {
+			w.Close()
+		}
+	}()
+
+	// stop following the logs on interrupt
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	var clusters []clusterConfig
+	if *contexts == "" {
+		// use the current context in kubeconfig
+		config, err := clientcmd.BuildConfigFromFlags("", *kubeconfig)
+		if err != nil {
+			log.Println(err, "Failed to build config from flags")
+			return
+		}
+		clusters = append(clusters, clusterConfig{config: config})
+	} else {
+		for _, contextName := range strings.Split(*contexts, ",") {
+			contextName = strings.TrimSpace(contextName)
+			config, err := buildConfigWithContextFromFlags(contextName, *kubeconfig)
+			if err != nil {
+				log.Println(err, "Failed to build config for context", contextName)
+				return
+			}
+			clusters = append(clusters, clusterConfig{name: contextName, config: config})
+		}
+	}
+
+	err = collectApplicationLogs(ctx, clusters, collectOptions{
+		filename:      "/home/raka/logs.txt",
+		processor:     processor,
+		sinks:         writers,
+		alertRules:    alertRules,
+		alertWebhook:  *alertWebhook,
+		reorderWindow: *reorderWindow,
+		reorderBuffer: *reorderBuffer,
+	})
 	if err != nil {
 		log.Println(err, "Failed to collect logs")
 	}
 
 }
 
-func collectApplicationLogs(ctx context.Context, config *rest.Config, filename string) error {
+// kubeconfigFlag registers the -kubeconfig flag on fs
+func kubeconfigFlag(fs *flag.FlagSet) *string {
+	if home := homedir.HomeDir(); home != "" {
+		return fs.String("kubeconfig", filepath.Join(home, ".kube", "config"), "(optional) absolute path to the kubeconfig file")
+	}
+	return fs.String("kubeconfig", "", "absolute path to the kubeconfig file")
+}
+
+func buildConfigWithContextFromFlags(context string, kubeconfigPath string) (*rest.Config, error) {
+	return clientcmd.NewNonInteractiveDeferredLoadingClientConfig(
+		&clientcmd.ClientConfigLoadingRules{ExplicitPath: kubeconfigPath},
+		&clientcmd.ConfigOverrides{
+			CurrentContext: context,
+		}).ClientConfig()
+}
+
+// clusterConfig is a cluster to collect logs from, name is empty for the current context
+type clusterConfig struct {
+	name   string
+	config *rest.Config
+}
+
+// collectOptions controls what happens to the collected lines
+type collectOptions struct {
+	filename      string
+	processor     *logProcessor
+	sinks         []*sinkWriter
+	alertRules    []AlertRule
+	alertWebhook  string
+	reorderWindow time.Duration
+	reorderBuffer int
+}
+
+func collectApplicationLogs(ctx context.Context, clusters []clusterConfig, opts collectOptions) error {
+	// If the file doesn't exist, create it or append to the file
+	file, err := os.OpenFile(opts.filename, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0666)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	// the lines of all streams are merged by timestamp by a single writer
+	records := make(chan *logRecord, 1024)
+	merger := newLogMerger(file, opts.sinks, opts.reorderWindow, opts.reorderBuffer)
+	mergeErr := make(chan error, 1)
+	go func() {
+		mergeErr <- merger.Run(records)
+	}()
+
+	// get the pod lists of every cluster first
+	// then get the podLogs from each container of the pods
+	// read the streams concurrently
+	// use channel for blocking reasons
+	ch := make(chan bool)
+	streams := 0
+	for _, cluster := range clusters {
+		n, alerts, err := streamClusterLogs(ctx, cluster, opts, records, ch)
+		if alerts != nil {
+			defer alerts.Close()
+		}
+		streams += n
+		if err != nil {
+			// keep collecting from the clusters that are reachable
+			log.Println(err, "Failed to collect logs from cluster", cluster.name)
+		}
+	}
+	if streams == 0 {
+		close(records)
+		<-mergeErr
+		return fmt.Errorf("no log streams could be opened")
+	}
+
+	// wait for every stream to finish
+	for i := 0; i < streams; i++ {
+		<-ch
+	}
+	close(records)
+	return <-mergeErr
+}
+
+// streamClusterLogs starts a writeLogs goroutine for every container of the matching pods in the
+// cluster and returns the number of started streams
+func streamClusterLogs(ctx context.Context, cluster clusterConfig, opts collectOptions, records chan<- *logRecord, ch chan bool) (int, *alerter, error) {
 	// create the clientset
-	clientSet, err := kubernetes.NewForConfig(config)
+	clientSet, err := kubernetes.NewForConfig(cluster.config)
 	if err != nil {
 		log.Println("Failed to create clientset from the given config")
-		return err
+		return 0, nil, err
 	}
 	// get the pods as ListItems
 	pods, err := clientSet.CoreV1().Pods(namespace).List(ctx, metav1.ListOptions{
@@ -60,46 +229,65 @@ func collectApplicationLogs(ctx context.Context, config *rest.Config, filename s
 	})
 	if err != nil {
 		log.Println(err, "Failed to get pods")
-		return err
+		return 0, nil, err
 	}
-	// If the file doesn't exist, create it or append to the file
-	file, err := os.OpenFile(filename, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0666)
-	if err != nil {
-		return err
+	var alerts *alerter
+	if len(opts.alertRules) > 0 {
+		alerts = newAlerter(clientSet, opts.alertRules, opts.alertWebhook)
 	}
-	defer file.Close()
-	// get the pod lists first
-	// then get the podLogs from each of the pods
-	// write to files concurrently
-	// use channel for blocking reasons
-	ch := make(chan bool)
+
+	streams := 0
 	podItems := pods.Items
 	for i := 0; i < len(podItems); i++ {
-		podLogs, err := clientSet.CoreV1().Pods(namespace).GetLogs(podItems[i].Name, &v1.PodLogOptions{
-			Follow: true,
-		}).Stream(ctx)
-		if err != nil {
-			return err
+		pod := podItems[i]
+		if alerts != nil {
+			alerts.addPod(&pod)
+		}
+		for _, container := range pod.Spec.Containers {
+			podLogs, err := clientSet.CoreV1().Pods(namespace).GetLogs(pod.Name, &v1.PodLogOptions{
+				Container:  container.Name,
+				Follow:     true,
+				Timestamps: true,
+			}).Stream(ctx)
+			if err != nil {
+				log.Println(err, "Failed to stream logs of", pod.Name, container.Name)
+				continue
+			}
+			src := &LogEntry{
+				Cluster:   cluster.name,
+				Namespace: pod.Namespace,
+				Pod:       pod.Name,
+				Container: container.Name,
+				Node:      pod.Spec.NodeName,
+				Labels:    pod.Labels,
+			}
+			buffer := bufio.NewReader(podLogs)
+			go writeLogs(buffer, ch, opts.processor, src, alerts, records)
+			streams++
 		}
-		buffer := bufio.NewReader(podLogs)
-		go writeLogs(buffer, file, ch)
 	}
-	<-ch
-	return nil
+	return streams, alerts, nil
 }
 
-func writeLogs(buffer *bufio.Reader, file *os.File, ch chan bool) {
+func writeLogs(buffer *bufio.Reader, ch chan bool, processor *logProcessor, src *LogEntry, alerts *alerter, records chan<- *logRecord) {
 	defer func() {
 		ch <- true
 	}()
 	for {
 		str, readErr := buffer.ReadString('\n')
-		if readErr == io.EOF {
+		if readErr != nil && str == "" {
 			break
 		}
-		_, err := file.Write([]byte(str))
-		if err != nil {
-			return
+		ts, line := splitTimestamp(str)
+		// alert rules look at every line, before any filtering
+		if alerts != nil {
+			alerts.observe(line, src)
+		}
+		if entry, out, ok := processor.process(line, ts, src); ok {
+			records <- &logRecord{ts: ts, entry: entry, out: out}
+		}
+		if readErr == io.EOF {
+			break
 		}
 	}
 }
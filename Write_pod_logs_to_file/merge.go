@@ -0,0 +1,144 @@
+package main
+
+import (
+	"container/heap"
+	"io"
+	"strings"
+	"time"
+)
+
+// logRecord is a processed line waiting to be written in timestamp order
+type logRecord struct {
+	ts      time.Time
+	arrived time.Time
+	seq     uint64
+	entry   LogEntry
+	out     []byte
+}
+
+// recordHeap orders records by timestamp, falling back to arrival order
+type recordHeap []*logRecord
+
+func (h recordHeap) Len() int { return len(h) }
+func (h recordHeap) Less(i, j int) bool {
+	if h[i].ts.Equal(h[j].ts) {
+		return h[i].seq < h[j].seq
+	}
+	return h[i].ts.Before(h[j].ts)
+}
+func (h recordHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *recordHeap) Push(x interface{}) { *h = append(*h, x.(*logRecord)) }
+func (h *recordHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	r := old[n-1]
+	old[n-1] = nil
+	*h = old[:n-1]
+	return r
+}
+
+// logMerger merges the records of all streams into a single time ordered output.
+// Every record is held back for up to window so that lines from slower streams can be
+// sorted in front of it, and at most maxBuffered records are held at once, after which the
+// oldest is written right away. Lines arriving later than that are written out of order.
+type logMerger struct {
+	window      time.Duration
+	maxBuffered int
+	out         io.Writer
+	sinks       []*sinkWriter
+
+	pending recordHeap
+	seq     uint64
+}
+
+func newLogMerger(out io.Writer, sinks []*sinkWriter, window time.Duration, maxBuffered int) *logMerger {
+	if maxBuffered <= 0 {
+		maxBuffered = 1
+	}
+	return &logMerger{
+		window:      window,
+		maxBuffered: maxBuffered,
+		out:         out,
+		sinks:       sinks,
+	}
+}
+
+// Run writes the records received on records until the channel is closed.
+// After a write error the remaining records are discarded so that the streams don't block.
+func (m *logMerger) Run(records <-chan *logRecord) error {
+	err := m.merge(records)
+	if err != nil {
+		for range records {
+		}
+	}
+	return err
+}
+
+func (m *logMerger) merge(records <-chan *logRecord) error {
+	tick := m.window / 4
+	if tick <= 0 {
+		tick = 100 * time.Millisecond
+	}
+	ticker := time.NewTicker(tick)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case r, ok := <-records:
+			if !ok {
+				return m.flush(time.Time{})
+			}
+			m.seq++
+			r.seq = m.seq
+			r.arrived = time.Now()
+			heap.Push(&m.pending, r)
+			for m.pending.Len() > m.maxBuffered {
+				if err := m.write(heap.Pop(&m.pending).(*logRecord)); err != nil {
+					return err
+				}
+			}
+		case now := <-ticker.C:
+			if err := m.flush(now.Add(-m.window)); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// flush writes the pending records in order for as long as the oldest one arrived
+// before cutoff. A zero cutoff writes everything.
+func (m *logMerger) flush(cutoff time.Time) error {
+	for m.pending.Len() > 0 {
+		if !cutoff.IsZero() && m.pending[0].arrived.After(cutoff) {
+			return nil
+		}
+		if err := m.write(heap.Pop(&m.pending).(*logRecord)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *logMerger) write(r *logRecord) error {
+	if _, err := m.out.Write(r.out); err != nil {
+		return err
+	}
+	for _, sink := range m.sinks {
+		sink.Add(r.entry)
+	}
+	return nil
+}
+
+// splitTimestamp splits the timestamp the kubelet prefixes every line with when
+// PodLogOptions.Timestamps is set from the line itself
+func splitTimestamp(line string) (time.Time, string) {
+	idx := strings.IndexByte(line, ' ')
+	if idx <= 0 {
+		return time.Now(), line
+	}
+	ts, err := time.Parse(time.RFC3339Nano, line[:idx])
+	if err != nil {
+		return time.Now(), line
+	}
+	return ts, line[idx+1:]
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+var mergeBase = time.Date(2024, 3, 1, 10, 0, 0, 0, time.UTC)
+
+// testRecord returns a record logged the given number of seconds after mergeBase
+func testRecord(source string, seconds int) *logRecord {
+	return &logRecord{
+		ts:  mergeBase.Add(time.Duration(seconds) * time.Second),
+		out: []byte(fmt.Sprintf("%s@%ds\n", source, seconds)),
+	}
+}
+
+// syncBuffer is a buffer that can be read while the merger writes to it
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// runMerger sends records to a merger in order, closes the channel and returns what was written
+func runMerger(t *testing.T, m *logMerger, records []*logRecord) ([]string, error) {
+	t.Helper()
+	var out bytes.Buffer
+	if m.out == nil {
+		m.out = &out
+	}
+	ch := make(chan *logRecord)
+	done := make(chan error)
+	go func() {
+		done <- m.Run(ch)
+	}()
+	for _, r := range records {
+		ch <- r
+	}
+	close(ch)
+	select {
+	case err := <-done:
+		return strings.Fields(out.String()), err
+	case <-time.After(5 * time.Second):
+		t.Fatal("the merger didn't return after the records were closed")
+		return nil, nil
+	}
+}
+
+func TestLogMerger(t *testing.T) {
+	tests := []struct {
+		name        string
+		maxBuffered int
+		records     []*logRecord
+		want        []string
+	}{
+		{
+			name:        "out of order across two sources",
+			maxBuffered: 100,
+			records: []*logRecord{
+				testRecord("a", 2), testRecord("a", 5), testRecord("b", 1),
+				testRecord("b", 3), testRecord("a", 6), testRecord("b", 4),
+			},
+			want: []string{"b@1s", "a@2s", "b@3s", "b@4s", "a@5s", "a@6s"},
+		},
+		{
+			name:        "same timestamp in arrival order",
+			maxBuffered: 100,
+			records:     []*logRecord{testRecord("b", 1), testRecord("a", 1), testRecord("a", 0)},
+			want:        []string{"a@0s", "b@1s", "a@1s"},
+		},
+		{
+			name:        "reorder buffer overflow",
+			maxBuffered: 2,
+			records: []*logRecord{
+				testRecord("a", 3), testRecord("a", 2), testRecord("b", 1), testRecord("b", 0), testRecord("a", 4),
+			},
+			// the buffer holds two records, so b@1s is written as soon as it is the oldest of three
+			// and b@0s arrives too late to be sorted in front of it
+			want: []string{"b@1s", "b@0s", "a@2s", "a@3s", "a@4s"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// the window is long enough that only the buffer size and closing the channel write records
+			m := newLogMerger(nil, nil, time.Hour, tt.maxBuffered)
+			got, err := runMerger(t, m, tt.records)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if strings.Join(got, " ") != strings.Join(tt.want, " ") {
+				t.Errorf("expected %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestLogMergerWindow(t *testing.T) {
+	var out syncBuffer
+	m := newLogMerger(&out, nil, 50*time.Millisecond, 100)
+	ch := make(chan *logRecord)
+	done := make(chan error)
+	go func() {
+		done <- m.Run(ch)
+	}()
+	ch <- testRecord("a", 1)
+	eventually(t, func() bool { return out.String() == "a@1s\n" })
+	close(ch)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+type failingWriter struct{}
+
+func (failingWriter) Write([]byte) (int, error) {
+	return 0, errors.New("disk full")
+}
+
+func TestLogMergerWriteError(t *testing.T) {
+	m := newLogMerger(failingWriter{}, nil, time.Hour, 1)
+	// the records after the failed write must still be consumed so that the streams don't block
+	_, err := runMerger(t, m, []*logRecord{testRecord("a", 1), testRecord("a", 2), testRecord("a", 3)})
+	if err == nil || err.Error() != "disk full" {
+		t.Errorf("expected the write error, got %v", err)
+	}
+}
+
+func TestSplitTimestamp(t *testing.T) {
+	tests := []struct {
+		name     string
+		line     string
+		wantTime string
+		wantLine string
+	}{
+		{
+			name:     "kubelet timestamp",
+			line:     "2024-03-01T10:00:00.123456789Z GET /healthz 200",
+			wantTime: "2024-03-01T10:00:00.123456789Z",
+			wantLine: "GET /healthz 200",
+		},
+		{
+			name:     "timestamp with an offset",
+			line:     "2024-03-01T12:00:00+02:00 started",
+			wantTime: "2024-03-01T10:00:00Z",
+			wantLine: "started",
+		},
+		{name: "no timestamp", line: "GET /healthz 200", wantLine: "GET /healthz 200"},
+		{name: "no space", line: "2024-03-01T10:00:00Z", wantLine: "2024-03-01T10:00:00Z"},
+		{name: "leading space", line: " indented", wantLine: " indented"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			before := time.Now()
+			ts, line := splitTimestamp(tt.line)
+			if line != tt.wantLine {
+				t.Errorf("expected line %q, got %q", tt.wantLine, line)
+			}
+			if tt.wantTime == "" {
+				// lines without a timestamp get the time they were read
+				if ts.Before(before) || ts.After(time.Now()) {
+					t.Errorf("expected the current time, got %s", ts)
+				}
+				return
+			}
+			if got := ts.UTC().Format(time.RFC3339Nano); got != tt.wantTime {
+				t.Errorf("expected time %s, got %s", tt.wantTime, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"encoding/json"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// supported values for the -parse flag
+const (
+	formatRaw    = ""
+	formatJSON   = "json"
+	formatLogfmt = "logfmt"
+	formatKlog   = "klog"
+	formatAuto   = "auto"
+)
+
+// log levels in increasing order of severity
+const (
+	levelUnknown = iota
+	levelTrace
+	levelDebug
+	levelInfo
+	levelWarn
+	levelError
+	levelFatal
+)
+
+var levelNames = map[int]string{
+	levelTrace: "trace",
+	levelDebug: "debug",
+	levelInfo:  "info",
+	levelWarn:  "warn",
+	levelError: "error",
+	levelFatal: "fatal",
+}
+
+// keys commonly used by structured loggers for the time, level and message fields
+var (
+	timeKeys    = []string{"time", "ts", "timestamp", "@timestamp", "t"}
+	levelKeys   = []string{"level", "lvl", "severity", "loglevel", "l"}
+	messageKeys = []string{"msg", "message", "log", "m"}
+)
+
+// klog header: Lmmdd hh:mm:ss.uuuuuu threadid file:line] msg
+var klogLine = regexp.MustCompile(`^([IWEF])(\d{2})(\d{2}) (\d{2}:\d{2}:\d{2}\.\d+)\s+(\d+) ([^:\]]+):(\d+)\] (.*)$`)
+
+// LogEntry is a single normalized log line enriched with the metadata of the pod it came from
+type LogEntry struct {
+	Time      string                 `json:"time,omitempty"`
+	Level     string                 `json:"level,omitempty"`
+	Message   string                 `json:"msg"`
+	Fields    map[string]interface{} `json:"fields,omitempty"`
+	Cluster   string                 `json:"cluster,omitempty"`
+	Namespace string                 `json:"namespace"`
+	Pod       string                 `json:"pod"`
+	Container string                 `json:"container"`
+	Node      string                 `json:"node,omitempty"`
+	Labels    map[string]string      `json:"labels,omitempty"`
+}
+
+// parseLevel maps the many spellings of a log level onto one of the level constants
+func parseLevel(s string) int {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "trace", "trc":
+		return levelTrace
+	case "debug", "dbg", "d":
+		return levelDebug
+	case "info", "inf", "information", "notice", "i":
+		return levelInfo
+	case "warn", "warning", "wrn", "w":
+		return levelWarn
+	case "error", "err", "e":
+		return levelError
+	case "fatal", "panic", "critical", "crit", "dpanic", "f":
+		return levelFatal
+	}
+	return levelUnknown
+}
+
+// parseLine parses a single log line according to format.
+// It returns false if the line doesn't match the requested format.
+func parseLine(format, line string) (LogEntry, bool) {
+	line = strings.TrimRight(line, "\r\n")
+	switch format {
+	case formatJSON:
+		return parseJSON(line)
+	case formatLogfmt:
+		return parseLogfmt(line)
+	case formatKlog:
+		return parseKlog(line)
+	case formatAuto:
+		if entry, ok := parseJSON(line); ok {
+			return entry, true
+		}
+		if entry, ok := parseKlog(line); ok {
+			return entry, true
+		}
+		if entry, ok := parseLogfmt(line); ok {
+			return entry, true
+		}
+	}
+	return LogEntry{Message: line}, false
+}
+
+func parseJSON(line string) (LogEntry, bool) {
+	fields := map[string]interface{}{}
+	if err := json.Unmarshal([]byte(line), &fields); err != nil {
+		return LogEntry{Message: line}, false
+	}
+	return entryFromFields(fields), true
+}
+
+// parseLogfmt parses key=value pairs, where values may be double-quoted.
+// A line is treated as logfmt only if it contains at least one key=value pair.
+func parseLogfmt(line string) (LogEntry, bool) {
+	fields := map[string]interface{}{}
+	i := 0
+	for i < len(line) {
+		// skip separators
+		for i < len(line) && line[i] == ' ' {
+			i++
+		}
+		start := i
+		for i < len(line) && line[i] != '=' && line[i] != ' ' {
+			i++
+		}
+		key := line[start:i]
+		if key == "" {
+			break
+		}
+		if i >= len(line) || line[i] != '=' {
+			// bare key without a value
+			fields[key] = true
+			continue
+		}
+		i++ // skip '='
+		var value string
+		if i < len(line) && line[i] == '"' {
+			i++
+			var sb strings.Builder
+			for i < len(line) && line[i] != '"' {
+				if line[i] == '\\' && i+1 < len(line) {
+					i++
+				}
+				sb.WriteByte(line[i])
+				i++
+			}
+			if i >= len(line) {
+				// unterminated quote
+				return LogEntry{Message: line}, false
+			}
+			i++ // skip closing quote
+			value = sb.String()
+		} else {
+			start = i
+			for i < len(line) && line[i] != ' ' {
+				i++
+			}
+			value = line[start:i]
+		}
+		fields[key] = value
+	}
+
+	hasPair := false
+	for _, v := range fields {
+		if _, ok := v.(string); ok {
+			hasPair = true
+			break
+		}
+	}
+	if !hasPair {
+		return LogEntry{Message: line}, false
+	}
+	return entryFromFields(fields), true
+}
+
+func parseKlog(line string) (LogEntry, bool) {
+	m := klogLine.FindStringSubmatch(line)
+	if m == nil {
+		return LogEntry{Message: line}, false
+	}
+	entry := LogEntry{
+		Level:   levelNames[parseLevel(m[1])],
+		Message: m[8],
+		Fields: map[string]interface{}{
+			"thread": m[5],
+			"source": m[6] + ":" + m[7],
+		},
+	}
+	if t, ok := klogTime(m[2]+m[3], m[4], time.Now()); ok {
+		entry.Time = t.Format(time.RFC3339Nano)
+	}
+	return entry, true
+}
+
+// klogTime returns the time of a klog header, which doesn't log the year. The year of now is
+// assumed unless that puts the line more than a day in the future, as for a line logged on
+// December 31 and read on January 1, in which case it is from the year before.
+func klogTime(date, clock string, now time.Time) (time.Time, bool) {
+	t, err := time.Parse("2006 0102 15:04:05.000000", now.Format("2006")+" "+date+" "+clock)
+	if err != nil {
+		return time.Time{}, false
+	}
+	if t.After(now.Add(24 * time.Hour)) {
+		t = t.AddDate(-1, 0, 0)
+	}
+	return t, true
+}
+
+// entryFromFields pulls the well-known keys out of fields and keeps the rest as extra fields
+func entryFromFields(fields map[string]interface{}) LogEntry {
+	entry := LogEntry{}
+	if v, ok := takeField(fields, timeKeys); ok {
+		entry.Time = v
+	}
+	if v, ok := takeField(fields, levelKeys); ok {
+		entry.Level = v
+		if lvl := parseLevel(v); lvl != levelUnknown {
+			entry.Level = levelNames[lvl]
+		}
+	}
+	if v, ok := takeField(fields, messageKeys); ok {
+		entry.Message = v
+	}
+	if len(fields) > 0 {
+		entry.Fields = fields
+	}
+	return entry
+}
+
+func takeField(fields map[string]interface{}, keys []string) (string, bool) {
+	for _, k := range keys {
+		v, ok := fields[k]
+		if !ok {
+			continue
+		}
+		delete(fields, k)
+		switch val := v.(type) {
+		case string:
+			return val, true
+		case nil:
+			return "", true
+		default:
+			raw, _ := json.Marshal(val)
+			return string(raw), true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseLine(t *testing.T) {
+	tests := []struct {
+		name   string
+		format string
+		line   string
+		want   LogEntry
+		ok     bool
+	}{
+		{
+			name:   "json",
+			format: formatJSON,
+			line:   `{"ts":"2024-03-01T10:00:00Z","level":"WARNING","msg":"disk almost full","used":0.93}` + "\n",
+			want: LogEntry{
+				Time:    "2024-03-01T10:00:00Z",
+				Level:   "warn",
+				Message: "disk almost full",
+				Fields:  map[string]interface{}{"used": 0.93},
+			},
+			ok: true,
+		},
+		{
+			name:   "json with a numeric time",
+			format: formatJSON,
+			line:   `{"time":1709287200,"message":"started"}`,
+			want:   LogEntry{Time: "1709287200", Message: "started"},
+			ok:     true,
+		},
+		{
+			name:   "not json",
+			format: formatJSON,
+			line:   "plain text",
+			want:   LogEntry{Message: "plain text"},
+		},
+		{
+			name:   "logfmt",
+			format: formatLogfmt,
+			line:   `time=2024-03-01T10:00:00Z level=error msg="connection \"db\" refused" retry=3 fatal`,
+			want: LogEntry{
+				Time:    "2024-03-01T10:00:00Z",
+				Level:   "error",
+				Message: `connection "db" refused`,
+				Fields:  map[string]interface{}{"retry": "3", "fatal": true},
+			},
+			ok: true,
+		},
+		{
+			name:   "logfmt with an unterminated quote",
+			format: formatLogfmt,
+			line:   `level=info msg="unterminated`,
+			want:   LogEntry{Message: `level=info msg="unterminated`},
+		},
+		{
+			name:   "not logfmt",
+			format: formatLogfmt,
+			line:   "plain text",
+			want:   LogEntry{Message: "plain text"},
+		},
+		{
+			name:   "klog",
+			format: formatKlog,
+			line:   "E0301 10:00:00.123456       1 controller.go:42] sync failed",
+			want: LogEntry{
+				Level:   "error",
+				Message: "sync failed",
+				Fields:  map[string]interface{}{"thread": "1", "source": "controller.go:42"},
+			},
+			ok: true,
+		},
+		{
+			name:   "not klog",
+			format: formatKlog,
+			line:   "level=info msg=started",
+			want:   LogEntry{Message: "level=info msg=started"},
+		},
+		{
+			name:   "auto json",
+			format: formatAuto,
+			line:   `{"level":"debug","msg":"tick"}`,
+			want:   LogEntry{Level: "debug", Message: "tick"},
+			ok:     true,
+		},
+		{
+			name:   "auto klog",
+			format: formatAuto,
+			line:   "I0301 10:00:00.000000 7 main.go:1] ready",
+			want: LogEntry{
+				Level:   "info",
+				Message: "ready",
+				Fields:  map[string]interface{}{"thread": "7", "source": "main.go:1"},
+			},
+			ok: true,
+		},
+		{
+			name:   "auto logfmt",
+			format: formatAuto,
+			line:   "lvl=wrn m=slow",
+			want:   LogEntry{Level: "warn", Message: "slow"},
+			ok:     true,
+		},
+		{
+			name:   "auto plain text",
+			format: formatAuto,
+			line:   "plain text",
+			want:   LogEntry{Message: "plain text"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := parseLine(tt.format, tt.line)
+			if ok != tt.ok {
+				t.Fatalf("expected ok %v, got %v", tt.ok, ok)
+			}
+			// the klog year depends on the current date, klogTime is tested on its own
+			if _, klog := tt.want.Fields["source"]; klog {
+				if got.Time == "" {
+					t.Errorf("expected a time for the klog line")
+				}
+				got.Time = ""
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("unexpected entry\nwant %#v\ngot  %#v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestKlogTime(t *testing.T) {
+	tests := []struct {
+		name  string
+		date  string
+		clock string
+		now   string
+		want  string
+	}{
+		{name: "same day", date: "0301", clock: "10:00:00.000000", now: "2024-03-01T10:00:05Z", want: "2024-03-01T10:00:00Z"},
+		{name: "new year", date: "1231", clock: "23:59:59.500000", now: "2025-01-01T00:00:01Z", want: "2024-12-31T23:59:59.5Z"},
+		{name: "a day ahead", date: "0302", clock: "09:00:00.000000", now: "2024-03-01T10:00:00Z", want: "2024-03-02T09:00:00Z"},
+		{name: "earlier this year", date: "0115", clock: "08:30:00.000000", now: "2024-06-01T00:00:00Z", want: "2024-01-15T08:30:00Z"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			now, err := time.Parse(time.RFC3339, tt.now)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, ok := klogTime(tt.date, tt.clock, now)
+			if !ok {
+				t.Fatal("expected the time to parse")
+			}
+			if got.Format(time.RFC3339Nano) != tt.want {
+				t.Errorf("expected %s, got %s", tt.want, got.Format(time.RFC3339Nano))
+			}
+		})
+	}
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Sink ships a batch of log entries to an external system
+type Sink interface {
+	Name() string
+	Send(ctx context.Context, batch []LogEntry) error
+}
+
+// sinkFlags holds the command line options selecting the sinks to ship logs to
+type sinkFlags struct {
+	lokiURL    string
+	esURL      string
+	esIndex    string
+	esUsername string
+	s3Endpoint string
+	s3Bucket   string
+	s3Prefix   string
+	s3Region   string
+}
+
+func (f *sinkFlags) sinks() ([]Sink, error) {
+	var sinks []Sink
+	if f.lokiURL != "" {
+		sinks = append(sinks, newLokiSink(f.lokiURL))
+	}
+	if f.esURL != "" {
+		sinks = append(sinks, newElasticsearchSink(f.esURL, f.esIndex, f.esUsername, os.Getenv("ES_PASSWORD")))
+	}
+	if f.s3Endpoint != "" {
+		if f.s3Bucket == "" {
+			return nil, fmt.Errorf("an s3 bucket is required with an s3 endpoint")
+		}
+		sink, err := newS3Sink(f.s3Endpoint, f.s3Bucket, f.s3Prefix, f.s3Region, os.Getenv("AWS_ACCESS_KEY_ID"), os.Getenv("AWS_SECRET_ACCESS_KEY"))
+		if err != nil {
+			return nil, err
+		}
+		sinks = append(sinks, sink)
+	}
+	return sinks, nil
+}
+
+// sinkOptions controls how entries are batched and retried for every sink
+type sinkOptions struct {
+	batchSize int
+	batchWait time.Duration
+	retries   int
+	// retryWait is the delay before the first retry, it doubles with every further retry
+	retryWait time.Duration
+	spoolDir  string
+}
+
+// sinkWriter batches entries for a Sink, retries failed sends with exponential backoff and
+// spools batches to disk when the sink stays unavailable. Spooled batches are replayed
+// before the next successful send.
+type sinkWriter struct {
+	sink    Sink
+	opts    sinkOptions
+	entries chan LogEntry
+	done    chan struct{}
+	spoolMu sync.Mutex
+}
+
+func newSinkWriter(sink Sink, opts sinkOptions) *sinkWriter {
+	if opts.batchSize <= 0 {
+		opts.batchSize = 100
+	}
+	if opts.batchWait <= 0 {
+		opts.batchWait = 5 * time.Second
+	}
+	if opts.retryWait <= 0 {
+		opts.retryWait = 500 * time.Millisecond
+	}
+	return &sinkWriter{
+		sink:    sink,
+		opts:    opts,
+		entries: make(chan LogEntry, opts.batchSize*4),
+		done:    make(chan struct{}),
+	}
+}
+
+// Add queues an entry for the next batch
+func (w *sinkWriter) Add(entry LogEntry) {
+	w.entries <- entry
+}
+
+// Run batches queued entries until Close is called
+func (w *sinkWriter) Run(ctx context.Context) {
+	defer close(w.done)
+	ticker := time.NewTicker(w.opts.batchWait)
+	defer ticker.Stop()
+
+	batch := make([]LogEntry, 0, w.opts.batchSize)
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		w.flush(ctx, batch)
+		batch = make([]LogEntry, 0, w.opts.batchSize)
+	}
+	for {
+		select {
+		case entry, ok := <-w.entries:
+			if !ok {
+				flush()
+				return
+			}
+			batch = append(batch, entry)
+			if len(batch) >= w.opts.batchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
+// Close flushes the pending entries and waits for Run to return
+func (w *sinkWriter) Close() {
+	close(w.entries)
+	<-w.done
+}
+
+func (w *sinkWriter) flush(ctx context.Context, batch []LogEntry) {
+	if err := w.sendWithRetry(ctx, batch); err != nil {
+		log.Println(err, "Failed to ship logs to", w.sink.Name())
+		if err := w.spool(batch); err != nil {
+			log.Println(err, "Failed to spool logs for", w.sink.Name())
+		}
+		return
+	}
+	if err := w.replaySpool(ctx); err != nil {
+		log.Println(err, "Failed to replay spooled logs for", w.sink.Name())
+	}
+}
+
+func (w *sinkWriter) sendWithRetry(ctx context.Context, batch []LogEntry) error {
+	backoff := wait.Backoff{
+		Duration: w.opts.retryWait,
+		Factor:   2,
+		Jitter:   0.1,
+		Steps:    w.opts.retries + 1,
+		Cap:      30 * time.Second,
+	}
+	var lastErr error
+	err := wait.ExponentialBackoffWithContext(ctx, backoff, func(ctx context.Context) (bool, error) {
+		lastErr = w.sink.Send(ctx, batch)
+		return lastErr == nil, nil
+	})
+	if err != nil && lastErr != nil {
+		return lastErr
+	}
+	return err
+}
+
+func (w *sinkWriter) spoolFile() string {
+	return filepath.Join(w.opts.spoolDir, w.sink.Name()+".spool.jsonl")
+}
+
+// spool appends the batch to the sink's spool file as JSON lines
+func (w *sinkWriter) spool(batch []LogEntry) error {
+	if w.opts.spoolDir == "" {
+		return fmt.Errorf("no spool directory configured, dropping %d entries", len(batch))
+	}
+	w.spoolMu.Lock()
+	defer w.spoolMu.Unlock()
+
+	if err := os.MkdirAll(w.opts.spoolDir, 0755); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(w.spoolFile(), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	enc := json.NewEncoder(file)
+	for i := range batch {
+		if err := enc.Encode(&batch[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// replaySpool sends the spooled entries in batches and removes the spool file once all of them are shipped.
+// If a batch fails, the spool file is rewritten with the entries from that batch on, so that the
+// batches the sink already accepted are not sent again.
+func (w *sinkWriter) replaySpool(ctx context.Context) error {
+	if w.opts.spoolDir == "" {
+		return nil
+	}
+	w.spoolMu.Lock()
+	defer w.spoolMu.Unlock()
+
+	lines, entries, err := w.readSpool()
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	for start := 0; start < len(entries); start += w.opts.batchSize {
+		end := start + w.opts.batchSize
+		if end > len(entries) {
+			end = len(entries)
+		}
+		if err := w.sendWithRetry(ctx, entries[start:end]); err != nil {
+			if err := w.rewriteSpool(lines[start:]); err != nil {
+				log.Println(err, "Failed to rewrite the spool file of", w.sink.Name())
+			}
+			return err
+		}
+	}
+	return os.Remove(w.spoolFile())
+}
+
+// readSpool returns the lines of the spool file and the entries decoded from them, lines that
+// can't be decoded are dropped
+func (w *sinkWriter) readSpool() ([][]byte, []LogEntry, error) {
+	file, err := os.Open(w.spoolFile())
+	if err != nil {
+		return nil, nil, err
+	}
+	defer file.Close()
+
+	var lines [][]byte
+	var entries []LogEntry
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var entry LogEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			continue
+		}
+		lines = append(lines, append([]byte(nil), scanner.Bytes()...))
+		entries = append(entries, entry)
+	}
+	return lines, entries, scanner.Err()
+}
+
+// rewriteSpool replaces the spool file with the given lines
+func (w *sinkWriter) rewriteSpool(lines [][]byte) error {
+	tmp := w.spoolFile() + ".tmp"
+	file, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	writer := bufio.NewWriter(file)
+	for _, line := range lines {
+		writer.Write(line)
+		writer.WriteByte('\n')
+	}
+	if err := writer.Flush(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, w.spoolFile())
+}
@@ -0,0 +1,448 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testServer records the entries every accepted request carried. status returns the status code of
+// the n-th request, starting at 0.
+type testServer struct {
+	*httptest.Server
+	mu       sync.Mutex
+	requests int
+	batches  [][]string
+	status   func(n int) int
+	decode   func(r *http.Request) ([]string, error)
+}
+
+func newTestServer(t *testing.T, decode func(r *http.Request) ([]string, error), status func(n int) int) *testServer {
+	s := &testServer{decode: decode, status: status}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		n := s.requests
+		s.requests++
+		s.mu.Unlock()
+
+		if code := s.status(n); code != http.StatusOK {
+			http.Error(w, "unavailable", code)
+			return
+		}
+		messages, err := decode(r)
+		if err != nil {
+			t.Errorf("request %d: %v", n, err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		s.mu.Lock()
+		s.batches = append(s.batches, messages)
+		s.mu.Unlock()
+		if strings.HasSuffix(r.URL.Path, "/_bulk") {
+			fmt.Fprint(w, `{"errors":false,"items":[]}`)
+		}
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *testServer) accepted() [][]string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([][]string(nil), s.batches...)
+}
+
+func (s *testServer) requestCount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests
+}
+
+func decodeLoki(r *http.Request) ([]string, error) {
+	var req lokiPushRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return nil, err
+	}
+	var messages []string
+	for _, stream := range req.Streams {
+		if stream.Stream["pod"] == "" {
+			return nil, fmt.Errorf("stream %v has no pod label", stream.Stream)
+		}
+		for _, value := range stream.Values {
+			var entry LogEntry
+			if err := json.Unmarshal([]byte(value[1]), &entry); err != nil {
+				return nil, err
+			}
+			messages = append(messages, entry.Message)
+		}
+	}
+	return messages, nil
+}
+
+func decodeElasticsearch(r *http.Request) ([]string, error) {
+	if r.Header.Get("Content-Type") != "application/x-ndjson" {
+		return nil, fmt.Errorf("unexpected content type %q", r.Header.Get("Content-Type"))
+	}
+	var messages []string
+	scanner := bufio.NewScanner(r.Body)
+	for i := 0; scanner.Scan(); i++ {
+		if i%2 == 0 {
+			var action map[string]map[string]string
+			if err := json.Unmarshal(scanner.Bytes(), &action); err != nil {
+				return nil, err
+			}
+			if action["index"]["_index"] != "logs" {
+				return nil, fmt.Errorf("unexpected action %s", scanner.Text())
+			}
+			continue
+		}
+		var entry LogEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return nil, err
+		}
+		messages = append(messages, entry.Message)
+	}
+	return messages, scanner.Err()
+}
+
+func decodeS3(r *http.Request) ([]string, error) {
+	if r.Method != http.MethodPut || !strings.HasPrefix(r.URL.Path, "/bucket/pod-logs/") {
+		return nil, fmt.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+	}
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=key/") {
+		return nil, fmt.Errorf("request is not signed: %q", r.Header.Get("Authorization"))
+	}
+	var messages []string
+	scanner := bufio.NewScanner(r.Body)
+	for scanner.Scan() {
+		var entry LogEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return nil, err
+		}
+		messages = append(messages, entry.Message)
+	}
+	return messages, scanner.Err()
+}
+
+var testSinks = []struct {
+	name    string
+	newSink func(t *testing.T, url string) Sink
+	decode  func(r *http.Request) ([]string, error)
+}{
+	{
+		name:    "loki",
+		newSink: func(t *testing.T, url string) Sink { return newLokiSink(url) },
+		decode:  decodeLoki,
+	},
+	{
+		name:    "elasticsearch",
+		newSink: func(t *testing.T, url string) Sink { return newElasticsearchSink(url, "logs", "user", "password") },
+		decode:  decodeElasticsearch,
+	},
+	{
+		name: "s3",
+		newSink: func(t *testing.T, url string) Sink {
+			sink, err := newS3Sink(url, "bucket", "pod-logs", "", "key", "secret")
+			if err != nil {
+				t.Fatal(err)
+			}
+			return sink
+		},
+		decode: decodeS3,
+	},
+}
+
+func testEntries(prefix string, n int) []LogEntry {
+	entries := make([]LogEntry, n)
+	for i := range entries {
+		entries[i] = LogEntry{
+			Time:      time.Date(2024, 1, 2, 3, 4, 5, i, time.UTC).Format(time.RFC3339Nano),
+			Message:   fmt.Sprintf("%s-%d", prefix, i),
+			Namespace: "default",
+			Pod:       "web-0",
+			Container: "web",
+		}
+	}
+	return entries
+}
+
+func messages(batches [][]string) []string {
+	var all []string
+	for _, batch := range batches {
+		all = append(all, batch...)
+	}
+	return all
+}
+
+func sameMessages(got []string, want []LogEntry) bool {
+	if len(got) != len(want) {
+		return false
+	}
+	for i := range want {
+		if got[i] != want[i].Message {
+			return false
+		}
+	}
+	return true
+}
+
+func alwaysOK(int) int { return http.StatusOK }
+
+func eventually(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met within 5s")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestSinkWriterBatching(t *testing.T) {
+	for _, sink := range testSinks {
+		t.Run(sink.name+"/size", func(t *testing.T) {
+			server := newTestServer(t, sink.decode, alwaysOK)
+			w := newSinkWriter(sink.newSink(t, server.URL), sinkOptions{batchSize: 3, batchWait: time.Hour})
+			go w.Run(context.Background())
+
+			entries := testEntries("line", 7)
+			for _, entry := range entries {
+				w.Add(entry)
+			}
+			// two full batches are sent without waiting for the interval
+			eventually(t, func() bool { return len(server.accepted()) == 2 })
+			w.Close()
+
+			batches := server.accepted()
+			if len(batches) != 3 || len(batches[0]) != 3 || len(batches[1]) != 3 || len(batches[2]) != 1 {
+				t.Fatalf("expected batches of 3, 3 and 1 entries, got %v", batches)
+			}
+			if got := messages(batches); !sameMessages(got, entries) {
+				t.Errorf("unexpected messages %v", got)
+			}
+		})
+
+		t.Run(sink.name+"/interval", func(t *testing.T) {
+			server := newTestServer(t, sink.decode, alwaysOK)
+			w := newSinkWriter(sink.newSink(t, server.URL), sinkOptions{batchSize: 100, batchWait: 20 * time.Millisecond})
+			go w.Run(context.Background())
+			defer w.Close()
+
+			entries := testEntries("line", 2)
+			for _, entry := range entries {
+				w.Add(entry)
+			}
+			eventually(t, func() bool { return len(server.accepted()) == 1 })
+			if got := messages(server.accepted()); !sameMessages(got, entries) {
+				t.Errorf("unexpected messages %v", got)
+			}
+		})
+	}
+}
+
+func TestSinkWriterRetry(t *testing.T) {
+	tests := []struct {
+		name     string
+		statuses []int
+		retries  int
+		wantErr  bool
+	}{
+		{name: "5xx then success", statuses: []int{http.StatusServiceUnavailable, http.StatusInternalServerError}, retries: 3},
+		{name: "429 then success", statuses: []int{http.StatusTooManyRequests}, retries: 3},
+		{name: "retries exhausted", statuses: []int{502, 502, 502}, retries: 2, wantErr: true},
+	}
+	for _, sink := range testSinks {
+		for _, tt := range tests {
+			t.Run(sink.name+"/"+tt.name, func(t *testing.T) {
+				server := newTestServer(t, sink.decode, func(n int) int {
+					if n < len(tt.statuses) {
+						return tt.statuses[n]
+					}
+					return http.StatusOK
+				})
+				w := newSinkWriter(sink.newSink(t, server.URL), sinkOptions{retries: tt.retries, retryWait: time.Millisecond})
+
+				entries := testEntries("line", 2)
+				err := w.sendWithRetry(context.Background(), entries)
+				if tt.wantErr {
+					if err == nil {
+						t.Fatal("expected an error")
+					}
+					if server.requestCount() != tt.retries+1 {
+						t.Errorf("expected %d requests, got %d", tt.retries+1, server.requestCount())
+					}
+					return
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				if server.requestCount() != len(tt.statuses)+1 {
+					t.Errorf("expected %d requests, got %d", len(tt.statuses)+1, server.requestCount())
+				}
+				if got := messages(server.accepted()); !sameMessages(got, entries) {
+					t.Errorf("unexpected messages %v", got)
+				}
+			})
+		}
+	}
+}
+
+func TestSinkWriterSpool(t *testing.T) {
+	for _, sink := range testSinks {
+		t.Run(sink.name, func(t *testing.T) {
+			var mu sync.Mutex
+			down := true
+			server := newTestServer(t, sink.decode, func(int) int {
+				mu.Lock()
+				defer mu.Unlock()
+				if down {
+					return http.StatusServiceUnavailable
+				}
+				return http.StatusOK
+			})
+			w := newSinkWriter(sink.newSink(t, server.URL), sinkOptions{batchSize: 2, retries: 1, retryWait: time.Millisecond, spoolDir: t.TempDir()})
+
+			first := testEntries("first", 2)
+			second := testEntries("second", 1)
+			w.flush(context.Background(), first)
+			w.flush(context.Background(), second)
+			if len(server.accepted()) != 0 {
+				t.Fatal("no batch must be accepted while the server is down")
+			}
+			if _, entries, err := w.readSpool(); err != nil || len(entries) != 3 {
+				t.Fatalf("expected 3 spooled entries, got %d: %v", len(entries), err)
+			}
+
+			mu.Lock()
+			down = false
+			mu.Unlock()
+			third := testEntries("third", 1)
+			w.flush(context.Background(), third)
+
+			want := append(append(append([]LogEntry(nil), third...), first...), second...)
+			if got := messages(server.accepted()); !sameMessages(got, want) {
+				t.Errorf("expected %v, got %v", want, got)
+			}
+			if _, err := os.Stat(w.spoolFile()); !os.IsNotExist(err) {
+				t.Errorf("expected the spool file to be removed, got %v", err)
+			}
+		})
+	}
+}
+
+func TestSinkWriterReplayPartialFailure(t *testing.T) {
+	for _, sink := range testSinks {
+		t.Run(sink.name, func(t *testing.T) {
+			var mu sync.Mutex
+			failFrom := 1
+			server := newTestServer(t, sink.decode, func(n int) int {
+				mu.Lock()
+				defer mu.Unlock()
+				if failFrom >= 0 && n >= failFrom {
+					return http.StatusServiceUnavailable
+				}
+				return http.StatusOK
+			})
+			w := newSinkWriter(sink.newSink(t, server.URL), sinkOptions{batchSize: 2, retryWait: time.Millisecond, spoolDir: t.TempDir()})
+
+			entries := testEntries("spooled", 5)
+			if err := w.spool(entries); err != nil {
+				t.Fatal(err)
+			}
+			// the first batch is accepted, the second fails
+			if err := w.replaySpool(context.Background()); err == nil {
+				t.Fatal("expected the replay to fail")
+			}
+			if got := messages(server.accepted()); !sameMessages(got, entries[:2]) {
+				t.Fatalf("expected the first batch to be accepted, got %v", got)
+			}
+			_, spooled, err := w.readSpool()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(spooled) != 3 || spooled[0].Message != entries[2].Message {
+				t.Fatalf("expected the 3 entries not accepted to stay spooled, got %v", spooled)
+			}
+
+			mu.Lock()
+			failFrom = -1
+			mu.Unlock()
+			if err := w.replaySpool(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			if got := messages(server.accepted()); !sameMessages(got, entries) {
+				t.Errorf("expected every entry to be accepted exactly once, got %v", got)
+			}
+			if _, err := os.Stat(w.spoolFile()); !os.IsNotExist(err) {
+				t.Errorf("expected the spool file to be removed, got %v", err)
+			}
+		})
+	}
+}
+
+func TestElasticsearchSinkItemErrors(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"errors":true,"items":[{"index":{"status":400,"error":{"type":"mapper_parsing_exception","reason":"failed to parse"}}}]}`)
+	}))
+	defer server.Close()
+
+	err := newElasticsearchSink(server.URL, "logs", "", "").Send(context.Background(), testEntries("line", 1))
+	if err == nil || !strings.Contains(err.Error(), "mapper_parsing_exception") {
+		t.Errorf("expected the item error to be returned, got %v", err)
+	}
+}
+
+func TestElasticsearchSinkDocumentIDs(t *testing.T) {
+	var mu sync.Mutex
+	var ids [][]string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var batch []string
+		scanner := bufio.NewScanner(r.Body)
+		for i := 0; scanner.Scan(); i++ {
+			if i%2 == 0 {
+				var action map[string]map[string]string
+				if err := json.Unmarshal(scanner.Bytes(), &action); err != nil {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+				batch = append(batch, action["index"]["_id"])
+			}
+		}
+		mu.Lock()
+		ids = append(ids, batch)
+		mu.Unlock()
+		fmt.Fprint(w, `{"errors":false,"items":[]}`)
+	}))
+	defer server.Close()
+
+	sink := newElasticsearchSink(server.URL, "logs", "", "")
+	entries := testEntries("line", 3)
+	for i := 0; i < 2; i++ {
+		if err := sink.Send(context.Background(), entries); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if len(ids) != 2 || len(ids[0]) != len(entries) {
+		t.Fatalf("expected two requests of %d items, got %v", len(entries), ids)
+	}
+	seen := map[string]bool{}
+	for i, id := range ids[0] {
+		if id == "" || seen[id] {
+			t.Errorf("expected a distinct _id for every entry, got %v", ids[0])
+		}
+		seen[id] = true
+		if ids[1][i] != id {
+			t.Errorf("expected a resent entry to keep its _id %s, got %s", id, ids[1][i])
+		}
+	}
+}
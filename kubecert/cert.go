@@ -0,0 +1,302 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"time"
+)
+
+// certificate roles, they decide the key usages of an issued leaf certificate
+const (
+	roleServer = "server"
+	roleClient = "client"
+	rolePeer   = "peer"
+)
+
+// supported private key algorithms
+const (
+	keyRSA2048   = "rsa2048"
+	keyRSA3072   = "rsa3072"
+	keyRSA4096   = "rsa4096"
+	keyECDSAP256 = "ecdsa-p256"
+	keyECDSAP384 = "ecdsa-p384"
+	keyEd25519   = "ed25519"
+)
+
+// private key encodings, pkcs8 works for every algorithm while the legacy
+// encoding is PKCS#1 for RSA and SEC 1 for ECDSA keys
+const (
+	keyEncodingPKCS8  = "pkcs8"
+	keyEncodingLegacy = "legacy"
+)
+
+// keyOptions describes how to generate and encode a private key
+type keyOptions struct {
+	algorithm string
+	encoding  string
+}
+
+// certOptions describes a certificate to issue
+type certOptions struct {
+	commonName   string
+	organization []string
+	dnsNames     []string
+	ipAddresses  []net.IP
+	role         string
+	validity     time.Duration
+	key          keyOptions
+}
+
+// certificateAuthority holds a CA certificate and its private key used to sign leaf certificates
+type certificateAuthority struct {
+	cert    *x509.Certificate
+	key     crypto.Signer
+	certPEM []byte
+	keyPEM  []byte
+}
+
+// newSerialNumber returns a random 128 bit serial number as recommended by RFC 5280
+func newSerialNumber() (*big.Int, error) {
+	limit := new(big.Int).Lsh(big.NewInt(1), 128)
+	return rand.Int(rand.Reader, limit)
+}
+
+// subjectKeyID computes the key identifier from the public key as described in RFC 5280 4.2.1.2
+func subjectKeyID(pub crypto.PublicKey) ([]byte, error) {
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return nil, err
+	}
+	var spki struct {
+		Algorithm        pkix.AlgorithmIdentifier
+		SubjectPublicKey asn1.BitString
+	}
+	if _, err := asn1.Unmarshal(der, &spki); err != nil {
+		return nil, err
+	}
+	sum := sha1.Sum(spki.SubjectPublicKey.Bytes)
+	return sum[:], nil
+}
+
+func generateKey(algorithm string) (crypto.Signer, error) {
+	switch algorithm {
+	case keyRSA2048:
+		return rsa.GenerateKey(rand.Reader, 2048)
+	case keyRSA3072:
+		return rsa.GenerateKey(rand.Reader, 3072)
+	case keyRSA4096:
+		return rsa.GenerateKey(rand.Reader, 4096)
+	case keyECDSAP256:
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case keyECDSAP384:
+		return ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	case keyEd25519:
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		return key, err
+	}
+	return nil, fmt.Errorf("unsupported key algorithm %q", algorithm)
+}
+
+func encodeKey(key crypto.Signer, encoding string) ([]byte, error) {
+	switch encoding {
+	case keyEncodingPKCS8:
+		der, err := x509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			return nil, err
+		}
+		return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), nil
+	case keyEncodingLegacy:
+		switch k := key.(type) {
+		case *rsa.PrivateKey:
+			return pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(k)}), nil
+		case *ecdsa.PrivateKey:
+			der, err := x509.MarshalECPrivateKey(k)
+			if err != nil {
+				return nil, err
+			}
+			return pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), nil
+		}
+		return nil, fmt.Errorf("%T keys can only be encoded as pkcs8", key)
+	}
+	return nil, fmt.Errorf("unsupported key encoding %q", encoding)
+}
+
+// keyUsage returns the key usages that apply to a leaf certificate for key.
+// Only RSA keys can be used for key encipherment.
+func keyUsage(key crypto.Signer) x509.KeyUsage {
+	if _, ok := key.(*rsa.PrivateKey); ok {
+		return x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment
+	}
+	return x509.KeyUsageDigitalSignature
+}
+
+// generateCA creates a new self-signed CA certificate
+func generateCA(commonName string, organization []string, validity time.Duration, keyOpts keyOptions) (*certificateAuthority, error) {
+	key, err := generateKey(keyOpts.algorithm)
+	if err != nil {
+		return nil, err
+	}
+	serial, err := newSerialNumber()
+	if err != nil {
+		return nil, err
+	}
+	skid, err := subjectKeyID(key.Public())
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	template := x509.Certificate{
+		SerialNumber: serial,
+		Subject: pkix.Name{
+			Organization: organization,
+			CommonName:   commonName,
+		},
+		NotBefore:             now.Add(-5 * time.Minute), // tolerate clock skew
+		NotAfter:              now.Add(validity),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		MaxPathLenZero:        true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		SubjectKeyId:          skid,
+	}
+
+	certDER, err := x509.CreateCertificate(rand.Reader, &template, &template, key.Public(), key)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := x509.ParseCertificate(certDER)
+	if err != nil {
+		return nil, err
+	}
+	keyPEM, err := encodeKey(key, keyOpts.encoding)
+	if err != nil {
+		return nil, err
+	}
+	return &certificateAuthority{
+		cert:    cert,
+		key:     key,
+		certPEM: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDER}),
+		keyPEM:  keyPEM,
+	}, nil
+}
+
+// parseCA loads a CA from its PEM encoded certificate and private key
+func parseCA(certPEM, keyPEM []byte) (*certificateAuthority, error) {
+	block, _ := pem.Decode(certPEM)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, fmt.Errorf("no certificate found in CA certificate PEM")
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	if !cert.IsCA {
+		return nil, fmt.Errorf("certificate %q is not a CA", cert.Subject.CommonName)
+	}
+	key, err := parsePrivateKey(keyPEM)
+	if err != nil {
+		return nil, err
+	}
+	return &certificateAuthority{cert: cert, key: key, certPEM: certPEM, keyPEM: keyPEM}, nil
+}
+
+func parsePrivateKey(keyPEM []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(keyPEM)
+	if block == nil {
+		return nil, fmt.Errorf("no private key found in PEM")
+	}
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		return x509.ParseECPrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		signer, ok := key.(crypto.Signer)
+		if !ok {
+			return nil, fmt.Errorf("unsupported private key type %T", key)
+		}
+		return signer, nil
+	}
+	return nil, fmt.Errorf("unsupported private key type %q", block.Type)
+}
+
+// issue creates a leaf certificate for opts signed by the CA
+func (ca *certificateAuthority) issue(opts certOptions) (certPEM, keyPEM []byte, err error) {
+	key, err := generateKey(opts.key.algorithm)
+	if err != nil {
+		return nil, nil, err
+	}
+	serial, err := newSerialNumber()
+	if err != nil {
+		return nil, nil, err
+	}
+	skid, err := subjectKeyID(key.Public())
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var extKeyUsage []x509.ExtKeyUsage
+	switch opts.role {
+	case roleServer:
+		extKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+	case roleClient:
+		extKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+	case rolePeer:
+		extKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth}
+	default:
+		return nil, nil, fmt.Errorf("unknown certificate role %q", opts.role)
+	}
+	if opts.role != roleClient && len(opts.dnsNames) == 0 && len(opts.ipAddresses) == 0 {
+		return nil, nil, fmt.Errorf("a %s certificate needs at least one DNS name or IP address", opts.role)
+	}
+
+	now := time.Now()
+	notAfter := now.Add(opts.validity)
+	// a certificate can't outlive its issuer
+	if notAfter.After(ca.cert.NotAfter) {
+		notAfter = ca.cert.NotAfter
+	}
+	template := x509.Certificate{
+		SerialNumber: serial,
+		Subject: pkix.Name{
+			Organization: opts.organization,
+			CommonName:   opts.commonName,
+		},
+		DNSNames:              opts.dnsNames,
+		IPAddresses:           opts.ipAddresses,
+		NotBefore:             now.Add(-5 * time.Minute),
+		NotAfter:              notAfter,
+		BasicConstraintsValid: true,
+		KeyUsage:              keyUsage(key),
+		ExtKeyUsage:           extKeyUsage,
+		SubjectKeyId:          skid,
+		AuthorityKeyId:        ca.cert.SubjectKeyId,
+	}
+
+	certDER, err := x509.CreateCertificate(rand.Reader, &template, ca.cert, key.Public(), ca.key)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyPEM, err = encodeKey(key, opts.key.encoding)
+	if err != nil {
+		return nil, nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDER}), keyPEM, nil
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+var testKeyAlgorithms = []struct {
+	algorithm string
+	check     func(key interface{}) bool
+}{
+	{keyRSA2048, func(key interface{}) bool { k, ok := key.(*rsa.PrivateKey); return ok && k.N.BitLen() == 2048 }},
+	{keyRSA3072, func(key interface{}) bool { k, ok := key.(*rsa.PrivateKey); return ok && k.N.BitLen() == 3072 }},
+	{keyRSA4096, func(key interface{}) bool { k, ok := key.(*rsa.PrivateKey); return ok && k.N.BitLen() == 4096 }},
+	{keyECDSAP256, func(key interface{}) bool {
+		k, ok := key.(*ecdsa.PrivateKey)
+		return ok && k.Curve.Params().Name == "P-256"
+	}},
+	{keyECDSAP384, func(key interface{}) bool {
+		k, ok := key.(*ecdsa.PrivateKey)
+		return ok && k.Curve.Params().Name == "P-384"
+	}},
+	{keyEd25519, func(key interface{}) bool { _, ok := key.(ed25519.PrivateKey); return ok }},
+}
+
+func parseCertPEM(t *testing.T, certPEM []byte) *x509.Certificate {
+	t.Helper()
+	block, _ := pem.Decode(certPEM)
+	if block == nil || block.Type != "CERTIFICATE" {
+		t.Fatalf("no certificate in %q", certPEM)
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+func parsePKCS8PEM(t *testing.T, keyPEM []byte) interface{} {
+	t.Helper()
+	block, _ := pem.Decode(keyPEM)
+	if block == nil || block.Type != "PRIVATE KEY" {
+		t.Fatalf("no PKCS#8 private key in PEM")
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+// handshake serves certPEM and keyPEM on a local listener and completes a TLS handshake
+// with a client trusting only the CA
+func handshake(t *testing.T, ca *certificateAuthority, certPEM, keyPEM []byte) {
+	t.Helper()
+	pair, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{pair}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	serverErr := make(chan error, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			serverErr <- err
+			return
+		}
+		defer conn.Close()
+		_, err = conn.Write([]byte("ok"))
+		serverErr <- err
+	}()
+
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(ca.certPEM)
+	conn, err := tls.Dial("tcp", listener.Addr().String(), &tls.Config{RootCAs: roots, ServerName: "localhost"})
+	if err != nil {
+		t.Fatalf("handshake failed: %v", err)
+	}
+	defer conn.Close()
+	if msg, err := io.ReadAll(io.LimitReader(conn, 2)); err != nil || string(msg) != "ok" {
+		t.Fatalf("unexpected response %q: %v", msg, err)
+	}
+	if err := <-serverErr; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestIssueCertificate(t *testing.T) {
+	for _, tt := range testKeyAlgorithms {
+		t.Run(tt.algorithm, func(t *testing.T) {
+			keyOpts := keyOptions{algorithm: tt.algorithm, encoding: keyEncodingPKCS8}
+			ca, err := generateCA("kubecert-test-ca", []string{"kubecert"}, 24*time.Hour, keyOpts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !tt.check(parsePKCS8PEM(t, ca.keyPEM)) {
+				t.Errorf("CA key is not a %s key", tt.algorithm)
+			}
+
+			certPEM, keyPEM, err := ca.issue(certOptions{
+				commonName:  "localhost",
+				dnsNames:    []string{"localhost"},
+				ipAddresses: []net.IP{net.ParseIP("127.0.0.1")},
+				role:        roleServer,
+				validity:    time.Hour,
+				key:         keyOpts,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			leaf := parseCertPEM(t, certPEM)
+			roots := x509.NewCertPool()
+			roots.AddCert(ca.cert)
+			if _, err := leaf.Verify(x509.VerifyOptions{
+				DNSName:   "localhost",
+				Roots:     roots,
+				KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+			}); err != nil {
+				t.Fatalf("chain doesn't verify: %v", err)
+			}
+
+			key := parsePKCS8PEM(t, keyPEM)
+			if !tt.check(key) {
+				t.Errorf("leaf key is not a %s key", tt.algorithm)
+			}
+			if pub := key.(crypto.Signer).Public(); !pub.(interface{ Equal(crypto.PublicKey) bool }).Equal(leaf.PublicKey) {
+				t.Error("leaf key doesn't match the certificate")
+			}
+
+			handshake(t, ca, certPEM, keyPEM)
+		})
+	}
+}
+
+func TestParseCA(t *testing.T) {
+	for _, encoding := range []string{keyEncodingPKCS8, keyEncodingLegacy} {
+		t.Run(encoding, func(t *testing.T) {
+			ca, err := generateCA("kubecert-test-ca", nil, time.Hour, keyOptions{algorithm: keyECDSAP256, encoding: encoding})
+			if err != nil {
+				t.Fatal(err)
+			}
+			parsed, err := parseCA(ca.certPEM, ca.keyPEM)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !parsed.cert.Equal(ca.cert) {
+				t.Error("parsed CA certificate differs")
+			}
+		})
+	}
+}
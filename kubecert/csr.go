@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	certificatesv1 "k8s.io/api/certificates/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/clientcmd"
+	"log"
+	"net"
+	"time"
+)
+
+// runCSR implements the `csr` command which has the certificate signed by a cluster signer
+// through a CertificateSigningRequest instead of the kubecert CA
+func runCSR(args []string) {
+	fs := flag.NewFlagSet("csr", flag.ExitOnError)
+	kubeconfig := kubeconfigFlag(fs)
+	namespace := fs.String("namespace", "cert", "namespace of the secret")
+	secretName := fs.String("secret", "cert-secret", "name of the secret to store the issued certificate in")
+	commonName := fs.String("cn", "", "common name of the certificate, the user name for client certificates")
+	organization := fs.String("org", "", "comma separated organizations of the certificate, the groups for client certificates")
+	dnsNames := fs.String("dns", "", "comma separated DNS names of the certificate")
+	ipAddresses := fs.String("ip", "", "comma separated IP addresses of the certificate")
+	signerName := fs.String("signer", certificatesv1.KubeAPIServerClientSignerName, "signer name of the CertificateSigningRequest")
+	usages := fs.String("usages", "digital signature,key encipherment,client auth", "comma separated key usages to request")
+	expiration := fs.Duration("expiration", 0, "requested validity of the certificate, the signer decides when unset (minimum 10m)")
+	keyAlgorithm := fs.String("key-algorithm", keyRSA2048, "private key algorithm, one of rsa2048, rsa3072, rsa4096, ecdsa-p256, ecdsa-p384 or ed25519")
+	keyEncoding := fs.String("key-encoding", keyEncodingPKCS8, "private key encoding, pkcs8 or legacy (PKCS#1 for RSA, SEC 1 for ECDSA)")
+	approve := fs.Bool("approve", false, "approve the CertificateSigningRequest, requires permission to approve for the signer")
+	timeout := fs.Duration("timeout", 5*time.Minute, "how long to wait for the certificate to be signed")
+	_ = fs.Parse(args)
+
+	if *commonName == "" {
+		log.Fatal("-cn is required")
+	}
+	req := csrRequest{
+		commonName:   *commonName,
+		organization: splitList(*organization),
+		dnsNames:     splitList(*dnsNames),
+		signerName:   *signerName,
+		expiration:   *expiration,
+		key: keyOptions{
+			algorithm: *keyAlgorithm,
+			encoding:  *keyEncoding,
+		},
+	}
+	for _, v := range splitList(*ipAddresses) {
+		ip := net.ParseIP(v)
+		if ip == nil {
+			log.Fatalf("invalid IP address %q", v)
+		}
+		req.ipAddresses = append(req.ipAddresses, ip)
+	}
+	for _, u := range splitList(*usages) {
+		req.usages = append(req.usages, certificatesv1.KeyUsage(u))
+	}
+
+	config, err := clientcmd.BuildConfigFromFlags("", *kubeconfig)
+	if err != nil {
+		log.Fatal(err)
+	}
+	clientset, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+
+	name, certPEM, keyPEM, err := requestCertificate(ctx, clientset, req, *secretName, *approve)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	caPEM, err := clusterCABundle(ctx, clientset, *namespace, config.TLSClientConfig.CAData)
+	if err != nil {
+		log.Fatal(err)
+	}
+	secret, err := buildTLSSecret(*namespace, *secretName, certPEM, keyPEM, caPEM)
+	if err != nil {
+		log.Fatal(err)
+	}
+	secret.Annotations[signerAnnotation] = req.signerName
+	secret.Annotations[csrAnnotation] = name
+	if err := applySecret(clientset, secret, false); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// csrRequest describes a certificate to request from a cluster signer
+type csrRequest struct {
+	commonName   string
+	organization []string
+	dnsNames     []string
+	ipAddresses  []net.IP
+	signerName   string
+	usages       []certificatesv1.KeyUsage
+	expiration   time.Duration
+	key          keyOptions
+}
+
+// requestCertificate generates a key, submits a CertificateSigningRequest for it, optionally
+// approves it and waits until the signer issued the certificate.
+// It returns the name of the CertificateSigningRequest with the PEM certificate and key.
+func requestCertificate(ctx context.Context, clientset kubernetes.Interface, req csrRequest, generateName string, approve bool) (string, []byte, []byte, error) {
+	key, err := generateKey(req.key.algorithm)
+	if err != nil {
+		return "", nil, nil, err
+	}
+	keyPEM, err := encodeKey(key, req.key.encoding)
+	if err != nil {
+		return "", nil, nil, err
+	}
+	der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject: pkix.Name{
+			CommonName:   req.commonName,
+			Organization: req.organization,
+		},
+		DNSNames:    req.dnsNames,
+		IPAddresses: req.ipAddresses,
+	}, key)
+	if err != nil {
+		return "", nil, nil, err
+	}
+
+	csr := &certificatesv1.CertificateSigningRequest{
+		ObjectMeta: metav1.ObjectMeta{
+			GenerateName: generateName + "-",
+			Labels: map[string]string{
+				managedByLabel: managedByValue,
+			},
+		},
+		Spec: certificatesv1.CertificateSigningRequestSpec{
+			Request:    pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: der}),
+			SignerName: req.signerName,
+			Usages:     req.usages,
+		},
+	}
+	if req.expiration > 0 {
+		seconds := int32(req.expiration / time.Second)
+		csr.Spec.ExpirationSeconds = &seconds
+	}
+	csr, err = clientset.CertificatesV1().CertificateSigningRequests().Create(ctx, csr, metav1.CreateOptions{})
+	if err != nil {
+		return "", nil, nil, err
+	}
+	fmt.Printf("CertificateSigningRequest %s created for signer %s\n", csr.Name, req.signerName)
+
+	if approve {
+		csr.Status.Conditions = append(csr.Status.Conditions, certificatesv1.CertificateSigningRequestCondition{
+			Type:           certificatesv1.CertificateApproved,
+			Status:         corev1.ConditionTrue,
+			Reason:         "KubecertApprove",
+			Message:        "approved by kubecert",
+			LastUpdateTime: metav1.Now(),
+		})
+		_, err = clientset.CertificatesV1().CertificateSigningRequests().UpdateApproval(ctx, csr.Name, csr, metav1.UpdateOptions{})
+		if apierrors.IsForbidden(err) {
+			return "", nil, nil, fmt.Errorf("not allowed to approve CertificateSigningRequest %s for signer %s: %w", csr.Name, req.signerName, err)
+		}
+		if err != nil {
+			return "", nil, nil, err
+		}
+		fmt.Printf("CertificateSigningRequest %s approved\n", csr.Name)
+	} else {
+		fmt.Printf("Waiting for CertificateSigningRequest %s to be approved, run: kubectl certificate approve %s\n", csr.Name, csr.Name)
+	}
+
+	certPEM, err := waitForCertificate(ctx, clientset, csr.Name)
+	if err != nil {
+		return "", nil, nil, err
+	}
+	return csr.Name, certPEM, keyPEM, nil
+}
+
+// waitForCertificate polls the CertificateSigningRequest until the certificate is issued or the
+// request is denied or failed
+func waitForCertificate(ctx context.Context, clientset kubernetes.Interface, name string) ([]byte, error) {
+	var certPEM []byte
+	err := wait.PollUntilContextCancel(ctx, 2*time.Second, true, func(ctx context.Context) (bool, error) {
+		csr, err := clientset.CertificatesV1().CertificateSigningRequests().Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return false, err
+		}
+		for _, c := range csr.Status.Conditions {
+			if c.Type == certificatesv1.CertificateDenied || c.Type == certificatesv1.CertificateFailed {
+				return false, fmt.Errorf("CertificateSigningRequest %s %s: %s %s", name, c.Type, c.Reason, c.Message)
+			}
+		}
+		if len(csr.Status.Certificate) == 0 {
+			return false, nil
+		}
+		certPEM = csr.Status.Certificate
+		return true, nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed waiting for the certificate of CertificateSigningRequest %s: %w", name, err)
+	}
+	return certPEM, nil
+}
+
+// clusterCABundle returns the CA bundle of the cluster, published in every namespace by the
+// root CA publisher, falling back to the CA of the kubeconfig
+func clusterCABundle(ctx context.Context, clientset kubernetes.Interface, namespace string, fallback []byte) ([]byte, error) {
+	cm, err := clientset.CoreV1().ConfigMaps(namespace).Get(ctx, "kube-root-ca.crt", metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return fallback, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return []byte(cm.Data["ca.crt"]), nil
+}
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/x509"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/clientcmd"
+	"log"
+	"os"
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+// additional keys written by the import command
+const (
+	keystoreKey      = "keystore.p12"
+	truststoreKey    = "truststore.p12"
+	leafCertKey      = "leaf.crt"
+	intermediatesKey = "intermediates.crt"
+)
+
+// sourceAnnotation is set to "import" on secrets holding imported certificates, they are not
+// rotated because kubecert doesn't hold the key of their issuer
+const sourceAnnotation = "kubecert.io/source"
+
+// certBundle is a certificate with its private key, its intermediate CAs and the roots it chains to
+type certBundle struct {
+	key           crypto.Signer
+	keyPEM        []byte
+	leaf          *x509.Certificate
+	intermediates []*x509.Certificate
+	roots         []*x509.Certificate
+}
+
+// runImport implements the `import` command which stores an existing certificate in a TLS secret,
+// optionally converting it to PKCS#12 keystores for Java workloads
+func runImport(args []string) {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	kubeconfig := kubeconfigFlag(fs)
+	namespace := fs.String("namespace", "cert", "namespace of the secret")
+	secretName := fs.String("secret", "cert-secret", "name of the secret to store the certificate in")
+	certFiles := fs.String("cert", "", "comma separated PEM files with the certificate chain, merged in any order")
+	keyFile := fs.String("key", "", "PEM file with the private key of the certificate")
+	caFiles := fs.String("ca", "", "comma separated PEM files with the root CAs (default: the self-signed certificates of the chain)")
+	pkcs12File := fs.String("pkcs12-in", "", "PKCS#12 file to import instead of -cert and -key, it is decrypted with the keystore password")
+	writePKCS12 := fs.Bool("pkcs12", false, "add keystore.p12 and truststore.p12 to the secret")
+	passwordSecret := fs.String("password-secret", "", "secret in -namespace holding the keystore password")
+	passwordKey := fs.String("password-key", "password", "key of the keystore password in -password-secret")
+	profile := fs.String("pkcs12-profile", "modern", "PKCS#12 encryption, modern (AES-256, Java 11+) or legacy (RC2/3DES)")
+	split := fs.Bool("split", false, "also store the leaf and the intermediates as separate PEM keys")
+	dryRun := fs.Bool("dry-run", false, "print the secret manifest instead of applying it")
+	_ = fs.Parse(args)
+
+	var encoder *pkcs12.Encoder
+	switch *profile {
+	case "modern":
+		encoder = pkcs12.Modern
+	case "legacy":
+		encoder = pkcs12.LegacyDES
+	default:
+		log.Fatalf("unknown PKCS#12 profile %q", *profile)
+	}
+
+	config, err := clientcmd.BuildConfigFromFlags("", *kubeconfig)
+	if err != nil {
+		log.Fatal(err)
+	}
+	clientset, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var password string
+	if *passwordSecret != "" {
+		password, err = readPassword(clientset, *namespace, *passwordSecret, *passwordKey)
+		if err != nil {
+			log.Fatal(err)
+		}
+	} else if *writePKCS12 || *pkcs12File != "" {
+		log.Fatal("-password-secret is required for PKCS#12 keystores")
+	}
+
+	var bundle *certBundle
+	if *pkcs12File != "" {
+		bundle, err = loadPKCS12Bundle(*pkcs12File, password)
+	} else {
+		bundle, err = loadPEMBundle(splitList(*certFiles), *keyFile, splitList(*caFiles))
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := bundle.verify(); err != nil {
+		log.Fatal(err)
+	}
+
+	secret, err := buildTLSSecret(*namespace, *secretName, bundle.chainPEM(), bundle.keyPEM, encodeCertificates(bundle.roots...))
+	if err != nil {
+		log.Fatal(err)
+	}
+	secret.Annotations[sourceAnnotation] = "import"
+	if len(bundle.roots) == 0 {
+		delete(secret.Data, "ca.crt")
+	}
+	if *split {
+		secret.Data[leafCertKey] = encodeCertificates(bundle.leaf)
+		secret.Data[intermediatesKey] = encodeCertificates(bundle.intermediates...)
+	}
+	if *writePKCS12 {
+		keystore, err := encoder.Encode(bundle.key, bundle.leaf, append(append([]*x509.Certificate{}, bundle.intermediates...), bundle.roots...), password)
+		if err != nil {
+			log.Fatal(err)
+		}
+		truststore, err := encoder.EncodeTrustStore(bundle.roots, password)
+		if err != nil {
+			log.Fatal(err)
+		}
+		secret.Data[keystoreKey] = keystore
+		secret.Data[truststoreKey] = truststore
+	}
+
+	if err := applySecret(clientset, secret, *dryRun); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// readPassword reads a password from a key of a secret
+func readPassword(clientset kubernetes.Interface, namespace, name, key string) (string, error) {
+	secret, err := clientset.CoreV1().Secrets(namespace).Get(context.TODO(), name, metav1.GetOptions{})
+	if err != nil {
+		return "", err
+	}
+	password, ok := secret.Data[key]
+	if !ok {
+		return "", fmt.Errorf("secret %s/%s has no key %q", namespace, name, key)
+	}
+	return string(bytes.TrimRight(password, "\r\n")), nil
+}
+
+// loadPEMBundle reads the certificates and key from PEM files and sorts the certificates into the
+// leaf matching the key, the intermediates in issuing order and the roots
+func loadPEMBundle(certFiles []string, keyFile string, caFiles []string) (*certBundle, error) {
+	if len(certFiles) == 0 || keyFile == "" {
+		return nil, fmt.Errorf("-cert and -key are required")
+	}
+	keyPEM, err := os.ReadFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	key, err := parsePrivateKey(keyPEM)
+	if err != nil {
+		return nil, err
+	}
+	certs, err := readCertificates(certFiles)
+	if err != nil {
+		return nil, err
+	}
+	var roots []*x509.Certificate
+	if len(caFiles) > 0 {
+		if roots, err = readCertificates(caFiles); err != nil {
+			return nil, err
+		}
+	}
+
+	bundle, err := sortChain(key, certs, roots)
+	if err != nil {
+		return nil, err
+	}
+	bundle.keyPEM = keyPEM
+	return bundle, nil
+}
+
+// loadPKCS12Bundle reads the key and certificates from a PKCS#12 file
+func loadPKCS12Bundle(filename, password string) (*certBundle, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	privateKey, leaf, caCerts, err := pkcs12.DecodeChain(data, password)
+	if err != nil {
+		return nil, err
+	}
+	key, ok := privateKey.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported private key type %T", privateKey)
+	}
+	keyPEM, err := encodeKey(key, keyEncodingPKCS8)
+	if err != nil {
+		return nil, err
+	}
+	bundle, err := sortChain(key, append([]*x509.Certificate{leaf}, caCerts...), nil)
+	if err != nil {
+		return nil, err
+	}
+	bundle.keyPEM = keyPEM
+	return bundle, nil
+}
+
+// readCertificates returns every certificate of the PEM files, dropping duplicates
+func readCertificates(filenames []string) ([]*x509.Certificate, error) {
+	var certs []*x509.Certificate
+	seen := map[string]bool{}
+	for _, filename := range filenames {
+		data, err := os.ReadFile(filename)
+		if err != nil {
+			return nil, err
+		}
+		for {
+			var block *pem.Block
+			block, data = pem.Decode(data)
+			if block == nil {
+				break
+			}
+			if block.Type != "CERTIFICATE" {
+				continue
+			}
+			cert, err := x509.ParseCertificate(block.Bytes)
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse certificate in %s: %w", filename, err)
+			}
+			if fp := fingerprint(cert); !seen[fp] {
+				seen[fp] = true
+				certs = append(certs, cert)
+			}
+		}
+	}
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("no certificate found in %v", filenames)
+	}
+	return certs, nil
+}
+
+// sortChain finds the certificate of key and follows its issuers through certs.
+// Self-signed issuers are roots, unless roots are given explicitly.
+func sortChain(key crypto.Signer, certs, roots []*x509.Certificate) (*certBundle, error) {
+	bundle := &certBundle{key: key, roots: roots}
+	for _, cert := range certs {
+		if publicKeysEqual(key.Public(), cert.PublicKey) {
+			bundle.leaf = cert
+			break
+		}
+	}
+	if bundle.leaf == nil {
+		return nil, fmt.Errorf("none of the certificates matches the private key")
+	}
+
+	used := map[*x509.Certificate]bool{bundle.leaf: true}
+	for cur := bundle.leaf; ; {
+		var issuer *x509.Certificate
+		for _, cert := range certs {
+			if !used[cert] && bytes.Equal(cert.RawSubject, cur.RawIssuer) && cur.CheckSignatureFrom(cert) == nil {
+				issuer = cert
+				break
+			}
+		}
+		if issuer == nil {
+			break
+		}
+		used[issuer] = true
+		if bytes.Equal(issuer.RawSubject, issuer.RawIssuer) {
+			if len(roots) == 0 {
+				bundle.roots = append(bundle.roots, issuer)
+			}
+			break
+		}
+		bundle.intermediates = append(bundle.intermediates, issuer)
+		cur = issuer
+	}
+	for _, cert := range certs {
+		if !used[cert] {
+			log.Println("Ignoring certificate", cert.Subject, "which is not part of the chain of", bundle.leaf.Subject)
+		}
+	}
+	return bundle, nil
+}
+
+func publicKeysEqual(a, b crypto.PublicKey) bool {
+	k, ok := a.(interface{ Equal(crypto.PublicKey) bool })
+	return ok && k.Equal(b)
+}
+
+// verify checks that the key matches the certificate and, when roots are known, that the
+// certificate chains up to one of them
+func (b *certBundle) verify() error {
+	if !publicKeysEqual(b.key.Public(), b.leaf.PublicKey) {
+		return fmt.Errorf("the private key doesn't match certificate %s", b.leaf.Subject)
+	}
+	if len(b.roots) == 0 {
+		log.Println("No root CA found, the chain of", b.leaf.Subject, "is not verified")
+		return nil
+	}
+	opts := x509.VerifyOptions{
+		Roots:         x509.NewCertPool(),
+		Intermediates: x509.NewCertPool(),
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	}
+	for _, cert := range b.roots {
+		opts.Roots.AddCert(cert)
+	}
+	for _, cert := range b.intermediates {
+		opts.Intermediates.AddCert(cert)
+	}
+	if _, err := b.leaf.Verify(opts); err != nil {
+		return fmt.Errorf("failed to verify the chain of %s: %w", b.leaf.Subject, err)
+	}
+	return nil
+}
+
+// chainPEM returns the leaf followed by the intermediates, the format expected in tls.crt
+func (b *certBundle) chainPEM() []byte {
+	return encodeCertificates(append([]*x509.Certificate{b.leaf}, b.intermediates...)...)
+}
+
+func encodeCertificates(certs ...*x509.Certificate) []byte {
+	var buf bytes.Buffer
+	for _, cert := range certs {
+		_ = pem.Encode(&buf, &pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+	}
+	return buf.Bytes()
+}
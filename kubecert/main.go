@@ -2,91 +2,147 @@ package main
 
 import (
 	"context"
-	"crypto/rand"
-	"crypto/rsa"
-	"crypto/x509"
-	"crypto/x509/pkix"
-	"encoding/pem"
 	"flag"
-	"fmt"
 	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/tools/clientcmd"
 	"k8s.io/client-go/util/homedir"
 	"log"
-	"math/big"
+	"net"
+	"os"
 	"path/filepath"
+	"strings"
 	"time"
 )
 
-func generateSelfSignedCert(host string) (certPEM, keyPEM []byte, err error) {
-	// Generate a private key (RSA is the default)
-	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
-	if err != nil {
-		return nil, nil, err
+// loadOrCreateCA loads the CA from the given PEM files, or from the CA secret in the cluster.
+// If neither exists a new CA is generated and stored in the CA secret.
+func loadOrCreateCA(clientset kubernetes.Interface, namespace, caSecretName, caCertFile, caKeyFile string, organization []string, validity time.Duration, keyOpts keyOptions, dryRun bool) (*certificateAuthority, error) {
+	if caCertFile != "" || caKeyFile != "" {
+		certPEM, err := os.ReadFile(caCertFile)
+		if err != nil {
+			return nil, err
+		}
+		keyPEM, err := os.ReadFile(caKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		return parseCA(certPEM, keyPEM)
 	}
 
-	// Create a certificate template
-	template := x509.Certificate{
-		SerialNumber: big.NewInt(1),
-		Subject: pkix.Name{
-			Organization: []string{"Your Organization"},
-			CommonName:   host,
-		},
-		NotBefore:   time.Now(),
-		NotAfter:    time.Now().Add(time.Hour * 24 * 365), // Valid for one year
-		IsCA:        true,
-		KeyUsage:    x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
-		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	ca, err := loadCASecret(clientset, namespace, caSecretName)
+	if err == nil {
+		return ca, nil
+	}
+	if !apierrors.IsNotFound(err) {
+		return nil, err
 	}
 
-	// Generate the certificate using the correct public key type
-	certDER, err := x509.CreateCertificate(rand.Reader, &template, &template, &privateKey.PublicKey, privateKey)
+	ca, err = generateCA("kubecert-ca", organization, validity, keyOpts)
 	if err != nil {
-		return nil, nil, err
+		return nil, err
 	}
-
-	certPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDER})
-	keyPEM = pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(privateKey)})
-
-	return certPEM, keyPEM, nil
-
+	caSecret, err := buildTLSSecret(namespace, caSecretName, ca.certPEM, ca.keyPEM, ca.certPEM)
+	if err != nil {
+		return nil, err
+	}
+	caSecret.Labels[caLabel] = "true"
+	if err := applySecret(clientset, caSecret, dryRun); err != nil {
+		return nil, err
+	}
+	return ca, nil
 }
 
-func createSecret(clientset *kubernetes.Clientset, namespace string, secretName string, certPEM, keyPEM []byte) error {
-	secret := &corev1.Secret{
-		ObjectMeta: metav1.ObjectMeta{
-			Name:      secretName,
-			Namespace: namespace,
-		},
-		Type: corev1.SecretTypeOpaque,
-		Data: map[string][]byte{
-			"tls.crt": certPEM,
-			"tls.key": keyPEM,
-		},
+// loadCASecret loads the CA stored in a secret
+func loadCASecret(clientset kubernetes.Interface, namespace, name string) (*certificateAuthority, error) {
+	secret, err := clientset.CoreV1().Secrets(namespace).Get(context.TODO(), name, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
 	}
+	return parseCA(secret.Data[corev1.TLSCertKey], secret.Data[corev1.TLSPrivateKeyKey])
+}
 
-	_, err := clientset.CoreV1().Secrets(namespace).Create(context.TODO(), secret, metav1.CreateOptions{})
-	if err != nil {
-		return err
+// kubeconfigFlag registers the -kubeconfig flag on fs
+func kubeconfigFlag(fs *flag.FlagSet) *string {
+	if home := homedir.HomeDir(); home != "" {
+		return fs.String("kubeconfig", filepath.Join(home, ".kube", "config"), "(optional) absolute path to the kubeconfig file")
 	}
+	return fs.String("kubeconfig", "", "absolute path to the kubeconfig file")
+}
 
-	fmt.Printf("Secret %s created successfully in namespace %s\n", secretName, namespace)
-	return nil
+// splitList splits a comma separated flag value, dropping empty elements
+func splitList(s string) []string {
+	var out []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			out = append(out, v)
+		}
+	}
+	return out
 }
 
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "rotate":
+			runRotate(os.Args[2:])
+			return
+		case "scan":
+			runScan(os.Args[2:])
+			return
+		case "csr":
+			runCSR(os.Args[2:])
+			return
+		case "webhook":
+			runWebhook(os.Args[2:])
+			return
+		case "import":
+			runImport(os.Args[2:])
+			return
+		}
+	}
+
 	// Load Kubernetes configuration
 	// parse the .kubeconfig file
-	var kubeconfig *string
-	if home := homedir.HomeDir(); home != "" {
-		kubeconfig = flag.String("kubeconfig", filepath.Join(home, ".kube", "config"), "(optional) absolute path to the kubeconfig file")
-	} else {
-		kubeconfig = flag.String("kubeconfig", "", "absolute path to the kubeconfig file")
-	}
+	kubeconfig := kubeconfigFlag(flag.CommandLine)
+	namespace := flag.String("namespace", "cert", "namespace of the secrets")
+	secretName := flag.String("secret", "cert-secret", "name of the secret to store the issued certificate in")
+	commonName := flag.String("cn", "localhost", "common name of the certificate")
+	dnsNames := flag.String("dns", "localhost", "comma separated DNS names of the certificate")
+	ipAddresses := flag.String("ip", "", "comma separated IP addresses of the certificate")
+	organization := flag.String("org", "kubecert", "comma separated organizations of the certificate")
+	role := flag.String("role", roleServer, "certificate role, one of server, client or peer")
+	validity := flag.Duration("validity", 365*24*time.Hour, "validity of the certificate")
+	caSecretName := flag.String("ca-secret", "kubecert-ca", "secret holding the CA, it is created if it doesn't exist")
+	caCertFile := flag.String("ca-cert", "", "PEM file with the CA certificate, used instead of the CA secret")
+	caKeyFile := flag.String("ca-key", "", "PEM file with the CA private key, used instead of the CA secret")
+	keyAlgorithm := flag.String("key-algorithm", keyRSA2048, "private key algorithm, one of rsa2048, rsa3072, rsa4096, ecdsa-p256, ecdsa-p384 or ed25519")
+	keyEncoding := flag.String("key-encoding", keyEncodingPKCS8, "private key encoding, pkcs8 or legacy (PKCS#1 for RSA, SEC 1 for ECDSA)")
+	caValidity := flag.Duration("ca-validity", 10*365*24*time.Hour, "validity of a newly created CA")
+	dryRun := flag.Bool("dry-run", false, "print the secret manifests instead of applying them")
 	flag.Parse()
 
+	opts := certOptions{
+		commonName:   *commonName,
+		organization: splitList(*organization),
+		dnsNames:     splitList(*dnsNames),
+		role:         *role,
+		validity:     *validity,
+		key: keyOptions{
+			algorithm: *keyAlgorithm,
+			encoding:  *keyEncoding,
+		},
+	}
+	for _, v := range splitList(*ipAddresses) {
+		ip := net.ParseIP(v)
+		if ip == nil {
+			log.Fatalf("invalid IP address %q", v)
+		}
+		opts.ipAddresses = append(opts.ipAddresses, ip)
+	}
+
 	config, err := clientcmd.BuildConfigFromFlags("", *kubeconfig)
 	if err != nil {
 		panic(err)
@@ -98,17 +154,28 @@ func main() {
 		log.Fatal(err)
 	}
 
-	// Generate self-signed certificate
-	host := "localhost"
-	certPEM, keyPEM, err := generateSelfSignedCert(host)
+	// Load the CA, creating it on first use
+	ca, err := loadOrCreateCA(clientset, *namespace, *caSecretName, *caCertFile, *caKeyFile, opts.organization, *caValidity, opts.key, *dryRun)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	// Create the secret
-	namespace := "cert" // Replace with your desired namespace
-	secretName := "cert-secret"
-	err = createSecret(clientset, namespace, secretName, certPEM, keyPEM)
+	// Issue the certificate signed by the CA
+	certPEM, keyPEM, err := ca.issue(opts)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Create or update the secret
+	secret, err := buildTLSSecret(*namespace, *secretName, certPEM, keyPEM, ca.certPEM)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *caCertFile == "" {
+		// let the rotation controller find the CA again
+		secret.Annotations[caSecretAnnotation] = *namespace + "/" + *caSecretName
+	}
+	err = applySecret(clientset, secret, *dryRun)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -0,0 +1,431 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/client-go/util/workqueue"
+	"k8s.io/klog/v2"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// restartAnnotation is set on the pod template of the Deployments mounting a rotated
+// secret. Its value changes with every rotation, which triggers a rollout.
+const restartAnnotation = "kubecert.io/certificate-hash"
+
+// runRotate implements the `rotate` command, a long running controller that re-issues the
+// certificates in kubecert managed secrets before they expire
+func runRotate(args []string) {
+	fs := flag.NewFlagSet("rotate", flag.ExitOnError)
+	kubeconfig := kubeconfigFlag(fs)
+	namespace := fs.String("namespace", "", "only rotate secrets in this namespace (default: all namespaces)")
+	renewBefore := fs.Duration("renew-before", 30*24*time.Hour, "re-issue certificates expiring within this duration")
+	resync := fs.Duration("resync", time.Hour, "how often every secret is checked again")
+	caSecretName := fs.String("ca-secret", "kubecert-ca", "CA secret in the namespace of the certificate, used when the certificate doesn't record its CA secret")
+	caCertFile := fs.String("ca-cert", "", "PEM file with the CA certificate, used instead of the CA secrets")
+	caKeyFile := fs.String("ca-key", "", "PEM file with the CA private key, used instead of the CA secrets")
+	_ = fs.Parse(args)
+
+	config, err := clientcmd.BuildConfigFromFlags("", *kubeconfig)
+	if err != nil {
+		klog.Fatal(err)
+	}
+	clientset, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		klog.Fatal(err)
+	}
+	dynamicClient, err := dynamic.NewForConfig(config)
+	if err != nil {
+		klog.Fatal(err)
+	}
+
+	r := &rotator{
+		clientset:       clientset,
+		dynamic:         dynamicClient,
+		renewBefore:     *renewBefore,
+		resync:          *resync,
+		defaultCASecret: *caSecretName,
+		queue:           workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter()),
+	}
+	if *caCertFile != "" || *caKeyFile != "" {
+		certPEM, err := os.ReadFile(*caCertFile)
+		if err != nil {
+			klog.Fatal(err)
+		}
+		keyPEM, err := os.ReadFile(*caKeyFile)
+		if err != nil {
+			klog.Fatal(err)
+		}
+		r.ca, err = parseCA(certPEM, keyPEM)
+		if err != nil {
+			klog.Fatal(err)
+		}
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// only watch the secrets created by kubecert
+	factory := informers.NewSharedInformerFactoryWithOptions(clientset, *resync,
+		informers.WithNamespace(*namespace),
+		informers.WithTweakListOptions(func(opts *metav1.ListOptions) {
+			opts.LabelSelector = managedSelector
+		}))
+	secretInformer := factory.Core().V1().Secrets()
+	r.lister = secretInformer.Lister()
+	_, err = secretInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: r.enqueue,
+		// resyncs show up as updates, so every secret is checked again each resync period
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			r.enqueue(newObj)
+		},
+	})
+	if err != nil {
+		klog.Fatal(err)
+	}
+
+	defer runtime.HandleCrash()
+	defer r.queue.ShutDown()
+
+	factory.Start(ctx.Done())
+	if !cache.WaitForCacheSync(ctx.Done(), secretInformer.Informer().HasSynced) {
+		runtime.HandleError(fmt.Errorf("Timed out waiting for caches to sync"))
+		return
+	}
+
+	klog.Infof("Rotating certificates expiring within %s", *renewBefore)
+	go wait.UntilWithContext(ctx, r.runWorker, time.Second)
+	<-ctx.Done()
+}
+
+// rotator re-issues certificates before they expire
+type rotator struct {
+	clientset       kubernetes.Interface
+	dynamic         dynamic.Interface
+	lister          corelisters.SecretLister
+	queue           workqueue.RateLimitingInterface
+	renewBefore     time.Duration
+	resync          time.Duration
+	defaultCASecret string
+	// ca is set when the CA is loaded from files instead of secrets
+	ca *certificateAuthority
+}
+
+func (r *rotator) enqueue(obj interface{}) {
+	key, err := cache.MetaNamespaceKeyFunc(obj)
+	if err != nil {
+		runtime.HandleError(err)
+		return
+	}
+	r.queue.Add(key)
+}
+
+func (r *rotator) runWorker(ctx context.Context) {
+	for r.processNextItem(ctx) {
+	}
+}
+
+func (r *rotator) processNextItem(ctx context.Context) bool {
+	key, quit := r.queue.Get()
+	if quit {
+		return false
+	}
+	defer r.queue.Done(key)
+
+	err := r.reconcile(ctx, key.(string))
+	if err == nil {
+		r.queue.Forget(key)
+		return true
+	}
+	runtime.HandleError(fmt.Errorf("failed to rotate %s: %w", key, err))
+	r.queue.AddRateLimited(key)
+	return true
+}
+
+// reconcile re-issues the certificate of the secret if it expires within the renew-before window and
+// makes sure the Deployments and webhook configurations using the secret picked up its certificate
+func (r *rotator) reconcile(ctx context.Context, key string) error {
+	namespace, name, err := cache.SplitMetaNamespaceKey(key)
+	if err != nil {
+		return err
+	}
+	secret, err := r.lister.Secrets(namespace).Get(name)
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	cert, err := parseCertificatePEM(secret.Data[corev1.TLSCertKey])
+	if err != nil {
+		return err
+	}
+	renewed := false
+	if remaining := time.Until(cert.NotAfter); remaining <= r.renewBefore {
+		rotated, err := r.rotate(ctx, key, secret, cert, remaining)
+		if err != nil {
+			return err
+		}
+		if rotated != nil {
+			secret = rotated
+			renewed = true
+		}
+	}
+
+	// a previous reconcile may have failed after the secret was written, so the users of the
+	// secret are compared with its certificate every time
+	return r.syncDependents(ctx, secret, renewed)
+}
+
+// rotate re-issues the certificate of the secret and returns the updated secret, or nil if the
+// certificate can't or shouldn't be re-issued by the controller
+func (r *rotator) rotate(ctx context.Context, key string, secret *corev1.Secret, cert *x509.Certificate, remaining time.Duration) (*corev1.Secret, error) {
+	if secret.Annotations[sourceAnnotation] == "import" {
+		klog.Warningf("Imported certificate in secret %s expires in %s, import a renewed certificate", key, remaining.Round(time.Minute))
+		return nil, nil
+	}
+	if signer := secret.Annotations[signerAnnotation]; signer != "" {
+		// the kubecert CA can't re-issue a certificate signed by a cluster signer
+		klog.Warningf("Certificate in secret %s signed by %s expires in %s, renew it with the csr command", key, signer, remaining.Round(time.Minute))
+		return nil, nil
+	}
+	// issue backdates certificates, a certificate issued within the last resync period that is
+	// already due again would be re-issued on every resync
+	if issued := time.Since(cert.NotBefore.Add(5 * time.Minute)); issued < r.resync {
+		klog.Warningf("Certificate in secret %s was issued %s ago and already expires in %s, its validity is shorter than -renew-before %s",
+			key, issued.Round(time.Second), remaining.Round(time.Minute), r.renewBefore)
+		return nil, nil
+	}
+	klog.Infof("Certificate in secret %s expires in %s, re-issuing", key, remaining.Round(time.Minute))
+
+	ca, caSecret, err := r.loadCA(secret)
+	if err != nil {
+		return nil, err
+	}
+	opts, err := certOptionsFromCertificate(cert, secret.Data[corev1.TLSPrivateKeyKey])
+	if err != nil {
+		return nil, err
+	}
+	certPEM, keyPEM, err := ca.issue(opts)
+	if err != nil {
+		return nil, err
+	}
+	rotated, err := buildTLSSecret(secret.Namespace, secret.Name, certPEM, keyPEM, ca.certPEM)
+	if err != nil {
+		return nil, err
+	}
+	// a certificate can't outlive its CA, rotating before the CA is renewed doesn't help
+	notAfter, err := time.Parse(time.RFC3339, rotated.Annotations[notAfterAnnotation])
+	if err != nil {
+		return nil, err
+	}
+	if time.Until(notAfter) <= r.renewBefore {
+		return nil, fmt.Errorf("re-issued certificate would expire at %s, within -renew-before %s, renew the CA %q expiring at %s first",
+			notAfter.Format(time.RFC3339), r.renewBefore, ca.cert.Subject.CommonName, ca.cert.NotAfter.UTC().Format(time.RFC3339))
+	}
+	if caSecret != "" {
+		rotated.Annotations[caSecretAnnotation] = caSecret
+	}
+	webhookTargetsFromAnnotations(secret.Annotations).annotate(rotated.Annotations)
+	if err := applySecret(r.clientset, rotated, false); err != nil {
+		return nil, err
+	}
+	return rotated, nil
+}
+
+// syncDependents patches the caBundle of the webhook configurations recorded on the secret and
+// restarts the Deployments mounting it, unless they already use its current certificate.
+// rotated is set when the certificate was just re-issued.
+func (r *rotator) syncDependents(ctx context.Context, secret *corev1.Secret, rotated bool) error {
+	targets := webhookTargetsFromAnnotations(secret.Annotations)
+	if caPEM := secret.Data["ca.crt"]; !targets.empty() && len(caPEM) > 0 {
+		stale, err := staleCABundles(ctx, r.clientset, r.dynamic, targets, caPEM)
+		if err != nil {
+			return err
+		}
+		if !stale.empty() {
+			if err := patchCABundles(ctx, r.clientset, r.dynamic, stale, caPEM); err != nil {
+				return err
+			}
+		}
+	}
+
+	cert, err := parseCertificatePEM(secret.Data[corev1.TLSCertKey])
+	if err != nil {
+		return err
+	}
+	return r.restartDeployments(ctx, secret.Namespace, secret.Name, fingerprint(cert), rotated)
+}
+
+// loadCA returns the CA that issued the certificate in the secret and the namespace/name of its secret
+func (r *rotator) loadCA(secret *corev1.Secret) (*certificateAuthority, string, error) {
+	if r.ca != nil {
+		return r.ca, "", nil
+	}
+	ref := secret.Annotations[caSecretAnnotation]
+	if ref == "" {
+		ref = secret.Namespace + "/" + r.defaultCASecret
+	}
+	namespace, name, err := cache.SplitMetaNamespaceKey(ref)
+	if err != nil {
+		return nil, "", err
+	}
+	ca, err := loadCASecret(r.clientset, namespace, name)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to load CA from secret %s: %w", ref, err)
+	}
+	return ca, ref, nil
+}
+
+// certOptionsFromCertificate recovers the options a certificate was issued with, so that it can be
+// re-issued with the same subject, SANs, role, key type and validity
+func certOptionsFromCertificate(cert *x509.Certificate, keyPEM []byte) (certOptions, error) {
+	opts := certOptions{
+		commonName:   cert.Subject.CommonName,
+		organization: cert.Subject.Organization,
+		dnsNames:     cert.DNSNames,
+		ipAddresses:  cert.IPAddresses,
+		// issue backdates certificates to tolerate clock skew
+		validity: cert.NotAfter.Sub(cert.NotBefore) - 5*time.Minute,
+	}
+
+	var server, client bool
+	for _, usage := range cert.ExtKeyUsage {
+		switch usage {
+		case x509.ExtKeyUsageServerAuth:
+			server = true
+		case x509.ExtKeyUsageClientAuth:
+			client = true
+		}
+	}
+	switch {
+	case server && client:
+		opts.role = rolePeer
+	case client:
+		opts.role = roleClient
+	default:
+		opts.role = roleServer
+	}
+
+	switch pub := cert.PublicKey.(type) {
+	case *rsa.PublicKey:
+		switch pub.N.BitLen() {
+		case 3072:
+			opts.key.algorithm = keyRSA3072
+		case 4096:
+			opts.key.algorithm = keyRSA4096
+		default:
+			opts.key.algorithm = keyRSA2048
+		}
+	case *ecdsa.PublicKey:
+		if pub.Curve.Params().BitSize == 384 {
+			opts.key.algorithm = keyECDSAP384
+		} else {
+			opts.key.algorithm = keyECDSAP256
+		}
+	case ed25519.PublicKey:
+		opts.key.algorithm = keyEd25519
+	default:
+		return certOptions{}, fmt.Errorf("unsupported public key type %T", pub)
+	}
+
+	opts.key.encoding = keyEncodingPKCS8
+	if block, _ := pem.Decode(keyPEM); block != nil && block.Type != "PRIVATE KEY" {
+		opts.key.encoding = keyEncodingLegacy
+	}
+	return opts, nil
+}
+
+// restartDeployments triggers a rollout of every Deployment in the namespace that mounts the secret
+// by setting a pod template annotation to the fingerprint of the certificate. Deployments without
+// the annotation are only restarted when the certificate was just rotated, so that starting the
+// controller doesn't restart every Deployment. Deployments annotated with an older fingerprint
+// are restarted as well, a previous restart after the rotation failed.
+func (r *rotator) restartDeployments(ctx context.Context, namespace, secretName, hash string, rotated bool) error {
+	deployments, err := r.clientset.AppsV1().Deployments(namespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return err
+	}
+	patch, err := json.Marshal(map[string]interface{}{
+		"spec": map[string]interface{}{
+			"template": map[string]interface{}{
+				"metadata": map[string]interface{}{
+					"annotations": map[string]string{
+						restartAnnotation: hash,
+					},
+				},
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, d := range deployments.Items {
+		if !podSpecUsesSecret(&d.Spec.Template.Spec, secretName) {
+			continue
+		}
+		current, ok := d.Spec.Template.Annotations[restartAnnotation]
+		if current == hash || (!ok && !rotated) {
+			continue
+		}
+		_, err := r.clientset.AppsV1().Deployments(namespace).Patch(ctx, d.Name, types.StrategicMergePatchType, patch, metav1.PatchOptions{})
+		if err != nil {
+			return fmt.Errorf("failed to restart deployment %s: %w", d.Name, err)
+		}
+		klog.Infof("Restarted deployment %s/%s to pick up secret %s", namespace, d.Name, secretName)
+	}
+	return nil
+}
+
+// podSpecUsesSecret reports whether the pod spec mounts the secret or reads it into the environment
+func podSpecUsesSecret(spec *corev1.PodSpec, secretName string) bool {
+	for _, vol := range spec.Volumes {
+		if vol.Secret != nil && vol.Secret.SecretName == secretName {
+			return true
+		}
+		if vol.Projected != nil {
+			for _, src := range vol.Projected.Sources {
+				if src.Secret != nil && src.Secret.Name == secretName {
+					return true
+				}
+			}
+		}
+	}
+	containers := append(append([]corev1.Container{}, spec.InitContainers...), spec.Containers...)
+	for _, c := range containers {
+		for _, env := range c.Env {
+			if env.ValueFrom != nil && env.ValueFrom.SecretKeyRef != nil && env.ValueFrom.SecretKeyRef.Name == secretName {
+				return true
+			}
+		}
+		for _, envFrom := range c.EnvFrom {
+			if envFrom.SecretRef != nil && envFrom.SecretRef.Name == secretName {
+				return true
+			}
+		}
+	}
+	return false
+}
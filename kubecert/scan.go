@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"io"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/clientcmd"
+	"log"
+	"math"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// certReport describes a single certificate found in a secret
+type certReport struct {
+	Namespace          string    `json:"namespace"`
+	Secret             string    `json:"secret"`
+	Key                string    `json:"key"`
+	Index              int       `json:"index"`
+	Subject            string    `json:"subject"`
+	DNSNames           []string  `json:"dnsNames,omitempty"`
+	IPAddresses        []string  `json:"ipAddresses,omitempty"`
+	Issuer             string    `json:"issuer"`
+	IsCA               bool      `json:"isCA"`
+	NotAfter           time.Time `json:"notAfter"`
+	DaysToExpiry       int       `json:"daysToExpiry"`
+	KeyType            string    `json:"keyType"`
+	KeySize            int       `json:"keySize"`
+	SignatureAlgorithm string    `json:"signatureAlgorithm"`
+	Warnings           []string  `json:"warnings,omitempty"`
+}
+
+// weakSignatureAlgorithms are the signature algorithms that should no longer be trusted
+var weakSignatureAlgorithms = map[x509.SignatureAlgorithm]bool{
+	x509.MD2WithRSA:    true,
+	x509.MD5WithRSA:    true,
+	x509.SHA1WithRSA:   true,
+	x509.DSAWithSHA1:   true,
+	x509.DSAWithSHA256: true,
+	x509.ECDSAWithSHA1: true,
+}
+
+// runScan implements the `scan` command which reports the certificates stored in the secrets of the
+// cluster and exits with status 1 if any of them expires within -days
+func runScan(args []string) {
+	fs := flag.NewFlagSet("scan", flag.ExitOnError)
+	kubeconfig := kubeconfigFlag(fs)
+	namespace := fs.String("namespace", "", "only scan secrets in this namespace (default: all namespaces)")
+	output := fs.String("output", "table", "output format, table or json")
+	days := fs.Int("days", 30, "exit with status 1 if a certificate expires within this many days")
+	_ = fs.Parse(args)
+
+	if *output != "table" && *output != "json" {
+		log.Fatalf("unknown output format %q", *output)
+	}
+
+	config, err := clientcmd.BuildConfigFromFlags("", *kubeconfig)
+	if err != nil {
+		log.Fatal(err)
+	}
+	clientset, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	reports, err := scanSecrets(context.Background(), clientset, *namespace, time.Now())
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if *output == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(reports); err != nil {
+			log.Fatal(err)
+		}
+	} else {
+		printCertTable(os.Stdout, reports)
+	}
+
+	expiring := 0
+	for _, r := range reports {
+		if r.DaysToExpiry < *days {
+			expiring++
+		}
+	}
+	if expiring > 0 {
+		fmt.Fprintf(os.Stderr, "%d certificates expire within %d days\n", expiring, *days)
+		os.Exit(1)
+	}
+}
+
+// scanSecrets lists the secrets page by page and returns a report for every certificate found in
+// kubernetes.io/tls secrets and in opaque secrets holding PEM certificates, soonest expiry first
+func scanSecrets(ctx context.Context, clientset kubernetes.Interface, namespace string, now time.Time) ([]certReport, error) {
+	var reports []certReport
+	opts := metav1.ListOptions{Limit: 500}
+	for {
+		secrets, err := clientset.CoreV1().Secrets(namespace).List(ctx, opts)
+		if err != nil {
+			return nil, err
+		}
+		for i := range secrets.Items {
+			reports = append(reports, scanSecret(&secrets.Items[i], now)...)
+		}
+		if secrets.Continue == "" {
+			break
+		}
+		opts.Continue = secrets.Continue
+	}
+
+	sort.SliceStable(reports, func(i, j int) bool {
+		return reports[i].NotAfter.Before(reports[j].NotAfter)
+	})
+	return reports, nil
+}
+
+// scanSecret parses the certificate chains in every data key of the secret
+func scanSecret(secret *corev1.Secret, now time.Time) []certReport {
+	if secret.Type != corev1.SecretTypeTLS && secret.Type != corev1.SecretTypeOpaque {
+		return nil
+	}
+
+	keys := make([]string, 0, len(secret.Data))
+	for key, value := range secret.Data {
+		if bytes.Contains(value, []byte("-----BEGIN CERTIFICATE-----")) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	var reports []certReport
+	for _, key := range keys {
+		rest := secret.Data[key]
+		for index := 0; ; {
+			var block *pem.Block
+			block, rest = pem.Decode(rest)
+			if block == nil {
+				break
+			}
+			if block.Type != "CERTIFICATE" {
+				continue
+			}
+			cert, err := x509.ParseCertificate(block.Bytes)
+			if err != nil {
+				log.Println(err, "Failed to parse certificate", index, "in", key, "of secret", secret.Namespace+"/"+secret.Name)
+				index++
+				continue
+			}
+			report := newCertReport(cert, now)
+			report.Namespace = secret.Namespace
+			report.Secret = secret.Name
+			report.Key = key
+			report.Index = index
+			reports = append(reports, report)
+			index++
+		}
+	}
+	return reports
+}
+
+func newCertReport(cert *x509.Certificate, now time.Time) certReport {
+	r := certReport{
+		Subject:            cert.Subject.String(),
+		DNSNames:           cert.DNSNames,
+		Issuer:             cert.Issuer.String(),
+		IsCA:               cert.IsCA,
+		NotAfter:           cert.NotAfter.UTC(),
+		DaysToExpiry:       int(math.Floor(cert.NotAfter.Sub(now).Hours() / 24)),
+		SignatureAlgorithm: cert.SignatureAlgorithm.String(),
+	}
+	for _, ip := range cert.IPAddresses {
+		r.IPAddresses = append(r.IPAddresses, ip.String())
+	}
+	if cert.NotAfter.Before(now) {
+		r.Warnings = append(r.Warnings, "expired")
+	}
+
+	switch pub := cert.PublicKey.(type) {
+	case *rsa.PublicKey:
+		r.KeyType = "RSA"
+		r.KeySize = pub.N.BitLen()
+		if r.KeySize < 2048 {
+			r.Warnings = append(r.Warnings, fmt.Sprintf("weak key size %d", r.KeySize))
+		}
+	case *ecdsa.PublicKey:
+		r.KeyType = "ECDSA"
+		r.KeySize = pub.Curve.Params().BitSize
+	case ed25519.PublicKey:
+		r.KeyType = "Ed25519"
+		r.KeySize = 256
+	default:
+		r.KeyType = cert.PublicKeyAlgorithm.String()
+	}
+
+	if weakSignatureAlgorithms[cert.SignatureAlgorithm] {
+		r.Warnings = append(r.Warnings, "weak signature algorithm "+r.SignatureAlgorithm)
+	}
+	return r
+}
+
+func printCertTable(out io.Writer, reports []certReport) {
+	w := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "NAMESPACE\tSECRET\tKEY\tSUBJECT\tSANS\tISSUER\tDAYS\tKEY TYPE\tSIGNATURE\tWARNINGS")
+	for _, r := range reports {
+		sans := append(append([]string{}, r.DNSNames...), r.IPAddresses...)
+		fmt.Fprintf(w, "%s\t%s\t%s[%d]\t%s\t%s\t%s\t%d\t%s-%d\t%s\t%s\n",
+			r.Namespace, r.Secret, r.Key, r.Index, r.Subject, strings.Join(sans, ","), r.Issuer,
+			r.DaysToExpiry, r.KeyType, r.KeySize, r.SignatureAlgorithm, strings.Join(r.Warnings, "; "))
+	}
+	w.Flush()
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	corev1ac "k8s.io/client-go/applyconfigurations/core/v1"
+	"k8s.io/client-go/kubernetes"
+	"sigs.k8s.io/yaml"
+	"strings"
+	"time"
+)
+
+const (
+	// fieldManager is the server-side apply field manager of the secrets written by kubecert
+	fieldManager = "kubecert"
+
+	// managedByLabel marks the secrets created by kubecert
+	managedByLabel = "app.kubernetes.io/managed-by"
+	managedByValue = "kubecert"
+	// caLabel marks the secrets holding a CA, they are not rotated
+	caLabel = "kubecert.io/ca"
+
+	// managedSelector selects the leaf certificate secrets created by kubecert
+	managedSelector = managedByLabel + "=" + managedByValue + ",!" + caLabel
+
+	issuerAnnotation      = "kubecert.io/issuer"
+	notAfterAnnotation    = "kubecert.io/not-after"
+	fingerprintAnnotation = "kubecert.io/fingerprint-sha256"
+	serialAnnotation      = "kubecert.io/serial"
+	// caSecretAnnotation records the namespace/name of the CA secret a certificate was issued by
+	caSecretAnnotation = "kubecert.io/ca-secret"
+	// signerAnnotation and csrAnnotation record the cluster signer and CertificateSigningRequest
+	// of certificates issued with the csr command
+	signerAnnotation = "kubecert.io/signer-name"
+	csrAnnotation    = "kubecert.io/csr"
+)
+
+// parseCertificatePEM returns the first certificate of a PEM bundle
+func parseCertificatePEM(certPEM []byte) (*x509.Certificate, error) {
+	for {
+		var block *pem.Block
+		block, certPEM = pem.Decode(certPEM)
+		if block == nil {
+			return nil, fmt.Errorf("no certificate found in PEM")
+		}
+		if block.Type == "CERTIFICATE" {
+			return x509.ParseCertificate(block.Bytes)
+		}
+	}
+}
+
+// fingerprint returns the hex encoded SHA-256 fingerprint of the certificate
+func fingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	return hex.EncodeToString(sum[:])
+}
+
+// buildTLSSecret returns a kubernetes.io/tls secret holding the certificate, its key and the CA
+// certificate, annotated with the issuer, expiry and fingerprint of the certificate
+func buildTLSSecret(namespace, secretName string, certPEM, keyPEM, caPEM []byte) (*corev1.Secret, error) {
+	cert, err := parseCertificatePEM(certPEM)
+	if err != nil {
+		return nil, err
+	}
+	return &corev1.Secret{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: "v1",
+			Kind:       "Secret",
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      secretName,
+			Namespace: namespace,
+			Labels: map[string]string{
+				managedByLabel: managedByValue,
+			},
+			Annotations: map[string]string{
+				issuerAnnotation:      cert.Issuer.CommonName,
+				notAfterAnnotation:    cert.NotAfter.UTC().Format(time.RFC3339),
+				fingerprintAnnotation: fingerprint(cert),
+				serialAnnotation:      strings.ToLower(cert.SerialNumber.Text(16)),
+			},
+		},
+		Type: corev1.SecretTypeTLS,
+		Data: map[string][]byte{
+			corev1.TLSCertKey:       certPEM,
+			corev1.TLSPrivateKeyKey: keyPEM,
+			"ca.crt":                caPEM,
+		},
+	}, nil
+}
+
+// applySecret creates or updates the secret with server-side apply.
+// With dryRun the manifest is printed instead of being applied.
+func applySecret(clientset kubernetes.Interface, secret *corev1.Secret, dryRun bool) error {
+	if dryRun {
+		data, err := yaml.Marshal(secret)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("---\n%s", data)
+		return nil
+	}
+
+	// the type of a secret is immutable, secrets written by older versions were Opaque.
+	// Only secrets created by kubecert are replaced, any other secret is left alone.
+	existing, err := clientset.CoreV1().Secrets(secret.Namespace).Get(context.TODO(), secret.Name, metav1.GetOptions{})
+	if err == nil && existing.Type != secret.Type {
+		if existing.Labels[managedByLabel] != managedByValue && !legacySecret(existing, secret.Data["ca.crt"]) {
+			return fmt.Errorf("secret %s in namespace %s already exists with type %s and is not managed by kubecert, expected type %s. "+
+				"Delete it first if it was created by an older version of kubecert", secret.Name, secret.Namespace, existing.Type, secret.Type)
+		}
+		fmt.Printf("Replacing secret %s of type %s in namespace %s\n", secret.Name, existing.Type, secret.Namespace)
+		err = clientset.CoreV1().Secrets(secret.Namespace).Delete(context.TODO(), secret.Name, metav1.DeleteOptions{
+			Preconditions: &metav1.Preconditions{UID: &existing.UID},
+		})
+		if err != nil {
+			return err
+		}
+	} else if err != nil && !apierrors.IsNotFound(err) {
+		return err
+	}
+
+	ac := corev1ac.Secret(secret.Name, secret.Namespace).
+		WithLabels(secret.Labels).
+		WithAnnotations(secret.Annotations).
+		WithType(secret.Type).
+		WithData(secret.Data)
+	_, err = clientset.CoreV1().Secrets(secret.Namespace).Apply(context.TODO(), ac, metav1.ApplyOptions{
+		FieldManager: fieldManager,
+		Force:        true,
+	})
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Secret %s applied successfully in namespace %s\n", secret.Name, secret.Namespace)
+	return nil
+}
+
+// legacySecret reports whether an unlabeled secret was written by an older version of kubecert,
+// which created Opaque secrets holding a certificate issued by the CA and its key
+func legacySecret(existing *corev1.Secret, caPEM []byte) bool {
+	if existing.Type != corev1.SecretTypeOpaque || len(existing.Data[corev1.TLSPrivateKeyKey]) == 0 || len(caPEM) == 0 {
+		return false
+	}
+	cert, err := parseCertificatePEM(existing.Data[corev1.TLSCertKey])
+	if err != nil {
+		return false
+	}
+	for {
+		var block *pem.Block
+		block, caPEM = pem.Decode(caPEM)
+		if block == nil {
+			return false
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		ca, err := x509.ParseCertificate(block.Bytes)
+		if err == nil && cert.CheckSignatureFrom(ca) == nil {
+			return true
+		}
+	}
+}
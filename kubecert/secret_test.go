@@ -0,0 +1,52 @@
+package main
+
+import (
+	corev1 "k8s.io/api/core/v1"
+	"testing"
+	"time"
+)
+
+func TestLegacySecret(t *testing.T) {
+	keyOpts := keyOptions{algorithm: keyECDSAP256, encoding: keyEncodingPKCS8}
+	ca, err := generateCA("kubecert-test-ca", nil, time.Hour, keyOpts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := generateCA("other-ca", nil, time.Hour, keyOpts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	issue := func(ca *certificateAuthority) ([]byte, []byte) {
+		certPEM, keyPEM, err := ca.issue(certOptions{commonName: "app", dnsNames: []string{"app"}, role: roleServer, validity: time.Hour, key: keyOpts})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return certPEM, keyPEM
+	}
+	certPEM, keyPEM := issue(ca)
+	otherCertPEM, otherKeyPEM := issue(other)
+
+	tests := []struct {
+		name  string
+		typ   corev1.SecretType
+		data  map[string][]byte
+		caPEM []byte
+		want  bool
+	}{
+		{name: "issued by the CA", typ: corev1.SecretTypeOpaque, data: map[string][]byte{"tls.crt": certPEM, "tls.key": keyPEM}, caPEM: ca.certPEM, want: true},
+		{name: "CA in a bundle", typ: corev1.SecretTypeOpaque, data: map[string][]byte{"tls.crt": certPEM, "tls.key": keyPEM}, caPEM: append(append([]byte{}, other.certPEM...), ca.certPEM...), want: true},
+		{name: "issued by another CA", typ: corev1.SecretTypeOpaque, data: map[string][]byte{"tls.crt": otherCertPEM, "tls.key": otherKeyPEM}, caPEM: ca.certPEM},
+		{name: "no key", typ: corev1.SecretTypeOpaque, data: map[string][]byte{"tls.crt": certPEM}, caPEM: ca.certPEM},
+		{name: "no certificate", typ: corev1.SecretTypeOpaque, data: map[string][]byte{"password": []byte("secret"), "tls.key": keyPEM}, caPEM: ca.certPEM},
+		{name: "no CA", typ: corev1.SecretTypeOpaque, data: map[string][]byte{"tls.crt": certPEM, "tls.key": keyPEM}},
+		{name: "not opaque", typ: corev1.SecretTypeBasicAuth, data: map[string][]byte{"tls.crt": certPEM, "tls.key": keyPEM}, caPEM: ca.certPEM},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			existing := &corev1.Secret{Type: tt.typ, Data: tt.data}
+			if got := legacySecret(existing, tt.caPEM); got != tt.want {
+				t.Errorf("expected %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
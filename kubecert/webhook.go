@@ -0,0 +1,264 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"fmt"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/klog/v2"
+	"log"
+	"strings"
+	"time"
+)
+
+// the webhook configurations whose caBundle is kept in sync with a serving certificate secret
+const (
+	validatingWebhooksAnnotation = "kubecert.io/validating-webhooks"
+	mutatingWebhooksAnnotation   = "kubecert.io/mutating-webhooks"
+	conversionCRDsAnnotation     = "kubecert.io/conversion-crds"
+)
+
+var crdResource = schema.GroupVersionResource{Group: "apiextensions.k8s.io", Version: "v1", Resource: "customresourcedefinitions"}
+
+// webhookTargets names the configurations that trust the CA of a webhook serving certificate
+type webhookTargets struct {
+	validating []string
+	mutating   []string
+	crds       []string
+}
+
+// webhookTargetsFromAnnotations returns the targets recorded on a secret by the webhook command
+func webhookTargetsFromAnnotations(annotations map[string]string) webhookTargets {
+	return webhookTargets{
+		validating: splitList(annotations[validatingWebhooksAnnotation]),
+		mutating:   splitList(annotations[mutatingWebhooksAnnotation]),
+		crds:       splitList(annotations[conversionCRDsAnnotation]),
+	}
+}
+
+func (t webhookTargets) empty() bool {
+	return len(t.validating) == 0 && len(t.mutating) == 0 && len(t.crds) == 0
+}
+
+// annotate records the targets on the secret so the rotation controller patches them again
+func (t webhookTargets) annotate(annotations map[string]string) {
+	if len(t.validating) > 0 {
+		annotations[validatingWebhooksAnnotation] = strings.Join(t.validating, ",")
+	}
+	if len(t.mutating) > 0 {
+		annotations[mutatingWebhooksAnnotation] = strings.Join(t.mutating, ",")
+	}
+	if len(t.crds) > 0 {
+		annotations[conversionCRDsAnnotation] = strings.Join(t.crds, ",")
+	}
+}
+
+// runWebhook implements the `webhook` command which issues the serving certificate of an admission
+// or conversion webhook service and injects the CA into the configurations calling it
+func runWebhook(args []string) {
+	fs := flag.NewFlagSet("webhook", flag.ExitOnError)
+	kubeconfig := kubeconfigFlag(fs)
+	namespace := fs.String("namespace", "default", "namespace of the webhook service and the secret")
+	service := fs.String("service", "", "name of the webhook service")
+	secretName := fs.String("secret", "", "name of the secret to store the serving certificate in (default: <service>-tls)")
+	validating := fs.String("validating", "", "comma separated ValidatingWebhookConfigurations to patch")
+	mutating := fs.String("mutating", "", "comma separated MutatingWebhookConfigurations to patch")
+	crds := fs.String("crds", "", "comma separated CustomResourceDefinitions whose conversion webhook to patch")
+	validity := fs.Duration("validity", 365*24*time.Hour, "validity of the certificate")
+	caSecretName := fs.String("ca-secret", "kubecert-ca", "secret holding the CA, it is created if it doesn't exist")
+	caValidity := fs.Duration("ca-validity", 10*365*24*time.Hour, "validity of a newly created CA")
+	keyAlgorithm := fs.String("key-algorithm", keyECDSAP256, "private key algorithm, one of rsa2048, rsa3072, rsa4096, ecdsa-p256, ecdsa-p384 or ed25519")
+	keyEncoding := fs.String("key-encoding", keyEncodingPKCS8, "private key encoding, pkcs8 or legacy (PKCS#1 for RSA, SEC 1 for ECDSA)")
+	_ = fs.Parse(args)
+
+	if *service == "" {
+		log.Fatal("-service is required")
+	}
+	if *secretName == "" {
+		*secretName = *service + "-tls"
+	}
+	targets := webhookTargets{
+		validating: splitList(*validating),
+		mutating:   splitList(*mutating),
+		crds:       splitList(*crds),
+	}
+
+	config, err := clientcmd.BuildConfigFromFlags("", *kubeconfig)
+	if err != nil {
+		log.Fatal(err)
+	}
+	clientset, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		log.Fatal(err)
+	}
+	dynamicClient, err := dynamic.NewForConfig(config)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	opts := certOptions{
+		commonName: *service + "." + *namespace + ".svc",
+		dnsNames:   serviceDNSNames(*service, *namespace),
+		role:       roleServer,
+		validity:   *validity,
+		key: keyOptions{
+			algorithm: *keyAlgorithm,
+			encoding:  *keyEncoding,
+		},
+	}
+	ca, err := loadOrCreateCA(clientset, *namespace, *caSecretName, "", "", []string{managedByValue}, *caValidity, opts.key, false)
+	if err != nil {
+		log.Fatal(err)
+	}
+	certPEM, keyPEM, err := ca.issue(opts)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	secret, err := buildTLSSecret(*namespace, *secretName, certPEM, keyPEM, ca.certPEM)
+	if err != nil {
+		log.Fatal(err)
+	}
+	secret.Annotations[caSecretAnnotation] = *namespace + "/" + *caSecretName
+	targets.annotate(secret.Annotations)
+	if err := applySecret(clientset, secret, false); err != nil {
+		log.Fatal(err)
+	}
+
+	if err := patchCABundles(context.Background(), clientset, dynamicClient, targets, ca.certPEM); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// serviceDNSNames returns the names a service is reachable under inside the cluster
+func serviceDNSNames(service, namespace string) []string {
+	return []string{
+		service,
+		service + "." + namespace,
+		service + "." + namespace + ".svc",
+		service + "." + namespace + ".svc.cluster.local",
+	}
+}
+
+// staleCABundles returns the targets with a webhook whose caBundle differs from caPEM.
+// CRDs that don't use a conversion webhook are skipped.
+func staleCABundles(ctx context.Context, clientset kubernetes.Interface, dynamicClient dynamic.Interface, targets webhookTargets, caPEM []byte) (webhookTargets, error) {
+	var stale webhookTargets
+	for _, name := range targets.validating {
+		cfg, err := clientset.AdmissionregistrationV1().ValidatingWebhookConfigurations().Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return stale, err
+		}
+		for _, webhook := range cfg.Webhooks {
+			if !bytes.Equal(webhook.ClientConfig.CABundle, caPEM) {
+				stale.validating = append(stale.validating, name)
+				break
+			}
+		}
+	}
+
+	for _, name := range targets.mutating {
+		cfg, err := clientset.AdmissionregistrationV1().MutatingWebhookConfigurations().Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return stale, err
+		}
+		for _, webhook := range cfg.Webhooks {
+			if !bytes.Equal(webhook.ClientConfig.CABundle, caPEM) {
+				stale.mutating = append(stale.mutating, name)
+				break
+			}
+		}
+	}
+
+	encoded := base64.StdEncoding.EncodeToString(caPEM)
+	for _, name := range targets.crds {
+		crd, err := dynamicClient.Resource(crdResource).Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return stale, err
+		}
+		// patching a CRD that doesn't use a conversion webhook fails, it would be retried forever
+		if strategy, _, _ := unstructured.NestedString(crd.Object, "spec", "conversion", "strategy"); strategy != "Webhook" {
+			klog.Warningf("CustomResourceDefinition %s doesn't use a conversion webhook, not patching its caBundle", name)
+			continue
+		}
+		if bundle, _, _ := unstructured.NestedString(crd.Object, "spec", "conversion", "webhook", "clientConfig", "caBundle"); bundle != encoded {
+			stale.crds = append(stale.crds, name)
+		}
+	}
+	return stale, nil
+}
+
+// patchCABundles sets caBundle on every webhook of the named webhook configurations and on the
+// conversion webhook of the named CRDs
+func patchCABundles(ctx context.Context, clientset kubernetes.Interface, dynamicClient dynamic.Interface, targets webhookTargets, caPEM []byte) error {
+	for _, name := range targets.validating {
+		cfg, err := clientset.AdmissionregistrationV1().ValidatingWebhookConfigurations().Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		for i := range cfg.Webhooks {
+			cfg.Webhooks[i].ClientConfig.CABundle = caPEM
+		}
+		if _, err := clientset.AdmissionregistrationV1().ValidatingWebhookConfigurations().Update(ctx, cfg, metav1.UpdateOptions{FieldManager: fieldManager}); err != nil {
+			return err
+		}
+		fmt.Printf("Patched caBundle of ValidatingWebhookConfiguration %s\n", name)
+	}
+
+	for _, name := range targets.mutating {
+		cfg, err := clientset.AdmissionregistrationV1().MutatingWebhookConfigurations().Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		for i := range cfg.Webhooks {
+			cfg.Webhooks[i].ClientConfig.CABundle = caPEM
+		}
+		if _, err := clientset.AdmissionregistrationV1().MutatingWebhookConfigurations().Update(ctx, cfg, metav1.UpdateOptions{FieldManager: fieldManager}); err != nil {
+			return err
+		}
+		fmt.Printf("Patched caBundle of MutatingWebhookConfiguration %s\n", name)
+	}
+
+	if len(targets.crds) == 0 {
+		return nil
+	}
+	patch, err := json.Marshal(map[string]interface{}{
+		"spec": map[string]interface{}{
+			"conversion": map[string]interface{}{
+				"webhook": map[string]interface{}{
+					"clientConfig": map[string]interface{}{
+						"caBundle": base64.StdEncoding.EncodeToString(caPEM),
+					},
+				},
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	for _, name := range targets.crds {
+		crd, err := dynamicClient.Resource(crdResource).Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		// a caBundle without a webhook conversion strategy is rejected
+		if strategy, _, _ := unstructured.NestedString(crd.Object, "spec", "conversion", "strategy"); strategy != "Webhook" {
+			return fmt.Errorf("CustomResourceDefinition %s doesn't use a conversion webhook", name)
+		}
+		_, err = dynamicClient.Resource(crdResource).Patch(ctx, name, types.MergePatchType, patch, metav1.PatchOptions{FieldManager: fieldManager})
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Patched caBundle of CustomResourceDefinition %s\n", name)
+	}
+	return nil
+}
@@ -0,0 +1,440 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/duration"
+	"k8s.io/client-go/dynamic"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+var (
+	mysqlClusterKind = schema.GroupVersionKind{Group: "mysql.presslabs.org", Version: "v1alpha1", Kind: "MysqlCluster"}
+	mysqlBackupKind  = schema.GroupVersionKind{Group: "mysql.presslabs.org", Version: "v1alpha1", Kind: "MysqlBackup"}
+)
+
+// backups manages the backups of Presslabs MysqlClusters
+type backups struct {
+	client    *client
+	namespace string
+	clusters  dynamic.ResourceInterface
+	backups   dynamic.ResourceInterface
+	mapping   *meta.RESTMapping
+}
+
+func newBackups(c *client, namespace string) (*backups, error) {
+	clusterMapping, err := c.mappingFor(mysqlClusterKind)
+	if err != nil {
+		return nil, fmt.Errorf("the Presslabs MySQL operator is not installed: %w", err)
+	}
+	backupMapping, err := c.mappingFor(mysqlBackupKind)
+	if err != nil {
+		return nil, fmt.Errorf("the Presslabs MySQL operator is not installed: %w", err)
+	}
+	return &backups{
+		client:    c,
+		namespace: namespace,
+		clusters:  c.resourceFor(clusterMapping, namespace),
+		backups:   c.resourceFor(backupMapping, namespace),
+		mapping:   backupMapping,
+	}, nil
+}
+
+// backupSchedule is the backup configuration of a cluster
+type backupSchedule struct {
+	schedule     string
+	url          string
+	secret       string
+	historyLimit int
+	deletePolicy string
+}
+
+// validateBackupURL checks that the URL points into a bucket of an S3 compatible endpoint
+func validateBackupURL(url string) error {
+	if !strings.HasPrefix(url, "s3://") || len(strings.TrimPrefix(url, "s3://")) == 0 {
+		return fmt.Errorf("invalid backup URL %q, use s3://<bucket>/<path>", url)
+	}
+	return nil
+}
+
+// schedule configures the scheduled backups of a cluster. An empty schedule disables them, the
+// backup URL and secret are kept for on-demand backups.
+func (b *backups) schedule(ctx context.Context, cluster string, s backupSchedule) error {
+	spec := map[string]interface{}{}
+	if s.schedule == "" {
+		spec["backupSchedule"] = nil
+	} else {
+		// the operator uses cron expressions with a leading seconds field
+		if fields := strings.Fields(s.schedule); !strings.HasPrefix(s.schedule, "@") && len(fields) != 6 {
+			return fmt.Errorf("invalid schedule %q, use 6 fields with seconds first, like \"0 0 2 * * *\"", s.schedule)
+		}
+		spec["backupSchedule"] = s.schedule
+		spec["backupScheduleJobsHistoryLimit"] = s.historyLimit
+	}
+	if s.url != "" {
+		if err := validateBackupURL(s.url); err != nil {
+			return err
+		}
+		spec["backupURL"] = s.url
+	}
+	if s.secret != "" {
+		spec["backupSecretName"] = s.secret
+	}
+	if s.deletePolicy != "" {
+		spec["backupRemoteDeletePolicy"] = s.deletePolicy
+	}
+
+	current, err := b.clusters.Get(ctx, cluster, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	if s.schedule != "" {
+		if url, _, _ := unstructured.NestedString(current.Object, "spec", "backupURL"); url == "" && s.url == "" {
+			return fmt.Errorf("cluster %s has no backup URL, use -url", cluster)
+		}
+		if secret, _, _ := unstructured.NestedString(current.Object, "spec", "backupSecretName"); secret == "" && s.secret == "" {
+			return fmt.Errorf("cluster %s has no backup secret, use -secret", cluster)
+		}
+	}
+
+	patch, err := json.Marshal(map[string]interface{}{"spec": spec})
+	if err != nil {
+		return err
+	}
+	if _, err := b.clusters.Patch(ctx, cluster, types.MergePatchType, patch, metav1.PatchOptions{FieldManager: fieldManager}); err != nil {
+		return fmt.Errorf("failed to configure the backups of cluster %s: %w", cluster, err)
+	}
+	if s.schedule == "" {
+		fmt.Printf("scheduled backups of cluster %s disabled\n", cluster)
+	} else {
+		fmt.Printf("cluster %s backs up on schedule %q\n", cluster, s.schedule)
+	}
+	return nil
+}
+
+// ensureBackupSecret creates the secret with the S3 credentials of the backups unless it exists.
+// The keys are read from the AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY environment variables so
+// that they never show up in the shell history.
+func (b *backups) ensureBackupSecret(ctx context.Context, name, provider, endpoint, region string) error {
+	secret := &unstructured.Unstructured{}
+	secret.SetAPIVersion("v1")
+	secret.SetKind("Secret")
+	secret.SetName(name)
+	secret.SetNamespace(b.namespace)
+	ri, _, err := b.client.resourceForObject(secret)
+	if err != nil {
+		return err
+	}
+	if _, err := ri.Get(ctx, name, metav1.GetOptions{}); err == nil {
+		return nil
+	} else if !apierrors.IsNotFound(err) {
+		return err
+	}
+
+	accessKey, secretKey := os.Getenv("AWS_ACCESS_KEY_ID"), os.Getenv("AWS_SECRET_ACCESS_KEY")
+	if accessKey == "" || secretKey == "" {
+		return fmt.Errorf("secrets/%s doesn't exist, set AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY to create it", name)
+	}
+	data := map[string]interface{}{
+		"AWS_ACCESS_KEY_ID":     accessKey,
+		"AWS_SECRET_ACCESS_KEY": secretKey,
+		"S3_PROVIDER":           provider,
+	}
+	if endpoint != "" {
+		data["S3_ENDPOINT"] = endpoint
+	}
+	if region != "" {
+		data["AWS_REGION"] = region
+	}
+	secret.Object["type"] = "Opaque"
+	secret.Object["stringData"] = data
+	secret.SetLabels(map[string]string{"app.kubernetes.io/managed-by": fieldManager})
+	if _, err := ri.Create(ctx, secret, metav1.CreateOptions{FieldManager: fieldManager}); err != nil {
+		return fmt.Errorf("failed to create secrets/%s: %w", name, err)
+	}
+	fmt.Printf("secrets/%s created\n", name)
+	return nil
+}
+
+// create triggers an on-demand backup of a cluster into its backup URL
+func (b *backups) create(ctx context.Context, cluster, name string) (*unstructured.Unstructured, error) {
+	current, err := b.clusters.Get(ctx, cluster, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	if url, _, _ := unstructured.NestedString(current.Object, "spec", "backupURL"); url == "" {
+		return nil, fmt.Errorf("cluster %s has no backup URL, configure it with `backup schedule`", cluster)
+	}
+
+	backup := &unstructured.Unstructured{}
+	backup.SetGroupVersionKind(mysqlBackupKind)
+	backup.SetNamespace(b.namespace)
+	if name != "" {
+		backup.SetName(name)
+	} else {
+		backup.SetGenerateName(cluster + "-")
+	}
+	backup.SetLabels(map[string]string{"app.kubernetes.io/instance": cluster, "app.kubernetes.io/managed-by": fieldManager})
+	if err := unstructured.SetNestedField(backup.Object, cluster, "spec", "clusterName"); err != nil {
+		return nil, err
+	}
+	created, err := b.backups.Create(ctx, backup, metav1.CreateOptions{FieldManager: fieldManager})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create a backup of cluster %s: %w", cluster, err)
+	}
+	return created, nil
+}
+
+// list returns the backups, of one cluster if it isn't empty, oldest first
+func (b *backups) list(ctx context.Context, cluster string) ([]*unstructured.Unstructured, error) {
+	list, err := b.backups.List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	var items []*unstructured.Unstructured
+	for i := range list.Items {
+		if name, _, _ := unstructured.NestedString(list.Items[i].Object, "spec", "clusterName"); cluster == "" || name == cluster {
+			items = append(items, &list.Items[i])
+		}
+	}
+	sort.Slice(items, func(i, j int) bool {
+		return items[i].GetCreationTimestamp().Time.Before(items[j].GetCreationTimestamp().Time)
+	})
+	return items, nil
+}
+
+// backupStatus summarizes the status of a backup as Complete, Failed or Running
+func backupStatus(backup *unstructured.Unstructured) string {
+	if completed, _, _ := unstructured.NestedBool(backup.Object, "status", "completed"); completed {
+		return "Complete"
+	}
+	conditions, _, _ := unstructured.NestedSlice(backup.Object, "status", "conditions")
+	for _, c := range conditions {
+		condition, ok := c.(map[string]interface{})
+		if !ok || condition["type"] != "Failed" || condition["status"] != "True" {
+			continue
+		}
+		if reason, _ := condition["reason"].(string); reason != "" {
+			return "Failed (" + reason + ")"
+		}
+		return "Failed"
+	}
+	return "Running"
+}
+
+// printBackupTable writes the backups as a table
+func printBackupTable(out io.Writer, items []*unstructured.Unstructured, now time.Time) {
+	w := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tCLUSTER\tSTATUS\tURL\tAGE")
+	for _, backup := range items {
+		cluster, _, _ := unstructured.NestedString(backup.Object, "spec", "clusterName")
+		url, _, _ := unstructured.NestedString(backup.Object, "spec", "backupURL")
+		if url == "" {
+			url = "<pending>"
+		}
+		age := duration.HumanDuration(now.Sub(backup.GetCreationTimestamp().Time))
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", backup.GetName(), cluster, backupStatus(backup), url, age)
+	}
+	w.Flush()
+}
+
+// restore creates a new cluster initialized from a completed backup. The new cluster copies the
+// spec of the backed up cluster, its scheduled backups are disabled so that it doesn't write into
+// the backups of the original cluster. When the backed up cluster doesn't exist anymore the new
+// cluster gets a minimal spec with the given replicas, the credentials secret is required then.
+func (b *backups) restore(ctx context.Context, backupName, name, secret string, replicas int) (*unstructured.Unstructured, error) {
+	backup, err := b.backups.Get(ctx, backupName, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	if status := backupStatus(backup); status != "Complete" {
+		return nil, fmt.Errorf("backup %s is not complete, it is %s", backupName, status)
+	}
+	url, _, _ := unstructured.NestedString(backup.Object, "spec", "backupURL")
+	if url == "" {
+		return nil, fmt.Errorf("backup %s has no backup URL", backupName)
+	}
+	clusterName, _, _ := unstructured.NestedString(backup.Object, "spec", "clusterName")
+	var spec map[string]interface{}
+	source, err := b.clusters.Get(ctx, clusterName, metav1.GetOptions{})
+	switch {
+	case apierrors.IsNotFound(err):
+		if secret == "" {
+			return nil, fmt.Errorf("cluster %s of backup %s doesn't exist anymore, use -secret", clusterName, backupName)
+		}
+		spec = map[string]interface{}{"replicas": int64(replicas)}
+	case err != nil:
+		return nil, fmt.Errorf("failed to get cluster %s of backup %s: %w", clusterName, backupName, err)
+	default:
+		if spec, _, err = unstructured.NestedMap(source.Object, "spec"); err != nil {
+			return nil, err
+		}
+	}
+
+	backupSecret, _, _ := unstructured.NestedString(backup.Object, "spec", "backupSecretName")
+	if backupSecret == "" {
+		backupSecret, _, _ = unstructured.NestedString(spec, "backupSecretName")
+	}
+	for _, field := range []string{"backupSchedule", "backupURL", "backupScheduleJobsHistoryLimit", "backupRemoteDeletePolicy", "backupSecretName"} {
+		delete(spec, field)
+	}
+	spec["initBucketURL"] = url
+	spec["initBucketSecretName"] = backupSecret
+	if secret != "" {
+		spec["secretName"] = secret
+	}
+
+	cluster := &unstructured.Unstructured{}
+	cluster.SetGroupVersionKind(mysqlClusterKind)
+	cluster.SetName(name)
+	cluster.SetNamespace(b.namespace)
+	cluster.Object["spec"] = spec
+	created, err := b.clusters.Create(ctx, cluster, metav1.CreateOptions{FieldManager: fieldManager})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cluster %s: %w", name, err)
+	}
+	return created, nil
+}
+
+// runBackup implements the `backup` command with its schedule, create, list and restore subcommands
+func runBackup(args []string) error {
+	const usage = "usage: mysql-go backup schedule|create|list|restore [flags]"
+	if len(args) == 0 {
+		return fmt.Errorf(usage)
+	}
+	fs := flag.NewFlagSet("backup "+args[0], flag.ExitOnError)
+	opts := addCommonFlags(fs)
+	cluster := fs.String("cluster", "", "name of the MysqlCluster")
+	ctx := context.TODO()
+
+	switch args[0] {
+	case "schedule":
+		s := backupSchedule{}
+		fs.StringVar(&s.schedule, "schedule", "", "cron schedule with seconds, like \"0 0 2 * * *\", empty disables the scheduled backups")
+		fs.StringVar(&s.url, "url", "", "S3 URL the backups are written to, like s3://bucket/path")
+		fs.StringVar(&s.secret, "secret", "", "secret with the S3 credentials")
+		fs.IntVar(&s.historyLimit, "history-limit", 10, "number of backups kept by the schedule")
+		fs.StringVar(&s.deletePolicy, "delete-policy", "", "remote delete policy of the backups, retain or delete")
+		provider := fs.String("provider", "AWS", "S3 provider of a secret created from the environment, like AWS or Minio")
+		endpoint := fs.String("endpoint", "", "S3 endpoint of a secret created from the environment, for S3 compatible storage")
+		region := fs.String("region", "", "S3 region of a secret created from the environment")
+		_ = fs.Parse(args[1:])
+		if *cluster == "" {
+			return fmt.Errorf("-cluster is required")
+		}
+		c, err := newClient(opts)
+		if err != nil {
+			return err
+		}
+		b, err := newBackups(c, opts.namespace)
+		if err != nil {
+			return err
+		}
+		if s.secret != "" {
+			if err := b.ensureBackupSecret(ctx, s.secret, *provider, *endpoint, *region); err != nil {
+				return err
+			}
+		}
+		return b.schedule(ctx, *cluster, s)
+
+	case "create":
+		name := fs.String("name", "", "name of the MysqlBackup, generated from the cluster name if empty")
+		wait := fs.Bool("wait", false, "wait until the backup is complete")
+		timeout := fs.Duration("timeout", 30*time.Minute, "how long to wait for the backup")
+		_ = fs.Parse(args[1:])
+		if *cluster == "" {
+			return fmt.Errorf("-cluster is required")
+		}
+		c, err := newClient(opts)
+		if err != nil {
+			return err
+		}
+		b, err := newBackups(c, opts.namespace)
+		if err != nil {
+			return err
+		}
+		backup, err := b.create(ctx, *cluster, *name)
+		if err != nil {
+			return err
+		}
+		result := target{obj: backup, mapping: b.mapping}
+		if err := report(opts, "created", []target{result}); err != nil {
+			return err
+		}
+		if !*wait {
+			return nil
+		}
+		cond, err := parseWaitFor("jsonpath={.status.completed}=true")
+		if err != nil {
+			return err
+		}
+		return waitFor(ctx, c, result, cond, *timeout)
+
+	case "list":
+		_ = fs.Parse(args[1:])
+		if err := validateOutput(opts.output); err != nil {
+			return err
+		}
+		c, err := newClient(opts)
+		if err != nil {
+			return err
+		}
+		b, err := newBackups(c, opts.namespace)
+		if err != nil {
+			return err
+		}
+		items, err := b.list(ctx, *cluster)
+		if err != nil {
+			return err
+		}
+		if opts.output != "" {
+			return printObjects(os.Stdout, opts.output, items)
+		}
+		printBackupTable(os.Stdout, items, time.Now())
+		return nil
+
+	case "restore":
+		from := fs.String("from", "", "name of the MysqlBackup to restore")
+		name := fs.String("name", "", "name of the new MysqlCluster")
+		secret := fs.String("secret", "", "credentials secret of the new cluster (default the secret of the backed up cluster, required if it doesn't exist anymore)")
+		replicas := fs.Int("replicas", 1, "replicas of the new cluster if the backed up cluster doesn't exist anymore")
+		_ = fs.Parse(args[1:])
+		if *from == "" || *name == "" {
+			return fmt.Errorf("-from and -name are required")
+		}
+		if *replicas < 1 {
+			return fmt.Errorf("-replicas must be at least 1")
+		}
+		c, err := newClient(opts)
+		if err != nil {
+			return err
+		}
+		b, err := newBackups(c, opts.namespace)
+		if err != nil {
+			return err
+		}
+		cluster, err := b.restore(ctx, *from, *name, *secret, *replicas)
+		if err != nil {
+			return err
+		}
+		mapping, err := c.mappingFor(mysqlClusterKind)
+		if err != nil {
+			return err
+		}
+		return report(opts, "created from backup "+*from, []target{{obj: cluster, mapping: mapping}})
+	}
+	return fmt.Errorf(usage)
+}
@@ -0,0 +1,403 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/rand"
+	"k8s.io/client-go/dynamic/fake"
+	k8stesting "k8s.io/client-go/testing"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func clusterFixture(name string, spec map[string]interface{}) *unstructured.Unstructured {
+	return newFakeObject(mysqlClusterKind, name, map[string]interface{}{"spec": spec})
+}
+
+func backupFixture(name, cluster string, created time.Time, status map[string]interface{}) *unstructured.Unstructured {
+	backup := newFakeObject(mysqlBackupKind, name, map[string]interface{}{
+		"spec": map[string]interface{}{
+			"clusterName":      cluster,
+			"backupURL":        "s3://backups/" + cluster + "/" + name + ".xbackup.gz",
+			"backupSecretName": "backup-secret",
+		},
+	})
+	if status != nil {
+		backup.Object["status"] = status
+	}
+	backup.SetCreationTimestamp(metav1.NewTime(created))
+	return backup
+}
+
+func newFakeBackups(t *testing.T, objs ...runtime.Object) (*backups, *fake.FakeDynamicClient) {
+	t.Helper()
+	c, dynamicClient := newFakeClient(t, objs...)
+	b, err := newBackups(c, "db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b, dynamicClient
+}
+
+// patches returns the decoded patches sent to the fake dynamic client
+func patches(dynamicClient *fake.FakeDynamicClient) []map[string]interface{} {
+	var patches []map[string]interface{}
+	for _, action := range dynamicClient.Actions() {
+		if patch, ok := action.(k8stesting.PatchAction); ok {
+			var decoded map[string]interface{}
+			_ = json.Unmarshal(patch.GetPatch(), &decoded)
+			patches = append(patches, decoded)
+		}
+	}
+	return patches
+}
+
+func TestBackupSchedule(t *testing.T) {
+	configured := map[string]interface{}{
+		"replicas":         int64(1),
+		"backupSchedule":   "0 0 2 * * *",
+		"backupURL":        "s3://backups/app",
+		"backupSecretName": "backup-secret",
+	}
+	tests := []struct {
+		name      string
+		spec      map[string]interface{}
+		schedule  backupSchedule
+		wantPatch map[string]interface{}
+		wantSpec  map[string]interface{}
+		wantErr   string
+	}{
+		{
+			name:     "enable",
+			spec:     map[string]interface{}{"replicas": int64(1)},
+			schedule: backupSchedule{schedule: "0 0 3 * * *", url: "s3://backups/app", secret: "backup-secret", historyLimit: 5, deletePolicy: "retain"},
+			wantPatch: map[string]interface{}{"spec": map[string]interface{}{
+				"backupSchedule":                 "0 0 3 * * *",
+				"backupScheduleJobsHistoryLimit": float64(5),
+				"backupURL":                      "s3://backups/app",
+				"backupSecretName":               "backup-secret",
+				"backupRemoteDeletePolicy":       "retain",
+			}},
+			wantSpec: map[string]interface{}{
+				"replicas":                       int64(1),
+				"backupSchedule":                 "0 0 3 * * *",
+				"backupScheduleJobsHistoryLimit": int64(5),
+				"backupURL":                      "s3://backups/app",
+				"backupSecretName":               "backup-secret",
+				"backupRemoteDeletePolicy":       "retain",
+			},
+		},
+		{
+			name:     "change schedule keeps URL and secret",
+			spec:     configured,
+			schedule: backupSchedule{schedule: "@daily", historyLimit: 10},
+			wantPatch: map[string]interface{}{"spec": map[string]interface{}{
+				"backupSchedule":                 "@daily",
+				"backupScheduleJobsHistoryLimit": float64(10),
+			}},
+		},
+		{
+			name:      "disable",
+			spec:      configured,
+			schedule:  backupSchedule{},
+			wantPatch: map[string]interface{}{"spec": map[string]interface{}{"backupSchedule": nil}},
+			wantSpec: map[string]interface{}{
+				"replicas":         int64(1),
+				"backupURL":        "s3://backups/app",
+				"backupSecretName": "backup-secret",
+			},
+		},
+		{
+			name:     "missing URL",
+			spec:     map[string]interface{}{"replicas": int64(1)},
+			schedule: backupSchedule{schedule: "0 0 3 * * *", secret: "backup-secret"},
+			wantErr:  "has no backup URL, use -url",
+		},
+		{
+			name:     "missing secret",
+			spec:     map[string]interface{}{"replicas": int64(1), "backupURL": "s3://backups/app"},
+			schedule: backupSchedule{schedule: "0 0 3 * * *"},
+			wantErr:  "has no backup secret, use -secret",
+		},
+		{
+			name:     "five field cron",
+			spec:     configured,
+			schedule: backupSchedule{schedule: "0 3 * * *"},
+			wantErr:  "use 6 fields with seconds first",
+		},
+		{
+			name:     "invalid URL",
+			spec:     configured,
+			schedule: backupSchedule{schedule: "0 0 3 * * *", url: "https://backups/app"},
+			wantErr:  "use s3://<bucket>/<path>",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, dynamicClient := newFakeBackups(t, clusterFixture("app", runtime.DeepCopyJSON(tt.spec)))
+			var err error
+			captureStdout(t, func() {
+				err = b.schedule(context.Background(), "app", tt.schedule)
+			})
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("expected an error containing %q, got %v", tt.wantErr, err)
+				}
+				if patches := patches(dynamicClient); len(patches) != 0 {
+					t.Errorf("expected no patch, got %v", patches)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			patches := patches(dynamicClient)
+			if len(patches) != 1 || !reflect.DeepEqual(patches[0], tt.wantPatch) {
+				t.Errorf("expected the merge patch %v, got %v", tt.wantPatch, patches)
+			}
+			if tt.wantSpec == nil {
+				return
+			}
+			cluster, err := b.clusters.Get(context.Background(), "app", metav1.GetOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if spec := cluster.Object["spec"]; !reflect.DeepEqual(spec, tt.wantSpec) {
+				t.Errorf("expected the spec %v, got %v", tt.wantSpec, spec)
+			}
+		})
+	}
+}
+
+func TestBackupCreate(t *testing.T) {
+	tests := []struct {
+		name     string
+		spec     map[string]interface{}
+		backup   string
+		wantName string
+		wantErr  string
+	}{
+		{name: "generated name", spec: map[string]interface{}{"backupURL": "s3://backups/app"}},
+		{name: "given name", spec: map[string]interface{}{"backupURL": "s3://backups/app"}, backup: "before-upgrade", wantName: "before-upgrade"},
+		{name: "no backup URL", spec: map[string]interface{}{}, wantErr: "has no backup URL"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, dynamicClient := newFakeBackups(t, clusterFixture("app", tt.spec))
+			// the fake client doesn't generate names like the API server does
+			dynamicClient.PrependReactor("create", "mysqlbackups", func(action k8stesting.Action) (bool, runtime.Object, error) {
+				obj := action.(k8stesting.CreateAction).GetObject().(*unstructured.Unstructured).DeepCopy()
+				if obj.GetName() == "" && obj.GetGenerateName() != "" {
+					obj.SetName(obj.GetGenerateName() + rand.String(5))
+				}
+				return true, obj, nil
+			})
+
+			created, err := b.create(context.Background(), "app", tt.backup)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("expected an error containing %q, got %v", tt.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.wantName != "" {
+				if created.GetName() != tt.wantName || created.GetGenerateName() != "" {
+					t.Errorf("expected the name %s, got %q with generateName %q", tt.wantName, created.GetName(), created.GetGenerateName())
+				}
+			} else if created.GetGenerateName() != "app-" || !strings.HasPrefix(created.GetName(), "app-") {
+				t.Errorf("expected generateName app-, got %q with generateName %q", created.GetName(), created.GetGenerateName())
+			}
+			if cluster, _, _ := unstructured.NestedString(created.Object, "spec", "clusterName"); cluster != "app" {
+				t.Errorf("expected clusterName app, got %q", cluster)
+			}
+		})
+	}
+}
+
+func TestBackupStatus(t *testing.T) {
+	tests := []struct {
+		name   string
+		status map[string]interface{}
+		want   string
+	}{
+		{name: "complete", status: map[string]interface{}{"completed": true}, want: "Complete"},
+		{
+			name: "failed with reason",
+			status: map[string]interface{}{"conditions": []interface{}{
+				map[string]interface{}{"type": "Complete", "status": "False"},
+				map[string]interface{}{"type": "Failed", "status": "True", "reason": "JobFailed"},
+			}},
+			want: "Failed (JobFailed)",
+		},
+		{
+			name:   "failed",
+			status: map[string]interface{}{"conditions": []interface{}{map[string]interface{}{"type": "Failed", "status": "True"}}},
+			want:   "Failed",
+		},
+		{
+			name:   "running",
+			status: map[string]interface{}{"conditions": []interface{}{map[string]interface{}{"type": "Failed", "status": "False"}}},
+			want:   "Running",
+		},
+		{name: "no status", want: "Running"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			backup := backupFixture("app-1", "app", time.Now(), tt.status)
+			if got := backupStatus(backup); got != tt.want {
+				t.Errorf("expected %s, got %s", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestBackupList(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	b, _ := newFakeBackups(t,
+		backupFixture("app-running", "app", now.Add(-time.Minute), nil),
+		backupFixture("app-complete", "app", now.Add(-2*time.Hour), map[string]interface{}{"completed": true}),
+		backupFixture("app-failed", "app", now.Add(-time.Hour), map[string]interface{}{"conditions": []interface{}{
+			map[string]interface{}{"type": "Failed", "status": "True", "reason": "JobFailed"},
+		}}),
+		backupFixture("other-complete", "other", now.Add(-3*time.Hour), map[string]interface{}{"completed": true}),
+	)
+
+	items, err := b.list(context.Background(), "app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, item := range items {
+		names = append(names, item.GetName())
+	}
+	if want := []string{"app-complete", "app-failed", "app-running"}; !reflect.DeepEqual(names, want) {
+		t.Fatalf("expected the backups of app oldest first %v, got %v", want, names)
+	}
+
+	var out strings.Builder
+	printBackupTable(&out, items, now)
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	for i, want := range []string{"Complete", "Failed (JobFailed)", "Running"} {
+		if !strings.Contains(lines[i+1], want) {
+			t.Errorf("expected line %d to show %s, got %q", i+1, want, lines[i+1])
+		}
+	}
+
+	all, err := b.list(context.Background(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != 4 || all[0].GetName() != "other-complete" {
+		t.Errorf("expected every backup oldest first, got %d", len(all))
+	}
+}
+
+func TestBackupRestore(t *testing.T) {
+	source := map[string]interface{}{
+		"replicas":                       int64(3),
+		"secretName":                     "app-credentials",
+		"mysqlVersion":                   "8.0",
+		"backupSchedule":                 "0 0 2 * * *",
+		"backupURL":                      "s3://backups/app",
+		"backupScheduleJobsHistoryLimit": int64(10),
+		"backupRemoteDeletePolicy":       "retain",
+		"backupSecretName":               "backup-secret",
+	}
+	complete := map[string]interface{}{"completed": true}
+	tests := []struct {
+		name     string
+		objs     []runtime.Object
+		backup   string
+		secret   string
+		replicas int
+		wantSpec map[string]interface{}
+		wantErr  string
+	}{
+		{
+			name:   "copies the source spec",
+			objs:   []runtime.Object{clusterFixture("app", source), backupFixture("app-1", "app", time.Now(), complete)},
+			backup: "app-1",
+			wantSpec: map[string]interface{}{
+				"replicas":             int64(3),
+				"secretName":           "app-credentials",
+				"mysqlVersion":         "8.0",
+				"initBucketURL":        "s3://backups/app/app-1.xbackup.gz",
+				"initBucketSecretName": "backup-secret",
+			},
+		},
+		{
+			name:   "new credentials secret",
+			objs:   []runtime.Object{clusterFixture("app", source), backupFixture("app-1", "app", time.Now(), complete)},
+			backup: "app-1",
+			secret: "restored-credentials",
+			wantSpec: map[string]interface{}{
+				"replicas":             int64(3),
+				"secretName":           "restored-credentials",
+				"mysqlVersion":         "8.0",
+				"initBucketURL":        "s3://backups/app/app-1.xbackup.gz",
+				"initBucketSecretName": "backup-secret",
+			},
+		},
+		{
+			name:     "deleted source cluster",
+			objs:     []runtime.Object{backupFixture("app-1", "app", time.Now(), complete)},
+			backup:   "app-1",
+			secret:   "restored-credentials",
+			replicas: 2,
+			wantSpec: map[string]interface{}{
+				"replicas":             int64(2),
+				"secretName":           "restored-credentials",
+				"initBucketURL":        "s3://backups/app/app-1.xbackup.gz",
+				"initBucketSecretName": "backup-secret",
+			},
+		},
+		{
+			name:    "deleted source cluster without secret",
+			objs:    []runtime.Object{backupFixture("app-1", "app", time.Now(), complete)},
+			backup:  "app-1",
+			wantErr: "doesn't exist anymore, use -secret",
+		},
+		{
+			name:    "running backup",
+			objs:    []runtime.Object{clusterFixture("app", source), backupFixture("app-1", "app", time.Now(), nil)},
+			backup:  "app-1",
+			wantErr: "is not complete, it is Running",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, _ := newFakeBackups(t, tt.objs...)
+			created, err := b.restore(context.Background(), tt.backup, "restored", tt.secret, tt.replicas)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("expected an error containing %q, got %v", tt.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if created.GetName() != "restored" || created.GetNamespace() != "db" {
+				t.Errorf("unexpected cluster %s/%s", created.GetNamespace(), created.GetName())
+			}
+			if spec := created.Object["spec"]; !reflect.DeepEqual(spec, tt.wantSpec) {
+				t.Errorf("expected the spec %v, got %v", tt.wantSpec, spec)
+			}
+			// the source cluster is left alone
+			if source, err := b.clusters.Get(context.Background(), "app", metav1.GetOptions{}); err == nil {
+				if schedule, _, _ := unstructured.NestedString(source.Object, "spec", "backupSchedule"); schedule == "" {
+					t.Error("the backup schedule of the source cluster was removed")
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/discovery/cached/memory"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/restmapper"
+	"k8s.io/client-go/tools/clientcmd"
+	"strings"
+)
+
+// client resolves objects to their resources through discovery and talks to them with the
+// dynamic client, so that it works for every built-in and custom kind
+type client struct {
+	config    *rest.Config
+	discovery discovery.CachedDiscoveryInterface
+	dynamic   dynamic.Interface
+	mapper    meta.ResettableRESTMapper
+	namespace string
+}
+
+func newClient(opts *options) (*client, error) {
+	// use the current context in kubeconfig
+	config, err := clientcmd.BuildConfigFromFlags("", opts.kubeconfig)
+	if err != nil {
+		return nil, fmt.Errorf("failed to build config from flags: %w", err)
+	}
+	discoveryClient, err := discovery.NewDiscoveryClientForConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	dynamicClient, err := dynamic.NewForConfig(config)
+	if err != nil {
+		return nil, err
+	}
+
+	cached := memory.NewMemCacheClient(discoveryClient)
+	return &client{
+		config:    config,
+		discovery: cached,
+		dynamic:   dynamicClient,
+		mapper:    restmapper.NewDeferredDiscoveryRESTMapper(cached),
+		namespace: opts.namespace,
+	}, nil
+}
+
+// mappingFor returns the resource of a kind. The discovery cache is refreshed once when the kind
+// is unknown, it may belong to a CRD created after the cache was filled.
+func (c *client) mappingFor(gvk schema.GroupVersionKind) (*meta.RESTMapping, error) {
+	mapping, err := c.mapper.RESTMapping(gvk.GroupKind(), gvk.Version)
+	if meta.IsNoMatchError(err) {
+		c.mapper.Reset()
+		mapping, err = c.mapper.RESTMapping(gvk.GroupKind(), gvk.Version)
+	}
+	return mapping, err
+}
+
+// mappingForResource resolves a resource argument like kubectl does: a plural, singular or short
+// name, optionally qualified with the group (deployments.apps) or version and group (deployments.v1.apps)
+func (c *client) mappingForResource(arg string) (*meta.RESTMapping, error) {
+	mapper := restmapper.NewShortcutExpander(c.mapper, c.discovery)
+
+	var gvr schema.GroupVersionResource
+	if fullySpecified, groupResource := schema.ParseResourceArg(strings.ToLower(arg)); fullySpecified != nil {
+		if _, err := mapper.ResourceFor(*fullySpecified); err == nil {
+			gvr = *fullySpecified
+		} else {
+			gvr = groupResource.WithVersion("")
+		}
+	} else {
+		gvr = groupResource.WithVersion("")
+	}
+
+	gvk, err := mapper.KindFor(gvr)
+	if meta.IsNoMatchError(err) {
+		c.mapper.Reset()
+		gvk, err = mapper.KindFor(gvr)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unknown resource %q: %w", arg, err)
+	}
+	return c.mappingFor(gvk)
+}
+
+// resourceFor returns the dynamic client of a mapping. Cluster scoped resources ignore the namespace,
+// namespaced resources fall back to the -namespace flag.
+func (c *client) resourceFor(mapping *meta.RESTMapping, namespace string) dynamic.ResourceInterface {
+	if mapping.Scope.Name() != meta.RESTScopeNameNamespace {
+		return c.dynamic.Resource(mapping.Resource)
+	}
+	if namespace == "" {
+		namespace = c.namespace
+	}
+	return c.dynamic.Resource(mapping.Resource).Namespace(namespace)
+}
+
+// resourceForObject returns the dynamic client for an object of a manifest and sets or clears its
+// namespace depending on the scope of its kind
+func (c *client) resourceForObject(obj *unstructured.Unstructured) (dynamic.ResourceInterface, *meta.RESTMapping, error) {
+	gvk := obj.GroupVersionKind()
+	if gvk.Kind == "" || gvk.Version == "" {
+		return nil, nil, fmt.Errorf("object %q has no apiVersion or kind", obj.GetName())
+	}
+	mapping, err := c.mappingFor(gvk)
+	if err != nil {
+		return nil, nil, err
+	}
+	if mapping.Scope.Name() != meta.RESTScopeNameNamespace {
+		obj.SetNamespace("")
+	} else if obj.GetNamespace() == "" {
+		obj.SetNamespace(c.namespace)
+	}
+	return c.resourceFor(mapping, obj.GetNamespace()), mapping, nil
+}
+
+// describe returns a kubectl style name for an object, like deployments.apps/nginx
+func describe(mapping *meta.RESTMapping, obj *unstructured.Unstructured) string {
+	resource := mapping.Resource.Resource
+	if mapping.Resource.Group != "" {
+		resource += "." + mapping.Resource.Group
+	}
+	return resource + "/" + obj.GetName()
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"io"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic/fake"
+	"os"
+	"testing"
+)
+
+// resettable adds the Reset of the discovery based mapper to a static mapper
+type resettable struct {
+	*meta.DefaultRESTMapper
+}
+
+func (resettable) Reset() {}
+
+var fakeKinds = []schema.GroupVersionKind{
+	{Version: "v1", Kind: "Secret"},
+	mysqlClusterKind,
+	mysqlBackupKind,
+}
+
+// newFakeClient returns a client on a fake dynamic client holding objs. It knows secrets and the
+// kinds of the Presslabs MySQL operator.
+func newFakeClient(t *testing.T, objs ...runtime.Object) (*client, *fake.FakeDynamicClient) {
+	t.Helper()
+	mapper := meta.NewDefaultRESTMapper(nil)
+	listKinds := map[schema.GroupVersionResource]string{}
+	for _, gvk := range fakeKinds {
+		mapper.Add(gvk, meta.RESTScopeNamespace)
+		mapping, err := mapper.RESTMapping(gvk.GroupKind(), gvk.Version)
+		if err != nil {
+			t.Fatal(err)
+		}
+		listKinds[mapping.Resource] = gvk.Kind + "List"
+	}
+	dynamicClient := fake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(), listKinds, objs...)
+	return &client{dynamic: dynamicClient, mapper: resettable{mapper}, namespace: "db"}, dynamicClient
+}
+
+// newFakeObject returns an object of kind in the db namespace
+func newFakeObject(gvk schema.GroupVersionKind, name string, content map[string]interface{}) *unstructured.Unstructured {
+	obj := &unstructured.Unstructured{Object: content}
+	if obj.Object == nil {
+		obj.Object = map[string]interface{}{}
+	}
+	obj.SetGroupVersionKind(gvk)
+	obj.SetName(name)
+	obj.SetNamespace("db")
+	return obj
+}
+
+// captureStdout returns what f writes to stdout
+func captureStdout(t *testing.T, f func()) string {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	out := make(chan []byte)
+	go func() {
+		data, _ := io.ReadAll(r)
+		out <- data
+	}()
+	defer func() {
+		os.Stdout = stdout
+	}()
+	f()
+	w.Close()
+	return string(<-out)
+}
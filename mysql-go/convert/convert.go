@@ -0,0 +1,57 @@
+// Package convert converts typed Kubernetes objects to and from unstructured objects, the form
+// the dynamic client works with.
+//
+// Marshalling a typed object to JSON and back into a map[string]interface{} works, but building
+// the map by hand with typed values like pointer.Int32(3) doesn't: the map then holds a *int32
+// that runtime.DeepCopyJSON panics on. The helpers here always produce JSON compatible values.
+package convert
+
+import (
+	"encoding/json"
+	"fmt"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	utiljson "k8s.io/apimachinery/pkg/util/json"
+)
+
+// ToUnstructured converts a typed object. When the object doesn't set apiVersion and kind, as
+// objects returned by typed clients usually don't, they are looked up in the scheme.
+func ToUnstructured(scheme *runtime.Scheme, obj runtime.Object) (*unstructured.Unstructured, error) {
+	content, err := runtime.DefaultUnstructuredConverter.ToUnstructured(obj)
+	if err != nil {
+		return nil, err
+	}
+	u := &unstructured.Unstructured{Object: content}
+	if u.GetKind() == "" || u.GetAPIVersion() == "" {
+		if scheme == nil {
+			return nil, fmt.Errorf("%T has no apiVersion or kind and no scheme was given", obj)
+		}
+		gvks, _, err := scheme.ObjectKinds(obj)
+		if err != nil {
+			return nil, err
+		}
+		u.SetGroupVersionKind(gvks[0])
+	}
+	return u, nil
+}
+
+// FromUnstructured converts an unstructured object into the typed object into.
+// Fields the type doesn't declare are an error, they would be lost silently otherwise.
+func FromUnstructured(u *unstructured.Unstructured, into runtime.Object) error {
+	return runtime.DefaultUnstructuredConverter.FromUnstructuredWithValidation(u.Object, into, true)
+}
+
+// FromMap returns an unstructured object for content built by hand. Values that aren't JSON
+// compatible, like pointers, structs, typed slices or Go ints, are normalized the way the API
+// server would decode them, integers become int64.
+func FromMap(content map[string]interface{}) (*unstructured.Unstructured, error) {
+	data, err := json.Marshal(content)
+	if err != nil {
+		return nil, err
+	}
+	normalized := map[string]interface{}{}
+	if err := utiljson.Unmarshal(data, &normalized); err != nil {
+		return nil, err
+	}
+	return &unstructured.Unstructured{Object: normalized}, nil
+}
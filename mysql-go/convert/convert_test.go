@@ -0,0 +1,172 @@
+package convert
+
+import (
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	kubescheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/utils/pointer"
+	"reflect"
+	"testing"
+)
+
+// roundTrip converts a typed object to unstructured and back and fails on any field that
+// doesn't survive the conversion
+func roundTrip(t *testing.T, scheme *runtime.Scheme, obj runtime.Object) {
+	t.Helper()
+	u, err := ToUnstructured(scheme, obj)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the copy must not panic, which it does for values that aren't JSON compatible
+	u = u.DeepCopy()
+
+	// convert into an empty object, so that dropped fields show up as differences
+	out := reflect.New(reflect.TypeOf(obj).Elem()).Interface().(runtime.Object)
+	if err := FromUnstructured(u, out); err != nil {
+		t.Fatal(err)
+	}
+	// apiVersion and kind may have been filled in from the scheme
+	out.GetObjectKind().SetGroupVersionKind(obj.GetObjectKind().GroupVersionKind())
+	if !equality.Semantic.DeepEqual(obj, out) {
+		t.Fatalf("%T changed in the round trip through unstructured:\nwant %#v\ngot  %#v", obj, obj, out)
+	}
+}
+
+func testPodSpec() corev1.PodSpec {
+	return corev1.PodSpec{
+		Containers: []corev1.Container{{
+			Name:  "mysql",
+			Image: "mysql:8.0",
+			Ports: []corev1.ContainerPort{{Name: "mysql", ContainerPort: 3306}},
+			Env: []corev1.EnvVar{{
+				Name: "MYSQL_ROOT_PASSWORD",
+				ValueFrom: &corev1.EnvVarSource{SecretKeyRef: &corev1.SecretKeySelector{
+					LocalObjectReference: corev1.LocalObjectReference{Name: "mysql-cred"},
+					Key:                  "ROOT_PASSWORD",
+				}},
+			}},
+			Resources: corev1.ResourceRequirements{
+				Requests: corev1.ResourceList{corev1.ResourceMemory: resource.MustParse("512Mi")},
+			},
+		}},
+		TerminationGracePeriodSeconds: pointer.Int64(30),
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	labels := map[string]string{"app": "mysql"}
+	meta := metav1.ObjectMeta{Name: "mysql", Namespace: "db", Labels: labels}
+	tests := []struct {
+		name string
+		obj  runtime.Object
+	}{
+		{
+			name: "Deployment",
+			obj: &appsv1.Deployment{
+				ObjectMeta: meta,
+				Spec: appsv1.DeploymentSpec{
+					Replicas: pointer.Int32(3),
+					Selector: &metav1.LabelSelector{MatchLabels: labels},
+					Template: corev1.PodTemplateSpec{ObjectMeta: metav1.ObjectMeta{Labels: labels}, Spec: testPodSpec()},
+					Strategy: appsv1.DeploymentStrategy{
+						Type: appsv1.RollingUpdateDeploymentStrategyType,
+						RollingUpdate: &appsv1.RollingUpdateDeployment{
+							MaxUnavailable: &intstr.IntOrString{Type: intstr.String, StrVal: "25%"},
+						},
+					},
+				},
+			},
+		},
+		{
+			name: "StatefulSet",
+			obj: &appsv1.StatefulSet{
+				TypeMeta:   metav1.TypeMeta{APIVersion: "apps/v1", Kind: "StatefulSet"},
+				ObjectMeta: meta,
+				Spec: appsv1.StatefulSetSpec{
+					Replicas:    pointer.Int32(3),
+					ServiceName: "mysql",
+					Selector:    &metav1.LabelSelector{MatchLabels: labels},
+					Template:    corev1.PodTemplateSpec{ObjectMeta: metav1.ObjectMeta{Labels: labels}, Spec: testPodSpec()},
+					VolumeClaimTemplates: []corev1.PersistentVolumeClaim{{
+						ObjectMeta: metav1.ObjectMeta{Name: "data"},
+						Spec: corev1.PersistentVolumeClaimSpec{
+							AccessModes: []corev1.PersistentVolumeAccessMode{corev1.ReadWriteOnce},
+							Resources: corev1.ResourceRequirements{
+								Requests: corev1.ResourceList{corev1.ResourceStorage: resource.MustParse("1Gi")},
+							},
+						},
+					}},
+				},
+			},
+		},
+		{
+			name: "Service",
+			obj: &corev1.Service{
+				ObjectMeta: meta,
+				Spec: corev1.ServiceSpec{
+					ClusterIP: corev1.ClusterIPNone,
+					Selector:  labels,
+					Ports:     []corev1.ServicePort{{Name: "mysql", Port: 3306, TargetPort: intstr.FromString("mysql")}},
+				},
+			},
+		},
+		{
+			name: "Pod",
+			obj:  &corev1.Pod{ObjectMeta: meta, Spec: testPodSpec()},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			roundTrip(t, kubescheme.Scheme, tt.obj)
+		})
+	}
+}
+
+func TestFromMapTypedValues(t *testing.T) {
+	u, err := FromMap(map[string]interface{}{
+		"apiVersion": "apps/v1",
+		"kind":       "Deployment",
+		"metadata":   map[string]interface{}{"name": "mysql", "namespace": "db"},
+		"spec": map[string]interface{}{
+			"replicas": pointer.Int32(3),
+			"selector": &metav1.LabelSelector{MatchLabels: map[string]string{"app": "mysql"}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the copy panics on values that aren't JSON compatible
+	u = u.DeepCopy()
+	if replicas := u.Object["spec"].(map[string]interface{})["replicas"]; replicas != int64(3) {
+		t.Errorf("expected replicas to be int64(3), got %T(%v)", replicas, replicas)
+	}
+
+	var d appsv1.Deployment
+	if err := FromUnstructured(u, &d); err != nil {
+		t.Fatal(err)
+	}
+	if d.Spec.Replicas == nil || *d.Spec.Replicas != 3 || d.Spec.Selector.MatchLabels["app"] != "mysql" {
+		t.Errorf("unexpected spec %+v", d.Spec)
+	}
+	roundTrip(t, kubescheme.Scheme, &d)
+}
+
+func TestFromUnstructuredUnknownField(t *testing.T) {
+	u, err := FromMap(map[string]interface{}{
+		"apiVersion": "v1",
+		"kind":       "Service",
+		"metadata":   map[string]interface{}{"name": "mysql"},
+		"spec":       map[string]interface{}{"clusterIp": "None"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := FromUnstructured(u, &corev1.Service{}); err == nil {
+		t.Error("expected an error for the misspelled field clusterIp")
+	}
+}
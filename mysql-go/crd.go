@@ -0,0 +1,441 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	"k8s.io/apiextensions-apiserver/pkg/client/clientset/clientset"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+)
+
+const crdUsage = `Usage: mysql-go crd <command> [flags]
+
+Commands:
+  list                              list the CRDs with their versions and instance counts
+  describe <crd>                    show versions, subresources and printer columns of a CRD
+  explain <crd> [version] [field]   print the schema of a CRD version as a field tree
+  migrate <crd>                     rewrite every instance in the storage version of the CRD
+
+<crd> is the name of the CRD (mysqlclusters.mysql.presslabs.org), its kind (MysqlCluster)
+or its kind qualified with the group (MysqlCluster.mysql.presslabs.org).
+`
+
+// runCRD implements the `crd` command which explores the CustomResourceDefinitions of the cluster
+func runCRD(args []string) error {
+	fs := flag.NewFlagSet("crd", flag.ExitOnError)
+	opts := addCommonFlags(fs)
+	recursive := fs.Bool("recursive", true, "explain prints the nested fields as well")
+	prune := fs.Bool("prune", false, "migrate removes the old versions from status.storedVersions once every instance is rewritten")
+	dryRun := fs.Bool("dry-run", false, "migrate only sends dry run requests")
+	fs.Usage = func() {
+		fmt.Fprint(fs.Output(), crdUsage)
+		fs.PrintDefaults()
+	}
+	_ = fs.Parse(args)
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return fmt.Errorf("missing crd command")
+	}
+
+	ctx := context.TODO()
+	c, err := newClient(opts)
+	if err != nil {
+		return err
+	}
+	explorer, err := newCRDExplorer(ctx, c)
+	if err != nil {
+		return err
+	}
+
+	cmdArgs := fs.Args()[1:]
+	switch fs.Arg(0) {
+	case "list":
+		return explorer.list(ctx, os.Stdout)
+	case "describe":
+		if len(cmdArgs) != 1 {
+			return fmt.Errorf("usage: mysql-go crd describe <crd>")
+		}
+		crd, err := explorer.find(cmdArgs[0])
+		if err != nil {
+			return err
+		}
+		return explorer.describe(ctx, os.Stdout, crd)
+	case "explain":
+		if len(cmdArgs) < 1 || len(cmdArgs) > 3 {
+			return fmt.Errorf("usage: mysql-go crd explain <crd> [version] [field]")
+		}
+		crd, err := explorer.find(cmdArgs[0])
+		if err != nil {
+			return err
+		}
+		version, field := "", ""
+		if len(cmdArgs) > 1 {
+			version = cmdArgs[1]
+		}
+		if len(cmdArgs) > 2 {
+			field = cmdArgs[2]
+		}
+		return explain(os.Stdout, crd, version, field, *recursive)
+	case "migrate":
+		if len(cmdArgs) != 1 {
+			return fmt.Errorf("usage: mysql-go crd migrate <crd> [-prune] [-dry-run]")
+		}
+		crd, err := explorer.find(cmdArgs[0])
+		if err != nil {
+			return err
+		}
+		return explorer.migrate(ctx, os.Stdout, crd, *prune, *dryRun)
+	}
+	fs.Usage()
+	return fmt.Errorf("unknown crd command %q", fs.Arg(0))
+}
+
+// crdExplorer holds the CRDs of the cluster and a scheme with every kind they define, used to
+// resolve kind names given on the command line
+type crdExplorer struct {
+	client    *client
+	crdClient clientset.Interface
+	crds      map[string]*apiextensionsv1.CustomResourceDefinition
+	scheme    *runtime.Scheme
+}
+
+func newCRDExplorer(ctx context.Context, c *client) (*crdExplorer, error) {
+	// 1. Create custom crdClientSet
+	crdClientSet, err := clientset.NewForConfig(c.config)
+	if err != nil {
+		return nil, err
+	}
+
+	// 2. List down all the existing crd in the cluster
+	crdList, err := crdClientSet.ApiextensionsV1().CustomResourceDefinitions().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	// 3. register the kind of every version of every crd in the scheme, served or not, so that
+	// find resolves the kind of a CRD whose versions are all disabled as well
+	e := &crdExplorer{
+		client:    c,
+		crdClient: crdClientSet,
+		crds:      map[string]*apiextensionsv1.CustomResourceDefinition{},
+		scheme:    runtime.NewScheme(),
+	}
+	for i := range crdList.Items {
+		crd := &crdList.Items[i]
+		e.crds[crd.Name] = crd
+		for _, v := range crd.Spec.Versions {
+			e.scheme.AddKnownTypeWithName(
+				schema.GroupVersionKind{
+					Group:   crd.Spec.Group,
+					Version: v.Name,
+					Kind:    crd.Spec.Names.Kind,
+				},
+				&unstructured.Unstructured{},
+			)
+		}
+	}
+	return e, nil
+}
+
+// find returns the CRD named by its name, its kind or its kind qualified with its group
+func (e *crdExplorer) find(name string) (*apiextensionsv1.CustomResourceDefinition, error) {
+	if crd, ok := e.crds[name]; ok {
+		return crd, nil
+	}
+
+	kind, group, _ := strings.Cut(name, ".")
+	found := map[schema.GroupKind]bool{}
+	for gvk := range e.scheme.AllKnownTypes() {
+		if strings.EqualFold(gvk.Kind, kind) && (group == "" || gvk.Group == group) {
+			found[gvk.GroupKind()] = true
+		}
+	}
+	matches := make([]schema.GroupKind, 0, len(found))
+	for gk := range found {
+		matches = append(matches, gk)
+	}
+	sort.Slice(matches, func(i, j int) bool { return matches[i].String() < matches[j].String() })
+	switch len(matches) {
+	case 0:
+		return nil, fmt.Errorf("no CRD found for %q", name)
+	case 1:
+		for _, crd := range e.crds {
+			if crd.Spec.Group == matches[0].Group && crd.Spec.Names.Kind == matches[0].Kind {
+				return crd, nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("%q is ambiguous, it matches %v", name, matches)
+}
+
+// countInstances counts the objects of a CRD version across all namespaces. Only a single object is
+// fetched, the server reports how many remain.
+func (e *crdExplorer) countInstances(ctx context.Context, crd *apiextensionsv1.CustomResourceDefinition, version string) (string, error) {
+	gvr := schema.GroupVersionResource{Group: crd.Spec.Group, Version: version, Resource: crd.Spec.Names.Plural}
+	list, err := e.client.dynamic.Resource(gvr).List(ctx, metav1.ListOptions{Limit: 1})
+	if err != nil {
+		return "", err
+	}
+	count := int64(len(list.Items))
+	if remaining := list.GetRemainingItemCount(); remaining != nil {
+		count += *remaining
+	} else if list.GetContinue() != "" {
+		// the server doesn't report the remaining items for label or field selected lists
+		return fmt.Sprintf("%d+", count), nil
+	}
+	return fmt.Sprint(count), nil
+}
+
+func (e *crdExplorer) list(ctx context.Context, out io.Writer) error {
+	names := make([]string, 0, len(e.crds))
+	for name := range e.crds {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	w := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tGROUP\tKIND\tSCOPE\tVERSIONS\tINSTANCES")
+	for _, name := range names {
+		crd := e.crds[name]
+		var versions []string
+		for _, v := range crd.Spec.Versions {
+			versions = append(versions, v.Name+versionFlags(v))
+		}
+		instances := "-"
+		if version := countVersion(crd); version != "" {
+			count, err := e.countInstances(ctx, crd, version)
+			if err != nil {
+				count = "?"
+			}
+			instances = count
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", crd.Name, crd.Spec.Group, crd.Spec.Names.Kind, crd.Spec.Scope, strings.Join(versions, ","), instances)
+	}
+	return w.Flush()
+}
+
+// countVersion returns the version to count the objects of a CRD in, the storage version if it is
+// served or else the first served version. Every version lists the same objects.
+func countVersion(crd *apiextensionsv1.CustomResourceDefinition) string {
+	version := ""
+	for _, v := range crd.Spec.Versions {
+		if !v.Served {
+			continue
+		}
+		if v.Storage {
+			return v.Name
+		}
+		if version == "" {
+			version = v.Name
+		}
+	}
+	return version
+}
+
+// versionFlags returns the served, storage and deprecated flags of a version, like (served,storage)
+func versionFlags(v apiextensionsv1.CustomResourceDefinitionVersion) string {
+	var flags []string
+	if v.Served {
+		flags = append(flags, "served")
+	}
+	if v.Storage {
+		flags = append(flags, "storage")
+	}
+	if v.Deprecated {
+		flags = append(flags, "deprecated")
+	}
+	return "(" + strings.Join(flags, ",") + ")"
+}
+
+func (e *crdExplorer) describe(ctx context.Context, out io.Writer, crd *apiextensionsv1.CustomResourceDefinition) error {
+	w := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(w, "Name:\t%s\n", crd.Name)
+	fmt.Fprintf(w, "Group:\t%s\n", crd.Spec.Group)
+	fmt.Fprintf(w, "Kind:\t%s\n", crd.Spec.Names.Kind)
+	fmt.Fprintf(w, "Plural:\t%s\n", crd.Spec.Names.Plural)
+	if len(crd.Spec.Names.ShortNames) > 0 {
+		fmt.Fprintf(w, "Short names:\t%s\n", strings.Join(crd.Spec.Names.ShortNames, ","))
+	}
+	if len(crd.Spec.Names.Categories) > 0 {
+		fmt.Fprintf(w, "Categories:\t%s\n", strings.Join(crd.Spec.Names.Categories, ","))
+	}
+	fmt.Fprintf(w, "Scope:\t%s\n", crd.Spec.Scope)
+	if crd.Spec.Conversion != nil {
+		fmt.Fprintf(w, "Conversion:\t%s\n", crd.Spec.Conversion.Strategy)
+	}
+	fmt.Fprintf(w, "Stored versions:\t%s\n", strings.Join(crd.Status.StoredVersions, ","))
+	if version := countVersion(crd); version != "" {
+		count, err := e.countInstances(ctx, crd, version)
+		if err != nil {
+			count = "unknown: " + err.Error()
+		}
+		fmt.Fprintf(w, "Instances:\t%s\n", count)
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	for _, v := range crd.Spec.Versions {
+		fmt.Fprintf(out, "\nVersion %s %s\n", v.Name, versionFlags(v))
+		w = tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+		if v.Deprecated && v.DeprecationWarning != nil {
+			fmt.Fprintf(w, "  Deprecation warning:\t%s\n", *v.DeprecationWarning)
+		}
+		status, scale := "disabled", "disabled"
+		if v.Subresources != nil && v.Subresources.Status != nil {
+			status = "enabled"
+		}
+		if v.Subresources != nil && v.Subresources.Scale != nil {
+			scale = fmt.Sprintf("enabled (spec %s, status %s)", v.Subresources.Scale.SpecReplicasPath, v.Subresources.Scale.StatusReplicasPath)
+		}
+		fmt.Fprintf(w, "  Status subresource:\t%s\n", status)
+		fmt.Fprintf(w, "  Scale subresource:\t%s\n", scale)
+		if err := w.Flush(); err != nil {
+			return err
+		}
+
+		if len(v.AdditionalPrinterColumns) > 0 {
+			fmt.Fprintln(out, "  Printer columns:")
+			w = tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+			fmt.Fprintln(w, "    NAME\tTYPE\tPRIORITY\tJSONPATH\tDESCRIPTION")
+			for _, col := range v.AdditionalPrinterColumns {
+				fmt.Fprintf(w, "    %s\t%s\t%d\t%s\t%s\n", col.Name, col.Type, col.Priority, col.JSONPath, col.Description)
+			}
+			if err := w.Flush(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// explain prints the schema of a field of a CRD version like kubectl explain. Without a version the
+// storage version is used, without a field the whole object is explained.
+func explain(out io.Writer, crd *apiextensionsv1.CustomResourceDefinition, version, field string, recursive bool) error {
+	var v *apiextensionsv1.CustomResourceDefinitionVersion
+	for i := range crd.Spec.Versions {
+		if crd.Spec.Versions[i].Name == version || (version == "" && crd.Spec.Versions[i].Storage) {
+			v = &crd.Spec.Versions[i]
+		}
+	}
+	if v == nil {
+		return fmt.Errorf("CRD %s has no version %q", crd.Name, version)
+	}
+	if v.Schema == nil || v.Schema.OpenAPIV3Schema == nil {
+		return fmt.Errorf("version %s of CRD %s has no schema", v.Name, crd.Name)
+	}
+
+	props := v.Schema.OpenAPIV3Schema
+	path := []string{strings.ToLower(crd.Spec.Names.Kind)}
+	if field != "" {
+		for _, name := range strings.Split(strings.TrimPrefix(field, "."), ".") {
+			props = elementSchema(props)
+			child, ok := props.Properties[name]
+			if !ok {
+				return fmt.Errorf("field %q does not exist in %s", name, strings.Join(path, "."))
+			}
+			props = &child
+			path = append(path, name)
+		}
+	}
+
+	fmt.Fprintf(out, "GROUP:      %s\nKIND:       %s\nVERSION:    %s\n\n", crd.Spec.Group, crd.Spec.Names.Kind, v.Name)
+	if len(path) > 1 {
+		fmt.Fprintf(out, "FIELD: %s %s\n\n", path[len(path)-1], schemaType(props))
+	}
+	fmt.Fprintln(out, "DESCRIPTION:")
+	if props.Description != "" {
+		fmt.Fprintln(out, indent(props.Description, "    "))
+	} else {
+		fmt.Fprintln(out, "    <empty>")
+	}
+
+	element := elementSchema(props)
+	if len(element.Properties) == 0 {
+		return nil
+	}
+	fmt.Fprintln(out, "\nFIELDS:")
+	printFields(out, element, "  ", recursive)
+	return nil
+}
+
+// elementSchema returns the schema of the items of arrays and the values of maps
+func elementSchema(props *apiextensionsv1.JSONSchemaProps) *apiextensionsv1.JSONSchemaProps {
+	switch {
+	case props.Type == "array" && props.Items != nil && props.Items.Schema != nil:
+		return elementSchema(props.Items.Schema)
+	case len(props.Properties) == 0 && props.AdditionalProperties != nil && props.AdditionalProperties.Schema != nil:
+		return elementSchema(props.AdditionalProperties.Schema)
+	}
+	return props
+}
+
+func printFields(out io.Writer, props *apiextensionsv1.JSONSchemaProps, prefix string, recursive bool) {
+	required := map[string]bool{}
+	for _, name := range props.Required {
+		required[name] = true
+	}
+	names := make([]string, 0, len(props.Properties))
+	for name := range props.Properties {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		child := props.Properties[name]
+		line := prefix + name + "\t" + schemaType(&child)
+		if required[name] {
+			line += " -required-"
+		}
+		fmt.Fprintln(out, line)
+		if !recursive {
+			if child.Description != "" {
+				fmt.Fprintln(out, indent(child.Description, prefix+"  "))
+			}
+			fmt.Fprintln(out)
+			continue
+		}
+		if element := elementSchema(&child); len(element.Properties) > 0 {
+			printFields(out, element, prefix+"  ", recursive)
+		}
+	}
+}
+
+// schemaType formats the type of a field the way kubectl explain does, like <[]Object> or <map[string]string>
+func schemaType(props *apiextensionsv1.JSONSchemaProps) string {
+	return "<" + typeName(props) + ">"
+}
+
+func typeName(props *apiextensionsv1.JSONSchemaProps) string {
+	switch {
+	case props.XIntOrString:
+		return "IntOrString"
+	case props.Type == "array":
+		if props.Items != nil && props.Items.Schema != nil {
+			return "[]" + typeName(props.Items.Schema)
+		}
+		return "[]"
+	case props.Type == "object" && len(props.Properties) == 0 && props.AdditionalProperties != nil && props.AdditionalProperties.Schema != nil:
+		return "map[string]" + typeName(props.AdditionalProperties.Schema)
+	case props.Type == "object" || props.Type == "":
+		return "Object"
+	}
+	return props.Type
+}
+
+func indent(text, prefix string) string {
+	lines := strings.Split(strings.TrimSpace(text), "\n")
+	for i, line := range lines {
+		lines[i] = prefix + line
+	}
+	return strings.Join(lines, "\n")
+}
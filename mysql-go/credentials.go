@@ -0,0 +1,242 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/client-go/dynamic"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// rotatedAtAnnotation records when the passwords of a credentials secret were last rotated
+	rotatedAtAnnotation = "mysql-go/rotated-at"
+	// previousHashAnnotation is the annotation holding the sha256 of the value a key of a credentials
+	// secret had before the last rotation, %s is the key
+	previousHashAnnotation = "mysql-go/%s-previous-sha256"
+)
+
+// generatePassword returns a random password of 192 bits without characters that need quoting in a URL
+func generatePassword() (string, error) {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// allPasswordKeys returns every secret key of the profile holding a generated password
+func (p profile) allPasswordKeys() []string {
+	return append([]string{p.passwordKey}, p.passwordKeys...)
+}
+
+// credentialData returns the content of a new credentials secret with generated passwords
+func credentialData(p profile) (map[string]interface{}, error) {
+	data := map[string]interface{}{}
+	for _, key := range p.allPasswordKeys() {
+		password, err := generatePassword()
+		if err != nil {
+			return nil, err
+		}
+		data[key] = password
+	}
+	if p.userKey != "" {
+		data[p.userKey] = p.user
+	}
+	if p.databaseKey != "" {
+		data[p.databaseKey] = p.database
+	}
+	return data, nil
+}
+
+// credentialsSecret returns the dynamic client of secrets and an empty credentials secret
+func credentialsSecret(c *client, s dbSpec) (dynamic.ResourceInterface, *unstructured.Unstructured, error) {
+	secret := &unstructured.Unstructured{}
+	secret.SetAPIVersion("v1")
+	secret.SetKind("Secret")
+	secret.SetName(s.secret)
+	secret.SetNamespace(s.namespace)
+	ri, _, err := c.resourceForObject(secret)
+	return ri, secret, err
+}
+
+// ensureCredentials creates the credentials secret with generated passwords unless it exists and
+// returns the database user. An existing secret is used as is, it must hold the keys the operator expects.
+// The passwords are never printed.
+func ensureCredentials(ctx context.Context, c *client, p profile, s dbSpec, dryRun bool) (string, error) {
+	ri, secret, err := credentialsSecret(c, s)
+	if err != nil {
+		return "", err
+	}
+
+	existing, err := ri.Get(ctx, s.secret, metav1.GetOptions{})
+	if err == nil {
+		var missing []string
+		for _, key := range p.allPasswordKeys() {
+			if _, found, _ := unstructured.NestedString(existing.Object, "data", key); !found {
+				missing = append(missing, key)
+			}
+		}
+		if len(missing) > 0 {
+			return "", fmt.Errorf("secrets/%s is missing keys required by %s: %s", s.secret, p.description, strings.Join(missing, ", "))
+		}
+		user := p.user
+		if encoded, _, _ := unstructured.NestedString(existing.Object, "data", p.userKey); p.userKey != "" && encoded != "" {
+			if decoded, err := base64.StdEncoding.DecodeString(encoded); err == nil {
+				user = string(decoded)
+			}
+		}
+		fmt.Printf("secrets/%s exists, using its credentials\n", s.secret)
+		return user, nil
+	}
+	if !apierrors.IsNotFound(err) {
+		return "", err
+	}
+
+	data, err := credentialData(p)
+	if err != nil {
+		return "", err
+	}
+	secret.Object["type"] = p.secretType
+	secret.Object["stringData"] = data
+	secret.SetLabels(map[string]string{"app.kubernetes.io/instance": s.name, "app.kubernetes.io/managed-by": fieldManager})
+	if _, err := ri.Create(ctx, secret, metav1.CreateOptions{FieldManager: fieldManager, DryRun: dryRunOption(dryRun)}); err != nil {
+		return "", fmt.Errorf("failed to create secrets/%s: %w", s.secret, err)
+	}
+	fmt.Printf("secrets/%s created with keys %s\n", s.secret, strings.Join(sortedKeys(data), ", "))
+	return p.user, nil
+}
+
+// rotateCredentials replaces the passwords of the given keys in place. The sha256 of every previous
+// value is kept in an annotation, so that it can be told which password a client still uses without
+// storing it. The operator is responsible for changing the password in the database, profiles whose
+// operator doesn't are refused.
+func rotateCredentials(ctx context.Context, c *client, p profile, s dbSpec, keys []string, dryRun bool) error {
+	if !p.rotatable {
+		return fmt.Errorf("the %s operator only reads secrets/%s when the cluster is bootstrapped, "+
+			"change the password in the database first and then update the secret", p.description, s.secret)
+	}
+	passwords := p.allPasswordKeys()
+	for _, key := range keys {
+		if !contains(passwords, key) {
+			return fmt.Errorf("key %s of secrets/%s is not a password, rotate one of %s", key, s.secret, strings.Join(passwords, ", "))
+		}
+	}
+	ri, _, err := credentialsSecret(c, s)
+	if err != nil {
+		return err
+	}
+	secret, err := ri.Get(ctx, s.secret, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+
+	data, _, err := unstructured.NestedStringMap(secret.Object, "data")
+	if err != nil {
+		return err
+	}
+	annotations := secret.GetAnnotations()
+	if annotations == nil {
+		annotations = map[string]string{}
+	}
+	for _, key := range keys {
+		encoded, ok := data[key]
+		if !ok {
+			return fmt.Errorf("secrets/%s has no key %s", s.secret, key)
+		}
+		previous, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return fmt.Errorf("key %s of secrets/%s is not base64 encoded: %w", key, s.secret, err)
+		}
+		password, err := generatePassword()
+		if err != nil {
+			return err
+		}
+		sum := sha256.Sum256(previous)
+		annotations[fmt.Sprintf(previousHashAnnotation, key)] = "sha256:" + hex.EncodeToString(sum[:])
+		data[key] = base64.StdEncoding.EncodeToString([]byte(password))
+	}
+	annotations[rotatedAtAnnotation] = time.Now().UTC().Format(time.RFC3339)
+	secret.SetAnnotations(annotations)
+	if err := unstructured.SetNestedStringMap(secret.Object, data, "data"); err != nil {
+		return err
+	}
+
+	// the resourceVersion of the secret read above guards against concurrent rotations
+	if _, err := ri.Update(ctx, secret, metav1.UpdateOptions{FieldManager: fieldManager, DryRun: dryRunOption(dryRun)}); err != nil {
+		return fmt.Errorf("failed to update secrets/%s: %w", s.secret, err)
+	}
+	fmt.Printf("secrets/%s rotated %s\n", s.secret, strings.Join(keys, ", "))
+	return nil
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// runCredentials implements the `credentials` command: `create` creates the credentials secret of
+// a database cluster unless it exists, `rotate` generates new passwords in place
+func runCredentials(args []string) error {
+	if len(args) == 0 || (args[0] != "create" && args[0] != "rotate") {
+		return fmt.Errorf("usage: mysql-go credentials create|rotate -profile <profile> -name <name> [flags]")
+	}
+	fs := flag.NewFlagSet("credentials "+args[0], flag.ExitOnError)
+	opts := addCommonFlags(fs)
+	profileName := fs.String("profile", "presslabs", "operator profile, one of "+profileNames())
+	s := dbSpec{}
+	fs.StringVar(&s.name, "name", "", "name of the database cluster")
+	fs.StringVar(&s.secret, "secret", "", "credentials secret (default <name>-credentials)")
+	keys := fs.String("keys", "", "comma separated keys to rotate (default every password of the profile)")
+	dryRun := fs.Bool("dry-run", false, "only validate the request on the server")
+	_ = fs.Parse(args[1:])
+
+	p, ok := profiles[*profileName]
+	if !ok {
+		return fmt.Errorf("unknown profile %q, use one of %s", *profileName, profileNames())
+	}
+	if s.name == "" && s.secret == "" {
+		return fmt.Errorf("-name or -secret is required")
+	}
+	if s.secret == "" {
+		s.secret = s.name + "-credentials"
+	}
+	s.namespace = opts.namespace
+
+	ctx := context.TODO()
+	c, err := newClient(opts)
+	if err != nil {
+		return err
+	}
+	if args[0] == "create" {
+		_, err := ensureCredentials(ctx, c, p, s, *dryRun)
+		return err
+	}
+	rotate := p.allPasswordKeys()
+	if *keys != "" {
+		rotate = splitList(*keys)
+	}
+	return rotateCredentials(ctx, c, p, s, rotate, *dryRun)
+}
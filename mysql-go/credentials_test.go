@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"strings"
+	"testing"
+)
+
+func credentialsSecretFixture(data map[string]string) *unstructured.Unstructured {
+	encoded := map[string]interface{}{}
+	for key, value := range data {
+		encoded[key] = base64.StdEncoding.EncodeToString([]byte(value))
+	}
+	return newFakeObject(schema.GroupVersionKind{Version: "v1", Kind: "Secret"}, "app-credentials", map[string]interface{}{
+		"type": "Opaque",
+		"data": encoded,
+	})
+}
+
+func TestRotateCredentials(t *testing.T) {
+	previous := map[string]string{"USER": "app", "PASSWORD": "old-password", "ROOT_PASSWORD": "old-root-password"}
+	tests := []struct {
+		name    string
+		profile string
+		keys    []string
+		wantErr string
+	}{
+		{name: "every password", profile: "presslabs", keys: []string{"PASSWORD", "ROOT_PASSWORD"}},
+		{name: "one password", profile: "presslabs", keys: []string{"PASSWORD"}},
+		{name: "missing key", profile: "percona", keys: []string{"monitor"}, wantErr: "has no key monitor"},
+		{name: "misspelled key", profile: "presslabs", keys: []string{"password"}, wantErr: "key password of secrets/app-credentials is not a password"},
+		{name: "user", profile: "presslabs", keys: []string{"USER"}, wantErr: "key USER of secrets/app-credentials is not a password, rotate one of PASSWORD, ROOT_PASSWORD"},
+		{name: "database", profile: "presslabs", keys: []string{"PASSWORD", "DATABASE"}, wantErr: "key DATABASE of secrets/app-credentials is not a password"},
+		{name: "kubedb", profile: "kubedb-mysql", keys: []string{"PASSWORD"}, wantErr: "only reads secrets/app-credentials when the cluster is bootstrapped"},
+		{name: "cnpg", profile: "cnpg", keys: []string{"PASSWORD"}, wantErr: "only reads secrets/app-credentials when the cluster is bootstrapped"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, _ := newFakeClient(t, credentialsSecretFixture(previous))
+			s := dbSpec{name: "app", namespace: "db", secret: "app-credentials"}
+
+			var err error
+			out := captureStdout(t, func() {
+				err = rotateCredentials(context.Background(), c, profiles[tt.profile], s, tt.keys, false)
+			})
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("expected an error containing %q, got %v", tt.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			ri, _, err := credentialsSecret(c, s)
+			if err != nil {
+				t.Fatal(err)
+			}
+			secret, err := ri.Get(context.Background(), s.secret, metav1.GetOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			data, _, _ := unstructured.NestedStringMap(secret.Object, "data")
+			annotations := secret.GetAnnotations()
+			if annotations[rotatedAtAnnotation] == "" {
+				t.Errorf("expected the %s annotation", rotatedAtAnnotation)
+			}
+			for key, value := range previous {
+				decoded, err := base64.StdEncoding.DecodeString(data[key])
+				if err != nil {
+					t.Fatalf("key %s is not base64 encoded: %v", key, err)
+				}
+				hash := annotations[fmt.Sprintf(previousHashAnnotation, key)]
+				if !contains(tt.keys, key) {
+					if string(decoded) != value || hash != "" {
+						t.Errorf("key %s must not change", key)
+					}
+					continue
+				}
+
+				if string(decoded) == value || len(decoded) != 32 {
+					t.Errorf("key %s has no new generated password", key)
+				}
+				sum := sha256.Sum256([]byte(value))
+				if want := "sha256:" + hex.EncodeToString(sum[:]); hash != want {
+					t.Errorf("expected the previous hash of %s to be %s, got %q", key, want, hash)
+				}
+				if strings.Contains(out, string(decoded)) || strings.Contains(out, value) {
+					t.Errorf("a password of %s was printed: %q", key, out)
+				}
+			}
+		})
+	}
+}
+
+func TestEnsureCredentials(t *testing.T) {
+	tests := []struct {
+		name     string
+		profile  string
+		existing map[string]string
+		wantUser string
+		wantErr  string
+	}{
+		{name: "created", profile: "percona", wantUser: "root"},
+		{name: "existing", profile: "presslabs", existing: map[string]string{"USER": "wordpress", "PASSWORD": "p", "ROOT_PASSWORD": "r"}, wantUser: "wordpress"},
+		{name: "existing without a user key", profile: "presslabs", existing: map[string]string{"PASSWORD": "p", "ROOT_PASSWORD": "r"}, wantUser: "app"},
+		{name: "missing root password", profile: "presslabs", existing: map[string]string{"USER": "app", "PASSWORD": "p"}, wantErr: "is missing keys required by Presslabs MySQL operator MysqlCluster: ROOT_PASSWORD"},
+		{
+			name:     "missing system users",
+			profile:  "percona",
+			existing: map[string]string{"root": "r", "monitor": "m"},
+			wantErr:  "is missing keys required by Percona XtraDB Cluster: xtrabackup, proxyadmin, operator, replication",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var objs []runtime.Object
+			if tt.existing != nil {
+				objs = append(objs, credentialsSecretFixture(tt.existing))
+			}
+			c, _ := newFakeClient(t, objs...)
+			s := dbSpec{name: "app", namespace: "db", secret: "app-credentials"}
+			p := profiles[tt.profile]
+
+			var user string
+			var err error
+			out := captureStdout(t, func() {
+				user, err = ensureCredentials(context.Background(), c, p, s, false)
+			})
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("expected an error containing %q, got %v", tt.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if user != tt.wantUser {
+				t.Errorf("expected user %s, got %s", tt.wantUser, user)
+			}
+			if tt.existing != nil {
+				return
+			}
+
+			ri, _, err := credentialsSecret(c, s)
+			if err != nil {
+				t.Fatal(err)
+			}
+			secret, err := ri.Get(context.Background(), s.secret, metav1.GetOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			data, _, _ := unstructured.NestedStringMap(secret.Object, "stringData")
+			for _, key := range p.allPasswordKeys() {
+				if len(data[key]) != 32 {
+					t.Errorf("expected a generated password in key %s, got %d characters", key, len(data[key]))
+				}
+				if strings.Contains(out, data[key]) {
+					t.Errorf("the password of %s was printed: %q", key, out)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,453 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/types"
+	kubescheme "k8s.io/client-go/kubernetes/scheme"
+	"os"
+	"sigs.k8s.io/yaml"
+)
+
+// fieldManager is the field manager of the changes made by mysql-go
+const fieldManager = "mysql-go"
+
+// target is an object addressed either by a manifest or by resource and name
+type target struct {
+	obj     *unstructured.Unstructured
+	mapping *meta.RESTMapping
+	// listed is set for objects read from the cluster with a List
+	listed bool
+}
+
+// resolveTargets returns the objects of the manifest given with -f, or the objects named by the
+// positional arguments `<resource> <name>...`. With a resource and no names every object is listed.
+func resolveTargets(ctx context.Context, c *client, opts *options, args []string, selector string) ([]target, error) {
+	if opts.filename != "" {
+		objs, err := readManifests(opts.filename)
+		if err != nil {
+			return nil, err
+		}
+		targets := make([]target, 0, len(objs))
+		for _, obj := range objs {
+			_, mapping, err := c.resourceForObject(obj)
+			if err != nil {
+				return nil, err
+			}
+			targets = append(targets, target{obj: obj, mapping: mapping})
+		}
+		return targets, nil
+	}
+
+	if len(args) == 0 {
+		return nil, fmt.Errorf("use -f or give a resource and names")
+	}
+	mapping, err := c.mappingForResource(args[0])
+	if err != nil {
+		return nil, err
+	}
+	namespace := ""
+	if mapping.Scope.Name() == meta.RESTScopeNameNamespace {
+		namespace = c.namespace
+	}
+
+	var targets []target
+	if len(args) == 1 {
+		list, err := c.resourceFor(mapping, namespace).List(ctx, metav1.ListOptions{LabelSelector: selector})
+		if err != nil {
+			return nil, err
+		}
+		for i := range list.Items {
+			targets = append(targets, target{obj: &list.Items[i], mapping: mapping, listed: true})
+		}
+		return targets, nil
+	}
+	for _, name := range args[1:] {
+		obj := &unstructured.Unstructured{}
+		obj.SetGroupVersionKind(mapping.GroupVersionKind)
+		obj.SetName(name)
+		obj.SetNamespace(namespace)
+		targets = append(targets, target{obj: obj, mapping: mapping})
+	}
+	return targets, nil
+}
+
+// report prints the objects with -o, or a line per object with the action taken
+func report(opts *options, action string, results []target) error {
+	if opts.output != "" {
+		objs := make([]*unstructured.Unstructured, 0, len(results))
+		for _, r := range results {
+			objs = append(objs, r.obj)
+		}
+		return printObjects(os.Stdout, opts.output, objs)
+	}
+	for _, r := range results {
+		fmt.Println(describe(r.mapping, r.obj), action)
+	}
+	return nil
+}
+
+// builtinGroup reports whether the API group is served by the API server itself, no CRD can
+// define kinds in it
+func builtinGroup(group string) bool {
+	return group == apiextensionsv1.GroupName || kubescheme.Scheme.IsGroupRegistered(group)
+}
+
+// validateBeforeSend validates the custom resources among objs against the CRDs of the cluster.
+// With withCurrent the objects in the cluster are the old objects of the CEL transition rules.
+// The CRDs are only listed when an object may be a custom resource, without the permission to
+// list them the validation is skipped with a warning.
+func validateBeforeSend(ctx context.Context, c *client, objs []*unstructured.Unstructured, enabled, withCurrent bool) error {
+	if !enabled {
+		return nil
+	}
+	custom := false
+	for _, obj := range objs {
+		if !builtinGroup(obj.GroupVersionKind().Group) {
+			custom = true
+			break
+		}
+	}
+	if !custom {
+		return nil
+	}
+	v, err := clusterSchemaValidator(ctx, c)
+	if apierrors.IsForbidden(err) {
+		fmt.Fprintln(os.Stderr, "Warning: not validating custom resources:", err)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var oldFor func(*unstructured.Unstructured) (*unstructured.Unstructured, error)
+	if withCurrent {
+		oldFor = func(obj *unstructured.Unstructured) (*unstructured.Unstructured, error) {
+			ri, _, err := c.resourceForObject(obj)
+			if err != nil {
+				return nil, err
+			}
+			current, err := ri.Get(ctx, obj.GetName(), metav1.GetOptions{})
+			if apierrors.IsNotFound(err) {
+				return nil, nil
+			}
+			return current, err
+		}
+	}
+	return v.validateObjects(ctx, objs, oldFor)
+}
+
+func dryRunOption(dryRun bool) []string {
+	if dryRun {
+		return []string{metav1.DryRunAll}
+	}
+	return nil
+}
+
+// runCreate implements the `create` command. Typed objects of an operator API can be converted
+// with convert.ToUnstructured instead of being written as a manifest.
+func runCreate(args []string) error {
+	fs := flag.NewFlagSet("create", flag.ExitOnError)
+	opts := addCommonFlags(fs)
+	dryRun := fs.Bool("dry-run", false, "only validate the request on the server")
+	validate := fs.Bool("validate", true, "validate custom resources against the schema of their CRD first")
+	wait := addWaitFlags(fs)
+	_ = fs.Parse(args)
+	if err := validateOutput(opts.output); err != nil {
+		return err
+	}
+	cond, err := wait.condition(*dryRun)
+	if err != nil {
+		return err
+	}
+
+	ctx := context.TODO()
+	c, err := newClient(opts)
+	if err != nil {
+		return err
+	}
+	objs, err := readManifests(opts.filename)
+	if err != nil {
+		return err
+	}
+	if err := validateBeforeSend(ctx, c, objs, *validate, false); err != nil {
+		return err
+	}
+
+	var results []target
+	for _, obj := range objs {
+		ri, mapping, err := c.resourceForObject(obj)
+		if err != nil {
+			return err
+		}
+		created, err := ri.Create(ctx, obj, metav1.CreateOptions{FieldManager: fieldManager, DryRun: dryRunOption(*dryRun)})
+		if err != nil {
+			return fmt.Errorf("failed to create %s: %w", describe(mapping, obj), err)
+		}
+		results = append(results, target{obj: created, mapping: mapping})
+	}
+	if err := report(opts, "created", results); err != nil {
+		return err
+	}
+	return waitForAll(ctx, c, results, cond, wait.timeout)
+}
+
+// runGet implements the `get` command
+func runGet(args []string) error {
+	fs := flag.NewFlagSet("get", flag.ExitOnError)
+	opts := addCommonFlags(fs)
+	selector := fs.String("l", "", "label selector used when listing a resource")
+	_ = fs.Parse(args)
+	if opts.output == "" {
+		opts.output = "yaml"
+	}
+	if err := validateOutput(opts.output); err != nil {
+		return err
+	}
+
+	ctx := context.TODO()
+	c, err := newClient(opts)
+	if err != nil {
+		return err
+	}
+	targets, err := resolveTargets(ctx, c, opts, fs.Args(), *selector)
+	if err != nil {
+		return err
+	}
+
+	results := make([]target, 0, len(targets))
+	for _, t := range targets {
+		// listed objects are current already, objects of a manifest are read from the cluster
+		if t.listed {
+			results = append(results, t)
+			continue
+		}
+		obj, err := c.resourceFor(t.mapping, t.obj.GetNamespace()).Get(ctx, t.obj.GetName(), metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		results = append(results, target{obj: obj, mapping: t.mapping})
+	}
+	return report(opts, "", results)
+}
+
+// runUpdate implements the `update` command which replaces objects with the manifest.
+// Objects without a resourceVersion overwrite the current version.
+func runUpdate(args []string) error {
+	fs := flag.NewFlagSet("update", flag.ExitOnError)
+	opts := addCommonFlags(fs)
+	dryRun := fs.Bool("dry-run", false, "only validate the request on the server")
+	validate := fs.Bool("validate", true, "validate custom resources against the schema of their CRD first")
+	_ = fs.Parse(args)
+	if err := validateOutput(opts.output); err != nil {
+		return err
+	}
+
+	ctx := context.TODO()
+	c, err := newClient(opts)
+	if err != nil {
+		return err
+	}
+	objs, err := readManifests(opts.filename)
+	if err != nil {
+		return err
+	}
+	if err := validateBeforeSend(ctx, c, objs, *validate, true); err != nil {
+		return err
+	}
+
+	var results []target
+	for _, obj := range objs {
+		ri, mapping, err := c.resourceForObject(obj)
+		if err != nil {
+			return err
+		}
+		if obj.GetResourceVersion() == "" {
+			current, err := ri.Get(ctx, obj.GetName(), metav1.GetOptions{})
+			if err != nil {
+				return err
+			}
+			obj.SetResourceVersion(current.GetResourceVersion())
+		}
+		updated, err := ri.Update(ctx, obj, metav1.UpdateOptions{FieldManager: fieldManager, DryRun: dryRunOption(*dryRun)})
+		if err != nil {
+			return fmt.Errorf("failed to update %s: %w", describe(mapping, obj), err)
+		}
+		results = append(results, target{obj: updated, mapping: mapping})
+	}
+	return report(opts, "updated", results)
+}
+
+// runPatch implements the `patch` command
+func runPatch(args []string) error {
+	fs := flag.NewFlagSet("patch", flag.ExitOnError)
+	opts := addCommonFlags(fs)
+	patchType := fs.String("type", "merge", "patch type, merge, json or strategic (built-in kinds only)")
+	patch := fs.String("p", "", "the patch, defaults to the manifest itself for merge patches")
+	patchFile := fs.String("patch-file", "", "file holding the patch")
+	dryRun := fs.Bool("dry-run", false, "only validate the request on the server")
+	_ = fs.Parse(args)
+	if err := validateOutput(opts.output); err != nil {
+		return err
+	}
+
+	var pt types.PatchType
+	switch *patchType {
+	case "merge":
+		pt = types.MergePatchType
+	case "json":
+		pt = types.JSONPatchType
+	case "strategic":
+		pt = types.StrategicMergePatchType
+	default:
+		return fmt.Errorf("unknown patch type %q", *patchType)
+	}
+
+	var body []byte
+	switch {
+	case *patch != "":
+		body = []byte(*patch)
+	case *patchFile != "":
+		data, err := os.ReadFile(*patchFile)
+		if err != nil {
+			return err
+		}
+		// accept YAML patches as well, the API only takes JSON
+		if body, err = yaml.YAMLToJSON(data); err != nil {
+			return err
+		}
+	case pt != types.MergePatchType || opts.filename == "":
+		return fmt.Errorf("use -p or -patch-file")
+	}
+
+	ctx := context.TODO()
+	c, err := newClient(opts)
+	if err != nil {
+		return err
+	}
+	targets, err := resolveTargets(ctx, c, opts, fs.Args(), "")
+	if err != nil {
+		return err
+	}
+
+	var results []target
+	for _, t := range targets {
+		data := body
+		if data == nil {
+			if data, err = t.obj.MarshalJSON(); err != nil {
+				return err
+			}
+		}
+		patched, err := c.resourceFor(t.mapping, t.obj.GetNamespace()).Patch(ctx, t.obj.GetName(), pt, data,
+			metav1.PatchOptions{FieldManager: fieldManager, DryRun: dryRunOption(*dryRun)})
+		if err != nil {
+			return fmt.Errorf("failed to patch %s: %w", describe(t.mapping, t.obj), err)
+		}
+		results = append(results, target{obj: patched, mapping: t.mapping})
+	}
+	return report(opts, "patched", results)
+}
+
+// runApply implements the `apply` command which uses server-side apply
+func runApply(args []string) error {
+	fs := flag.NewFlagSet("apply", flag.ExitOnError)
+	opts := addCommonFlags(fs)
+	manager := fs.String("field-manager", fieldManager, "field manager owning the applied fields")
+	force := fs.Bool("force-conflicts", false, "take ownership of fields owned by other managers")
+	dryRun := fs.Bool("dry-run", false, "only validate the request on the server")
+	validate := fs.Bool("validate", true, "validate custom resources against the schema of their CRD first")
+	wait := addWaitFlags(fs)
+	_ = fs.Parse(args)
+	if err := validateOutput(opts.output); err != nil {
+		return err
+	}
+	cond, err := wait.condition(*dryRun)
+	if err != nil {
+		return err
+	}
+
+	ctx := context.TODO()
+	c, err := newClient(opts)
+	if err != nil {
+		return err
+	}
+	objs, err := readManifests(opts.filename)
+	if err != nil {
+		return err
+	}
+	if err := validateBeforeSend(ctx, c, objs, *validate, true); err != nil {
+		return err
+	}
+
+	var results []target
+	for _, obj := range objs {
+		ri, mapping, err := c.resourceForObject(obj)
+		if err != nil {
+			return err
+		}
+		applied, err := ri.Apply(ctx, obj.GetName(), obj, metav1.ApplyOptions{FieldManager: *manager, Force: *force, DryRun: dryRunOption(*dryRun)})
+		if err != nil {
+			return fmt.Errorf("failed to apply %s: %w", describe(mapping, obj), err)
+		}
+		results = append(results, target{obj: applied, mapping: mapping})
+	}
+	if err := report(opts, "applied", results); err != nil {
+		return err
+	}
+	return waitForAll(ctx, c, results, cond, wait.timeout)
+}
+
+// runDelete implements the `delete` command
+func runDelete(args []string) error {
+	fs := flag.NewFlagSet("delete", flag.ExitOnError)
+	opts := addCommonFlags(fs)
+	selector := fs.String("l", "", "label selector used when deleting every object of a resource")
+	cascade := fs.String("cascade", "background", "deletion propagation, background, foreground or orphan")
+	ignoreNotFound := fs.Bool("ignore-not-found", false, "don't fail for objects that don't exist")
+	all := fs.Bool("all", false, "delete every object of the resource when no names and no -l are given")
+	dryRun := fs.Bool("dry-run", false, "only validate the request on the server")
+	_ = fs.Parse(args)
+	if opts.filename == "" && fs.NArg() == 1 && *selector == "" && !*all {
+		return fmt.Errorf("refusing to delete every object of %s, give names, -l or -all", fs.Arg(0))
+	}
+
+	var propagation metav1.DeletionPropagation
+	switch *cascade {
+	case "background":
+		propagation = metav1.DeletePropagationBackground
+	case "foreground":
+		propagation = metav1.DeletePropagationForeground
+	case "orphan":
+		propagation = metav1.DeletePropagationOrphan
+	default:
+		return fmt.Errorf("unknown cascade mode %q", *cascade)
+	}
+
+	ctx := context.TODO()
+	c, err := newClient(opts)
+	if err != nil {
+		return err
+	}
+	targets, err := resolveTargets(ctx, c, opts, fs.Args(), *selector)
+	if err != nil {
+		return err
+	}
+
+	for _, t := range targets {
+		err := c.resourceFor(t.mapping, t.obj.GetNamespace()).Delete(ctx, t.obj.GetName(),
+			metav1.DeleteOptions{PropagationPolicy: &propagation, DryRun: dryRunOption(*dryRun)})
+		if apierrors.IsNotFound(err) && *ignoreNotFound {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed to delete %s: %w", describe(t.mapping, t.obj), err)
+		}
+		fmt.Println(describe(t.mapping, t.obj), "deleted")
+	}
+	return nil
+}
@@ -0,0 +1,374 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io/fs"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/client-go/discovery"
+	"os"
+	"path/filepath"
+	"sigs.k8s.io/yaml"
+	"sort"
+	"strings"
+	"time"
+)
+
+// clusterDir is the directory of the cluster scoped objects of an export
+const clusterDir = "_cluster"
+
+// skippedResources are never exported: they are recreated by controllers or only hold state
+var skippedResources = sets.New(
+	"events",
+	"events.events.k8s.io",
+	"endpoints",
+	"endpointslices.discovery.k8s.io",
+	"leases.coordination.k8s.io",
+	"controllerrevisions.apps",
+)
+
+// stripFields removes the fields populated by the server, so that the object can be applied to
+// another cluster
+func stripFields(obj *unstructured.Unstructured) {
+	unstructured.RemoveNestedField(obj.Object, "status")
+	for _, field := range []string{"uid", "resourceVersion", "generation", "creationTimestamp", "deletionTimestamp",
+		"deletionGracePeriodSeconds", "managedFields", "selfLink", "ownerReferences"} {
+		unstructured.RemoveNestedField(obj.Object, "metadata", field)
+	}
+	annotations := obj.GetAnnotations()
+	for _, key := range []string{"kubectl.kubernetes.io/last-applied-configuration", "deployment.kubernetes.io/revision",
+		"pv.kubernetes.io/bind-completed", "pv.kubernetes.io/bound-by-controller",
+		"volume.beta.kubernetes.io/storage-provisioner", "volume.kubernetes.io/storage-provisioner",
+		"volume.kubernetes.io/selected-node"} {
+		delete(annotations, key)
+	}
+	if len(annotations) == 0 {
+		unstructured.RemoveNestedField(obj.Object, "metadata", "annotations")
+	} else {
+		obj.SetAnnotations(annotations)
+	}
+
+	switch obj.GroupVersionKind().GroupKind() {
+	case schema.GroupKind{Kind: "Service"}:
+		// cluster IPs are allocated by the target cluster, except None of headless services
+		if clusterIP, _, _ := unstructured.NestedString(obj.Object, "spec", "clusterIP"); clusterIP != "None" {
+			unstructured.RemoveNestedField(obj.Object, "spec", "clusterIP")
+			unstructured.RemoveNestedField(obj.Object, "spec", "clusterIPs")
+		}
+		// node ports are allocated by the target cluster as well, the same port may be taken there
+		if ports, found, _ := unstructured.NestedSlice(obj.Object, "spec", "ports"); found {
+			for _, port := range ports {
+				if p, ok := port.(map[string]interface{}); ok {
+					delete(p, "nodePort")
+				}
+			}
+			_ = unstructured.SetNestedSlice(obj.Object, ports, "spec", "ports")
+		}
+		unstructured.RemoveNestedField(obj.Object, "spec", "healthCheckNodePort")
+	case schema.GroupKind{Kind: "Pod"}:
+		// the target cluster schedules the pod on one of its own nodes
+		unstructured.RemoveNestedField(obj.Object, "spec", "nodeName")
+	case schema.GroupKind{Kind: "PersistentVolumeClaim"}:
+		unstructured.RemoveNestedField(obj.Object, "spec", "volumeName")
+	case schema.GroupKind{Group: "batch", Kind: "Job"}:
+		// the generated selector holds the uid of the job
+		if manual, _, _ := unstructured.NestedBool(obj.Object, "spec", "manualSelector"); !manual {
+			unstructured.RemoveNestedField(obj.Object, "spec", "selector")
+			unstructured.RemoveNestedField(obj.Object, "spec", "template", "metadata", "labels", "controller-uid")
+			unstructured.RemoveNestedField(obj.Object, "spec", "template", "metadata", "labels", "batch.kubernetes.io/controller-uid")
+		}
+	}
+}
+
+// skipObject reports whether an object is left out of an export: objects with a controller are
+// recreated by it, the others are created by the cluster itself
+func skipObject(obj *unstructured.Unstructured) bool {
+	if metav1.GetControllerOf(obj) != nil {
+		return true
+	}
+	switch obj.GroupVersionKind().GroupKind() {
+	case schema.GroupKind{Kind: "ConfigMap"}:
+		return obj.GetName() == "kube-root-ca.crt"
+	case schema.GroupKind{Kind: "Secret"}:
+		secretType, _, _ := unstructured.NestedString(obj.Object, "type")
+		return secretType == "kubernetes.io/service-account-token"
+	}
+	return false
+}
+
+// resourceName returns the directory name of a resource, like deployments.apps
+func resourceName(gvr schema.GroupVersionResource) string {
+	if gvr.Group == "" {
+		return gvr.Resource
+	}
+	return gvr.Resource + "." + gvr.Group
+}
+
+// listAll lists every object of a resource page by page
+func listAll(ctx context.Context, c *client, mapping *meta.RESTMapping, namespace string) ([]unstructured.Unstructured, error) {
+	var items []unstructured.Unstructured
+	opts := metav1.ListOptions{Limit: 500}
+	for {
+		list, err := c.resourceFor(mapping, namespace).List(ctx, opts)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, list.Items...)
+		if opts.Continue = list.GetContinue(); opts.Continue == "" {
+			return items, nil
+		}
+	}
+}
+
+// exportResources writes the objects of every listable resource in the namespaces to dir, one YAML
+// file per object in <namespace>/<resource>/<name>.yaml. The namespaces themselves and the CRDs of
+// the exported custom resources are written to _cluster.
+func exportResources(ctx context.Context, c *client, dir string, namespaces []string) error {
+	lists, err := c.discovery.ServerPreferredResources()
+	if err != nil && !discovery.IsGroupDiscoveryFailedError(err) {
+		return err
+	} else if err != nil {
+		fmt.Fprintln(os.Stderr, "Warning:", err)
+	}
+
+	crdMapping, err := c.mappingFor(schema.GroupVersionKind{Group: "apiextensions.k8s.io", Version: "v1", Kind: "CustomResourceDefinition"})
+	if err != nil {
+		return err
+	}
+	crds := map[schema.GroupResource]*unstructured.Unstructured{}
+	crdItems, err := listAll(ctx, c, crdMapping, "")
+	if err != nil {
+		return err
+	}
+	for i := range crdItems {
+		group, _, _ := unstructured.NestedString(crdItems[i].Object, "spec", "group")
+		plural, _, _ := unstructured.NestedString(crdItems[i].Object, "spec", "names", "plural")
+		crds[schema.GroupResource{Group: group, Resource: plural}] = &crdItems[i]
+	}
+
+	write := func(obj *unstructured.Unstructured, gvr schema.GroupVersionResource) error {
+		sub := clusterDir
+		if obj.GetNamespace() != "" {
+			sub = obj.GetNamespace()
+		}
+		path := filepath.Join(dir, sub, resourceName(gvr), obj.GetName()+".yaml")
+		if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+			return err
+		}
+		stripFields(obj)
+		data, err := yaml.Marshal(obj.Object)
+		if err != nil {
+			return err
+		}
+		// exports contain secrets
+		return os.WriteFile(path, data, 0o600)
+	}
+
+	exported, skipped := 0, 0
+	usedCRDs := map[string]*unstructured.Unstructured{}
+	for _, list := range lists {
+		gv, err := schema.ParseGroupVersion(list.GroupVersion)
+		if err != nil {
+			return err
+		}
+		for _, r := range list.APIResources {
+			gvr := gv.WithResource(r.Name)
+			if !r.Namespaced || strings.Contains(r.Name, "/") || !sets.New(r.Verbs...).HasAll("list", "get") || skippedResources.Has(resourceName(gvr)) {
+				continue
+			}
+			mapping, err := c.mappingFor(gv.WithKind(r.Kind))
+			if err != nil {
+				return err
+			}
+			for _, ns := range namespaces {
+				items, err := listAll(ctx, c, mapping, ns)
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "Warning: failed to list %s in %s: %v\n", resourceName(gvr), ns, err)
+					continue
+				}
+				for i := range items {
+					obj := &items[i]
+					if skipObject(obj) {
+						skipped++
+						continue
+					}
+					if err := write(obj, gvr); err != nil {
+						return err
+					}
+					exported++
+				}
+				if crd, ok := crds[gvr.GroupResource()]; ok && len(items) > 0 {
+					usedCRDs[crd.GetName()] = crd
+				}
+			}
+		}
+	}
+
+	nsMapping, err := c.mappingFor(schema.GroupVersionKind{Version: "v1", Kind: "Namespace"})
+	if err != nil {
+		return err
+	}
+	for _, ns := range namespaces {
+		obj, err := c.resourceFor(nsMapping, "").Get(ctx, ns, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		if err := write(obj, nsMapping.Resource); err != nil {
+			return err
+		}
+		exported++
+	}
+	for _, crd := range usedCRDs {
+		if err := write(crd, crdMapping.Resource); err != nil {
+			return err
+		}
+		exported++
+	}
+	fmt.Printf("%d objects exported to %s, %d owned by controllers or created by the cluster skipped\n", exported, dir, skipped)
+	return nil
+}
+
+// importOrder is the order objects are applied in: namespaces first, then CRDs, the objects
+// workloads reference, services, the workloads and at last everything else, including custom resources
+var importOrder = map[schema.GroupKind]int{
+	{Kind: "Namespace"}: 0,
+
+	{Group: "apiextensions.k8s.io", Kind: "CustomResourceDefinition"}: 1,
+
+	{Kind: "ServiceAccount"}:                                  2,
+	{Kind: "Secret"}:                                          2,
+	{Kind: "ConfigMap"}:                                       2,
+	{Kind: "PersistentVolumeClaim"}:                           2,
+	{Kind: "LimitRange"}:                                      2,
+	{Kind: "ResourceQuota"}:                                   2,
+	{Group: "rbac.authorization.k8s.io", Kind: "Role"}:        2,
+	{Group: "rbac.authorization.k8s.io", Kind: "RoleBinding"}: 2,
+
+	{Kind: "Service"}: 3,
+
+	{Group: "apps", Kind: "Deployment"}:  4,
+	{Group: "apps", Kind: "StatefulSet"}: 4,
+	{Group: "apps", Kind: "DaemonSet"}:   4,
+	{Group: "apps", Kind: "ReplicaSet"}:  4,
+	{Group: "batch", Kind: "Job"}:        4,
+	{Group: "batch", Kind: "CronJob"}:    4,
+	{Kind: "Pod"}:                        4,
+}
+
+func importTier(obj *unstructured.Unstructured) int {
+	if tier, ok := importOrder[obj.GroupVersionKind().GroupKind()]; ok {
+		return tier
+	}
+	return 5
+}
+
+// readExport reads every manifest below dir
+func readExport(dir string) ([]*unstructured.Unstructured, error) {
+	var objs []*unstructured.Unstructured
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		switch filepath.Ext(path) {
+		case ".yaml", ".yml", ".json":
+			items, err := readManifests(path)
+			if err != nil {
+				return err
+			}
+			objs = append(objs, items...)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(objs) == 0 {
+		return nil, fmt.Errorf("no objects found in %s", dir)
+	}
+	sort.SliceStable(objs, func(i, j int) bool { return importTier(objs[i]) < importTier(objs[j]) })
+	return objs, nil
+}
+
+// importResources applies the objects of an export in dependency order. The CRDs are waited for
+// until they are established, so that their custom resources can be applied right after.
+func importResources(ctx context.Context, c *client, objs []*unstructured.Unstructured, force, dryRun bool) error {
+	established, err := parseWaitFor("condition=Established")
+	if err != nil {
+		return err
+	}
+	failed := 0
+	for _, obj := range objs {
+		ri, mapping, err := c.resourceForObject(obj)
+		if err != nil {
+			failed++
+			fmt.Fprintf(os.Stderr, "failed to import %s %s: %v\n", obj.GetKind(), obj.GetName(), err)
+			continue
+		}
+		applied, err := ri.Apply(ctx, obj.GetName(), obj, metav1.ApplyOptions{FieldManager: fieldManager, Force: force, DryRun: dryRunOption(dryRun)})
+		if err != nil {
+			failed++
+			fmt.Fprintf(os.Stderr, "failed to import %s: %v\n", describe(mapping, obj), err)
+			continue
+		}
+		fmt.Println(describe(mapping, applied), "imported")
+		if importTier(obj) == 1 && !dryRun {
+			if err := waitFor(ctx, c, target{obj: applied, mapping: mapping}, established, time.Minute); err != nil {
+				return err
+			}
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d objects could not be imported", failed, len(objs))
+	}
+	return nil
+}
+
+// runExport implements the `export` command
+func runExport(args []string) error {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	opts := addCommonFlags(fs)
+	dir := fs.String("dir", "", "directory the objects are written to")
+	namespaces := fs.String("namespaces", "", "comma separated namespaces to export (default the -namespace flag)")
+	_ = fs.Parse(args)
+	if *dir == "" {
+		return fmt.Errorf("-dir is required")
+	}
+	selected := splitList(*namespaces)
+	if len(selected) == 0 {
+		selected = []string{opts.namespace}
+	}
+
+	c, err := newClient(opts)
+	if err != nil {
+		return err
+	}
+	return exportResources(context.TODO(), c, *dir, selected)
+}
+
+// runImport implements the `import` command which applies an export to the cluster
+func runImport(args []string) error {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	opts := addCommonFlags(fs)
+	dir := fs.String("dir", "", "directory written by export")
+	force := fs.Bool("force-conflicts", false, "take ownership of fields owned by other managers")
+	dryRun := fs.Bool("dry-run", false, "only validate the requests on the server")
+	_ = fs.Parse(args)
+	if *dir == "" {
+		return fmt.Errorf("-dir is required")
+	}
+
+	objs, err := readExport(*dir)
+	if err != nil {
+		return err
+	}
+	c, err := newClient(opts)
+	if err != nil {
+		return err
+	}
+	return importResources(context.TODO(), c, objs, *force, *dryRun)
+}
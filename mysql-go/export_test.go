@@ -0,0 +1,346 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestStripFields(t *testing.T) {
+	tests := []struct {
+		name string
+		obj  string
+		want string
+	}{
+		{
+			name: "metadata",
+			obj: `
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: settings
+  namespace: db
+  uid: 0b4c2a4e-3f4a-4b8e-9d2a-1c5e6f7a8b9c
+  resourceVersion: "4711"
+  generation: 2
+  creationTimestamp: "2024-03-01T10:00:00Z"
+  managedFields:
+  - manager: kubectl
+  ownerReferences:
+  - apiVersion: v1
+    kind: Pod
+    name: owner
+    uid: 1
+  labels:
+    app: mysql
+  annotations:
+    kubectl.kubernetes.io/last-applied-configuration: "{}"
+    team: payments
+data:
+  key: value
+`,
+			want: `
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: settings
+  namespace: db
+  labels:
+    app: mysql
+  annotations:
+    team: payments
+data:
+  key: value
+`,
+		},
+		{
+			name: "only server annotations",
+			obj: `
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: app
+  annotations:
+    deployment.kubernetes.io/revision: "3"
+spec:
+  replicas: 2
+status:
+  replicas: 2
+`,
+			want: `
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: app
+spec:
+  replicas: 2
+`,
+		},
+		{
+			name: "service",
+			obj: `
+apiVersion: v1
+kind: Service
+metadata:
+  name: mysql
+spec:
+  type: LoadBalancer
+  clusterIP: 10.96.12.34
+  clusterIPs: [10.96.12.34]
+  healthCheckNodePort: 31000
+  ports:
+  - name: mysql
+    port: 3306
+    nodePort: 30306
+  - name: metrics
+    port: 9104
+`,
+			want: `
+apiVersion: v1
+kind: Service
+metadata:
+  name: mysql
+spec:
+  type: LoadBalancer
+  ports:
+  - name: mysql
+    port: 3306
+  - name: metrics
+    port: 9104
+`,
+		},
+		{
+			name: "headless service",
+			obj: `
+apiVersion: v1
+kind: Service
+metadata:
+  name: mysql-headless
+spec:
+  clusterIP: None
+  clusterIPs: [None]
+  ports:
+  - port: 3306
+`,
+			want: `
+apiVersion: v1
+kind: Service
+metadata:
+  name: mysql-headless
+spec:
+  clusterIP: None
+  clusterIPs: [None]
+  ports:
+  - port: 3306
+`,
+		},
+		{
+			name: "pod",
+			obj: `
+apiVersion: v1
+kind: Pod
+metadata:
+  name: debug
+spec:
+  nodeName: worker-1
+  containers:
+  - name: debug
+    image: busybox
+`,
+			want: `
+apiVersion: v1
+kind: Pod
+metadata:
+  name: debug
+spec:
+  containers:
+  - name: debug
+    image: busybox
+`,
+		},
+		{
+			name: "claim",
+			obj: `
+apiVersion: v1
+kind: PersistentVolumeClaim
+metadata:
+  name: data
+  annotations:
+    pv.kubernetes.io/bind-completed: "yes"
+    volume.kubernetes.io/selected-node: worker-1
+spec:
+  volumeName: pvc-0b4c2a4e
+  resources:
+    requests:
+      storage: 1Gi
+`,
+			want: `
+apiVersion: v1
+kind: PersistentVolumeClaim
+metadata:
+  name: data
+spec:
+  resources:
+    requests:
+      storage: 1Gi
+`,
+		},
+		{
+			name: "job",
+			obj: `
+apiVersion: batch/v1
+kind: Job
+metadata:
+  name: backup
+spec:
+  selector:
+    matchLabels:
+      controller-uid: 0b4c2a4e
+  template:
+    metadata:
+      labels:
+        app: backup
+        controller-uid: 0b4c2a4e
+        batch.kubernetes.io/controller-uid: 0b4c2a4e
+`,
+			want: `
+apiVersion: batch/v1
+kind: Job
+metadata:
+  name: backup
+spec:
+  template:
+    metadata:
+      labels:
+        app: backup
+`,
+		},
+		{
+			name: "job with a manual selector",
+			obj: `
+apiVersion: batch/v1
+kind: Job
+metadata:
+  name: backup
+spec:
+  manualSelector: true
+  selector:
+    matchLabels:
+      app: backup
+`,
+			want: `
+apiVersion: batch/v1
+kind: Job
+metadata:
+  name: backup
+spec:
+  manualSelector: true
+  selector:
+    matchLabels:
+      app: backup
+`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			obj := readManifest(t, tt.obj)
+			stripFields(obj)
+			if want := readManifest(t, tt.want); !reflect.DeepEqual(obj.Object, want.Object) {
+				t.Errorf("unexpected object\nwant %v\ngot  %v", want.Object, obj.Object)
+			}
+		})
+	}
+}
+
+func TestSkipObject(t *testing.T) {
+	tests := []struct {
+		name string
+		obj  string
+		want bool
+	}{
+		{
+			name: "controlled",
+			obj: `
+apiVersion: apps/v1
+kind: ReplicaSet
+metadata:
+  name: app-7d9f
+  ownerReferences:
+  - apiVersion: apps/v1
+    kind: Deployment
+    name: app
+    uid: 0b4c2a4e
+    controller: true
+`,
+			want: true,
+		},
+		{
+			name: "owned without a controller",
+			obj: `
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: settings
+  ownerReferences:
+  - apiVersion: v1
+    kind: Secret
+    name: app
+    uid: 0b4c2a4e
+`,
+		},
+		{name: "root CA", obj: "apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: kube-root-ca.crt\n", want: true},
+		{name: "config map", obj: "apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: settings\n"},
+		{name: "service account token", obj: "apiVersion: v1\nkind: Secret\nmetadata:\n  name: token\ntype: kubernetes.io/service-account-token\n", want: true},
+		{name: "secret", obj: "apiVersion: v1\nkind: Secret\nmetadata:\n  name: credentials\ntype: Opaque\n"},
+		{name: "custom resource named like the root CA", obj: "apiVersion: example.com/v1\nkind: ConfigMap\nmetadata:\n  name: kube-root-ca.crt\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := skipObject(readManifest(t, tt.obj)); got != tt.want {
+				t.Errorf("expected %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestReadExport(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"db/widgets.example.com/w.yaml": "apiVersion: example.com/v1\nkind: Widget\nmetadata:\n  name: w\n  namespace: db\n",
+		"db/deployments.apps/app.yaml":  "apiVersion: apps/v1\nkind: Deployment\nmetadata:\n  name: app\n  namespace: db\n",
+		"db/services/app.yaml":          "apiVersion: v1\nkind: Service\nmetadata:\n  name: app\n  namespace: db\n",
+		"db/secrets/credentials.yaml":   "apiVersion: v1\nkind: Secret\nmetadata:\n  name: credentials\n  namespace: db\n",
+		"db/configmaps/settings.json":   `{"apiVersion": "v1", "kind": "ConfigMap", "metadata": {"name": "settings", "namespace": "db"}}`,
+		"_cluster/namespaces/db.yaml":   "apiVersion: v1\nkind: Namespace\nmetadata:\n  name: db\n",
+		"_cluster/customresourcedefinitions.apiextensions.k8s.io/widgets.example.com.yml": "apiVersion: apiextensions.k8s.io/v1\nkind: CustomResourceDefinition\nmetadata:\n  name: widgets.example.com\n",
+		"README.md": "not a manifest",
+	}
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	objs, err := readExport(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, obj := range objs {
+		got = append(got, obj.GetKind())
+	}
+	// objects of the same tier are kept in the order of their paths
+	want := []string{"Namespace", "CustomResourceDefinition", "ConfigMap", "Secret", "Service", "Deployment", "Widget"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("expected the import order %v, got %v", want, got)
+	}
+
+	if _, err := readExport(t.TempDir()); err == nil {
+		t.Error("expected an error for an empty export")
+	}
+}
@@ -1,174 +1,98 @@
 package main
 
 import (
-	"context"
 	"flag"
 	"fmt"
-	"k8s.io/apiextensions-apiserver/pkg/client/clientset/clientset"
-	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
-	"k8s.io/apimachinery/pkg/runtime"
-	"k8s.io/apimachinery/pkg/runtime/schema"
-	"k8s.io/client-go/dynamic"
-	"k8s.io/client-go/tools/clientcmd"
 	"k8s.io/client-go/util/homedir"
-	"k8s.io/utils/pointer"
-	"log"
+	"os"
 	"path/filepath"
+	"strings"
 )
 
-func main() {
-	// parse the .kubeconfig file
-	var kubeconfig *string
-	if home := homedir.HomeDir(); home != "" {
-		kubeconfig = flag.String("kubeconfig", filepath.Join(home, ".kube", "config"), "(optional) absolute path to the kubeconfig file")
-	} else {
-		kubeconfig = flag.String("kubeconfig", "", "absolute path to the kubeconfig file")
-	}
-	flag.Parse()
+const usage = `Usage: mysql-go <command> [flags]
 
-	// use the current context in kubeconfig
-	ctx := context.TODO()
-	config, err := clientcmd.BuildConfigFromFlags("", *kubeconfig)
-	if err != nil {
-		log.Println(err, "Failed to build config from flags")
-		return
-	}
+Commands:
+  create      create the objects of a manifest
+  get         print objects from a manifest or by resource and name
+  update      replace the objects of a manifest
+  patch       patch an object with a merge, JSON or strategic merge patch
+  apply       server-side apply the objects of a manifest
+  delete      delete objects from a manifest or by resource and name
+  crd         list, describe and explain the CustomResourceDefinitions
+  validate    validate custom resources against the schema of their CRD
+  provision   create a database cluster with one of the supported operators
+  credentials create or rotate the credentials secret of a database cluster
+  backup      schedule, create, list and restore backups of a MysqlCluster
+  export      write every object of namespaces to a directory of YAML files
+  import      apply a directory written by export in dependency order
+  search      find objects of every resource type, or what references a secret or config map
 
-	// create the clientset
-	//clientSet, err := kubernetes.NewForConfig(config)
-	//if err != nil {
-	//	log.Println("Failed to create clientset from the given config")
-	//	return
-	//}
-	// 1. Create custom crdClientSet
-	// here restConfig is your .kube/config file
-	crdClientSet, err := clientset.NewForConfig(config)
-	if err != nil {
-		return
-	}
+Run mysql-go <command> -h for the flags of a command.
+`
 
-	// 2. List down all the existing crd in the cluster
-	crdList, err := crdClientSet.ApiextensionsV1().CustomResourceDefinitions().List(ctx, metav1.ListOptions{})
-	if err != nil {
-		return
-	}
+// options are the flags shared by every command
+type options struct {
+	kubeconfig string
+	namespace  string
+	filename   string
+	output     string
+}
 
-	// 3. get new empty schema holder
-	scheme := runtime.NewScheme()
+// addCommonFlags registers the flags shared by every command on fs
+func addCommonFlags(fs *flag.FlagSet) *options {
+	opts := &options{}
+	// parse the .kubeconfig file
+	if home := homedir.HomeDir(); home != "" {
+		fs.StringVar(&opts.kubeconfig, "kubeconfig", filepath.Join(home, ".kube", "config"), "(optional) absolute path to the kubeconfig file")
+	} else {
+		fs.StringVar(&opts.kubeconfig, "kubeconfig", "", "absolute path to the kubeconfig file")
+	}
+	fs.StringVar(&opts.namespace, "namespace", "default", "namespace of namespaced objects that don't set one")
+	fs.StringVar(&opts.filename, "f", "", "YAML or JSON manifest, - reads from stdin")
+	fs.StringVar(&opts.output, "o", "", "print the resulting objects as yaml or json")
+	return opts
+}
 
-	// 4. loop over all the crd and add to the schema
-	for _, crd := range crdList.Items {
-		for _, v := range crd.Spec.Versions {
-			//fmt.Printf("GROUP = %s        VERSION = %s     KIND = %s\n", crd.Spec.Group, v.Name, crd.Spec.Names.Kind)
-			scheme.AddKnownTypeWithName(
-				schema.GroupVersionKind{
-					Group:   crd.Spec.Group,
-					Version: v.Name,
-					Kind:    crd.Spec.Names.Kind,
-				},
-				&unstructured.Unstructured{},
-			)
+// splitList splits a comma separated flag value, dropping empty elements
+func splitList(s string) []string {
+	var out []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			out = append(out, v)
 		}
 	}
+	return out
+}
 
-	dynamicClient, err := dynamic.NewForConfig(config)
-	if err != nil {
-		fmt.Println("Failed to get dynamic client")
-		return
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
 	}
 
-	dbGVR := schema.GroupVersionResource{
-		Group:    "mysql.presslabs.org",
-		Version:  "v1alpha1",
-		Resource: "mysqlclusters",
+	commands := map[string]func([]string) error{
+		"create":      runCreate,
+		"get":         runGet,
+		"update":      runUpdate,
+		"patch":       runPatch,
+		"apply":       runApply,
+		"delete":      runDelete,
+		"crd":         runCRD,
+		"validate":    runValidate,
+		"provision":   runProvision,
+		"credentials": runCredentials,
+		"backup":      runBackup,
+		"export":      runExport,
+		"import":      runImport,
+		"search":      runSearch,
 	}
-
-	db := &unstructured.Unstructured{
-		Object: map[string]interface{}{
-			"apiVersion": "mysql.presslabs.org/v1alpha1",
-			"kind":       "MysqlCluster",
-			"metadata": map[string]interface{}{
-				"name":      "mysql-sample",
-				"namespace": "db",
-			},
-			"spec": map[string]interface{}{
-				"replicas":     pointer.Int32(3),
-				"secretName":   "mysql-cred",
-				"mysqlVersion": "8.0",
-			},
-		},
+	run, ok := commands[os.Args[1]]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n%s", os.Args[1], usage)
+		os.Exit(2)
 	}
-
-	//db := v1alpha1.MysqlCluster{
-	//	TypeMeta: metav1.TypeMeta{
-	//		Kind:       "MysqlCluster",
-	//		APIVersion: "mysql.presslabs.org/v1alpha1",
-	//	},
-	//	ObjectMeta: metav1.ObjectMeta{
-	//		Name:      "mysql-sample",
-	//		Namespace: "db",
-	//	},
-	//	Spec: v1alpha1.MysqlClusterSpec{
-	//		Replicas:     pointer.Int32(3),
-	//		SecretName:   "mysql-cred",
-	//		MysqlVersion: "8.0", // 8.0.32
-	//		//Image:                          "",
-	//		//InitBucketURL:                  "",
-	//		//InitBucketURI:                  "",
-	//		//InitBucketSecretName:           "",
-	//		//MinAvailable:                   "",
-	//		//BackupSchedule:                 "",
-	//		//BackupURL:                      "",
-	//		//BackupRemoteDeletePolicy:       "",
-	//		//BackupSecretName:               "",
-	//		//BackupScheduleJobsHistoryLimit: nil,
-	//		//MysqlConf:                      nil,
-	//		//PodSpec:                        v1alpha1.PodSpec{},
-	//		//VolumeSpec:                     v1alpha1.VolumeSpec{},
-	//		//TmpfsSize:                      nil,
-	//		//MaxSlaveLatency:                nil,
-	//		//QueryLimits:                    nil,
-	//		//ReadOnly:                       false,
-	//		//ServerIDOffset:                 nil,
-	//		//BackupCompressCommand:          nil,
-	//		//BackupDecompressCommand:        nil,
-	//		//MetricsExporterExtraArgs:       nil,
-	//		//RcloneExtraArgs:                nil,
-	//		//XbstreamExtraArgs:              nil,
-	//		//XtrabackupExtraArgs:            nil,
-	//		//XtrabackupPrepareExtraArgs:     nil,
-	//		//XtrabackupTargetDir:            "",
-	//		//InitFileExtraSQL:               nil,
-	//	},
-	//	Status: v1alpha1.MysqlClusterStatus{},
-	//}
-
-	//dbRaw, err := json.Marshal(db)
-	//if err != nil {
-	//	fmt.Println("Failed to convert db object to raw json")
-	//	return
-	//}
-	//
-	//var mapObj map[string]interface{}
-	//err = json.Unmarshal(dbRaw, &mapObj)
-	//if err != nil {
-	//	fmt.Println("Failed to convert raw object to map")
-	//	return
-	//}
-	//
-	//dbUnstructured := unstructured.Unstructured{
-	//	Object: mapObj,
-	//}
-	//
-	//fmt.Println(dbUnstructured)
-
-	_, err = dynamicClient.Resource(dbGVR).Namespace("db").Create(context.TODO(), db, metav1.CreateOptions{})
-	if err != nil {
-		fmt.Println("Failed to create db")
-		fmt.Println(err)
-		return
+	if err := run(os.Args[2:]); err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		os.Exit(1)
 	}
-
-	fmt.Println("Successfully created db")
 }
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	utiljson "k8s.io/apimachinery/pkg/util/json"
+	utilyaml "k8s.io/apimachinery/pkg/util/yaml"
+	"os"
+	"sigs.k8s.io/yaml"
+)
+
+// readManifests decodes every object of a multi-document YAML or JSON manifest.
+// Lists are flattened into their items.
+func readManifests(filename string) ([]*unstructured.Unstructured, error) {
+	if filename == "" {
+		return nil, fmt.Errorf("no manifest given, use -f")
+	}
+	var r io.Reader = os.Stdin
+	if filename != "-" {
+		f, err := os.Open(filename)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		r = f
+	}
+
+	var objs []*unstructured.Unstructured
+	decoder := utilyaml.NewYAMLOrJSONDecoder(r, 4096)
+	for {
+		var raw json.RawMessage
+		if err := decoder.Decode(&raw); err != nil {
+			if err == io.EOF {
+				break
+			}
+			return nil, fmt.Errorf("failed to decode %s: %w", filename, err)
+		}
+		// decode numbers like the API server does, integers as int64 instead of float64
+		var content map[string]interface{}
+		if err := utiljson.Unmarshal(raw, &content); err != nil {
+			return nil, fmt.Errorf("failed to decode %s: %w", filename, err)
+		}
+		if len(content) == 0 {
+			continue
+		}
+		obj := &unstructured.Unstructured{Object: content}
+		if obj.IsList() {
+			list, err := obj.ToList()
+			if err != nil {
+				return nil, err
+			}
+			for i := range list.Items {
+				objs = append(objs, &list.Items[i])
+			}
+			continue
+		}
+		objs = append(objs, obj)
+	}
+	if len(objs) == 0 {
+		return nil, fmt.Errorf("no objects found in %s", filename)
+	}
+	return objs, nil
+}
+
+// printObjects writes the objects as YAML documents or as JSON, several JSON objects are wrapped in a List
+func printObjects(w io.Writer, output string, objs []*unstructured.Unstructured) error {
+	switch output {
+	case "yaml":
+		for _, obj := range objs {
+			data, err := yaml.Marshal(obj.Object)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(w, "---\n%s", data)
+		}
+		return nil
+	case "json":
+		var v interface{}
+		if len(objs) == 1 {
+			v = objs[0].Object
+		} else {
+			items := make([]interface{}, 0, len(objs))
+			for _, obj := range objs {
+				items = append(items, obj.Object)
+			}
+			v = map[string]interface{}{"apiVersion": "v1", "kind": "List", "items": items}
+		}
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "    ")
+		return enc.Encode(v)
+	}
+	return fmt.Errorf("unknown output format %q, use yaml or json", output)
+}
+
+// validateOutput checks the -o flag before anything is sent to the cluster
+func validateOutput(output string) error {
+	switch output {
+	case "", "yaml", "json":
+		return nil
+	}
+	return fmt.Errorf("unknown output format %q, use yaml or json", output)
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/util/retry"
+)
+
+// storageVersion returns the version of the CRD its objects are stored in
+func storageVersion(crd *apiextensionsv1.CustomResourceDefinition) (string, error) {
+	for _, v := range crd.Spec.Versions {
+		if v.Storage {
+			return v.Name, nil
+		}
+	}
+	return "", fmt.Errorf("CRD %s has no storage version", crd.Name)
+}
+
+// migrate rewrites every instance of the CRD through the API server, which stores them in the
+// storage version of the CRD. Which objects are still stored in an old version can't be told from
+// the API, so every object is rewritten, just like the storage version migrator does. With prune
+// the old versions are removed from status.storedVersions afterwards, so that they can be dropped
+// from the CRD.
+func (e *crdExplorer) migrate(ctx context.Context, out io.Writer, crd *apiextensionsv1.CustomResourceDefinition, prune, dryRun bool) error {
+	storage, err := storageVersion(crd)
+	if err != nil {
+		return err
+	}
+	var stale []string
+	for _, v := range crd.Status.StoredVersions {
+		if v != storage {
+			stale = append(stale, v)
+		}
+	}
+	fmt.Fprintf(out, "CRD %s stores version %s, stored versions are %v\n", crd.Name, storage, crd.Status.StoredVersions)
+	if len(stale) == 0 {
+		fmt.Fprintln(out, "nothing to migrate")
+		return nil
+	}
+
+	ri := e.client.dynamic.Resource(schema.GroupVersionResource{Group: crd.Spec.Group, Version: storage, Resource: crd.Spec.Names.Plural})
+	migrated, gone, failed := 0, 0, 0
+	opts := metav1.ListOptions{Limit: 500}
+	for {
+		list, err := ri.List(ctx, opts)
+		if err != nil {
+			return err
+		}
+		for i := range list.Items {
+			obj := &list.Items[i]
+			name := obj.GetName()
+			if obj.GetNamespace() != "" {
+				name = obj.GetNamespace() + "/" + name
+			}
+			err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+				_, err := ri.Namespace(obj.GetNamespace()).Update(ctx, obj, metav1.UpdateOptions{FieldManager: fieldManager, DryRun: dryRunOption(dryRun)})
+				if apierrors.IsConflict(err) {
+					// the object changed since it was listed, which rewrote it already, but
+					// retry with the current version to be sure
+					current, getErr := ri.Namespace(obj.GetNamespace()).Get(ctx, obj.GetName(), metav1.GetOptions{})
+					if getErr != nil {
+						return getErr
+					}
+					obj = current
+				}
+				return err
+			})
+			switch {
+			case apierrors.IsNotFound(err):
+				gone++
+			case err != nil:
+				failed++
+				fmt.Fprintf(out, "failed to migrate %s: %v\n", name, err)
+			default:
+				migrated++
+			}
+		}
+		if opts.Continue = list.GetContinue(); opts.Continue == "" {
+			break
+		}
+	}
+	action := "migrated"
+	if dryRun {
+		action = "can be migrated"
+	}
+	fmt.Fprintf(out, "%d objects %s to %s, %d deleted meanwhile, %d failed\n", migrated, action, storage, gone, failed)
+	if failed > 0 {
+		return fmt.Errorf("%d objects of %s could not be migrated, status.storedVersions is left unchanged", failed, crd.Name)
+	}
+	if !prune {
+		return nil
+	}
+	if dryRun {
+		fmt.Fprintf(out, "would remove %v from status.storedVersions\n", stale)
+		return nil
+	}
+
+	err = retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		current, err := e.crdClient.ApiextensionsV1().CustomResourceDefinitions().Get(ctx, crd.Name, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		// the storage version may have been changed while migrating
+		if v, err := storageVersion(current); err != nil || v != storage {
+			return fmt.Errorf("the storage version of CRD %s changed to %s while migrating, run migrate again", crd.Name, v)
+		}
+		current.Status.StoredVersions = []string{storage}
+		_, err = e.crdClient.ApiextensionsV1().CustomResourceDefinitions().UpdateStatus(ctx, current, metav1.UpdateOptions{FieldManager: fieldManager})
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to prune status.storedVersions of CRD %s: %w", crd.Name, err)
+	}
+	fmt.Fprintf(out, "removed %v from status.storedVersions\n", stale)
+	return nil
+}
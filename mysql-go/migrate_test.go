@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	apiextensionsfake "k8s.io/apiextensions-apiserver/pkg/client/clientset/clientset/fake"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic/fake"
+	k8stesting "k8s.io/client-go/testing"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+var widgetResource = schema.GroupVersionResource{Group: "example.com", Version: "v1", Resource: "widgets"}
+
+// widgetCRDFixture returns the Widget CRD storing version v1, with storedVersions as given
+func widgetCRDFixture(storedVersions ...string) *apiextensionsv1.CustomResourceDefinition {
+	return &apiextensionsv1.CustomResourceDefinition{
+		ObjectMeta: metav1.ObjectMeta{Name: "widgets.example.com"},
+		Spec: apiextensionsv1.CustomResourceDefinitionSpec{
+			Group: "example.com",
+			Names: apiextensionsv1.CustomResourceDefinitionNames{Kind: "Widget", Plural: "widgets"},
+			Scope: apiextensionsv1.NamespaceScoped,
+			Versions: []apiextensionsv1.CustomResourceDefinitionVersion{
+				{Name: "v1beta1", Served: true},
+				{Name: "v1", Served: true, Storage: true},
+			},
+		},
+		Status: apiextensionsv1.CustomResourceDefinitionStatus{StoredVersions: storedVersions},
+	}
+}
+
+// newFakeCRDExplorer returns an explorer on a fake dynamic client holding the widgets and a fake
+// apiextensions clientset holding the CRD
+func newFakeCRDExplorer(crd *apiextensionsv1.CustomResourceDefinition, widgets ...string) (*crdExplorer, *fake.FakeDynamicClient, *apiextensionsfake.Clientset) {
+	var objs []runtime.Object
+	for _, name := range widgets {
+		objs = append(objs, newFakeObject(widgetResource.GroupVersion().WithKind("Widget"), name, nil))
+	}
+	dynamicClient := fake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(),
+		map[schema.GroupVersionResource]string{widgetResource: "WidgetList"}, objs...)
+	crdClient := apiextensionsfake.NewSimpleClientset(crd)
+	e := &crdExplorer{
+		client:    &client{dynamic: dynamicClient, namespace: "db"},
+		crdClient: crdClient,
+		crds:      map[string]*apiextensionsv1.CustomResourceDefinition{crd.Name: crd},
+	}
+	return e, dynamicClient, crdClient
+}
+
+// countActions counts the actions with the verb on the resource, and the subresource if given
+func countActions(actions []k8stesting.Action, verb, resource, subresource string) int {
+	n := 0
+	for _, action := range actions {
+		if action.GetVerb() == verb && action.GetResource().Resource == resource && action.GetSubresource() == subresource {
+			n++
+		}
+	}
+	return n
+}
+
+func TestMigrate(t *testing.T) {
+	// failUpdate makes rewriting the widget named fail
+	failUpdate := func(name string) func(*fake.FakeDynamicClient, *apiextensionsfake.Clientset) {
+		return func(dynamicClient *fake.FakeDynamicClient, _ *apiextensionsfake.Clientset) {
+			dynamicClient.PrependReactor("update", "widgets", func(action k8stesting.Action) (bool, runtime.Object, error) {
+				obj := action.(k8stesting.UpdateAction).GetObject().(metav1.Object)
+				if obj.GetName() == name {
+					return true, nil, fmt.Errorf("admission webhook denied the request")
+				}
+				return false, nil, nil
+			})
+		}
+	}
+	// changeStorage switches the storage version of the CRD to v1beta1 while the widgets are rewritten
+	changeStorage := func(dynamicClient *fake.FakeDynamicClient, crdClient *apiextensionsfake.Clientset) {
+		dynamicClient.PrependReactor("update", "widgets", func(k8stesting.Action) (bool, runtime.Object, error) {
+			crd, err := crdClient.ApiextensionsV1().CustomResourceDefinitions().Get(context.Background(), "widgets.example.com", metav1.GetOptions{})
+			if err != nil {
+				return true, nil, err
+			}
+			crd.Spec.Versions[0].Storage, crd.Spec.Versions[1].Storage = true, false
+			_, err = crdClient.ApiextensionsV1().CustomResourceDefinitions().Update(context.Background(), crd, metav1.UpdateOptions{})
+			return false, nil, err
+		})
+	}
+
+	tests := []struct {
+		name           string
+		storedVersions []string
+		prune          bool
+		dryRun         bool
+		setup          func(*fake.FakeDynamicClient, *apiextensionsfake.Clientset)
+		wantUpdates    int
+		wantOut        string
+		wantErr        string
+		wantStored     []string
+	}{
+		{
+			name:           "nothing to migrate",
+			storedVersions: []string{"v1"},
+			prune:          true,
+			wantOut:        "nothing to migrate",
+			wantStored:     []string{"v1"},
+		},
+		{
+			name:           "migrate without prune",
+			storedVersions: []string{"v1beta1", "v1"},
+			wantUpdates:    3,
+			wantOut:        "3 objects migrated to v1, 0 deleted meanwhile, 0 failed",
+			wantStored:     []string{"v1beta1", "v1"},
+		},
+		{
+			name:           "migrate and prune",
+			storedVersions: []string{"v1beta1", "v1"},
+			prune:          true,
+			wantUpdates:    3,
+			wantOut:        "removed [v1beta1] from status.storedVersions",
+			wantStored:     []string{"v1"},
+		},
+		{
+			name:           "failed rewrite",
+			storedVersions: []string{"v1beta1", "v1"},
+			prune:          true,
+			setup:          failUpdate("b"),
+			wantUpdates:    3,
+			wantOut:        "failed to migrate db/b: admission webhook denied the request",
+			wantErr:        "1 objects of widgets.example.com could not be migrated, status.storedVersions is left unchanged",
+			wantStored:     []string{"v1beta1", "v1"},
+		},
+		{
+			name:           "storage version changed",
+			storedVersions: []string{"v1beta1", "v1"},
+			prune:          true,
+			setup:          changeStorage,
+			wantUpdates:    3,
+			wantErr:        "the storage version of CRD widgets.example.com changed to v1beta1 while migrating",
+			wantStored:     []string{"v1beta1", "v1"},
+		},
+		{
+			name:           "dry run",
+			storedVersions: []string{"v1beta1", "v1"},
+			prune:          true,
+			dryRun:         true,
+			wantUpdates:    3,
+			wantOut:        "would remove [v1beta1] from status.storedVersions",
+			wantStored:     []string{"v1beta1", "v1"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			crd := widgetCRDFixture(tt.storedVersions...)
+			e, dynamicClient, crdClient := newFakeCRDExplorer(crd, "a", "b", "c")
+			if tt.setup != nil {
+				tt.setup(dynamicClient, crdClient)
+			}
+
+			var out bytes.Buffer
+			err := e.migrate(context.Background(), &out, crd, tt.prune, tt.dryRun)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("expected an error containing %q, got %v", tt.wantErr, err)
+				}
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.Contains(out.String(), tt.wantOut) {
+				t.Errorf("expected the output to contain %q, got %q", tt.wantOut, out.String())
+			}
+
+			if n := countActions(dynamicClient.Actions(), "update", "widgets", ""); n != tt.wantUpdates {
+				t.Errorf("expected %d widgets to be rewritten, got %d", tt.wantUpdates, n)
+			}
+			statusUpdates := countActions(crdClient.Actions(), "update", "customresourcedefinitions", "status")
+			if wantStatus := !reflect.DeepEqual(tt.storedVersions, tt.wantStored); (statusUpdates > 0) != wantStatus {
+				t.Errorf("expected a status update %v, got %d", wantStatus, statusUpdates)
+			}
+			current, err := crdClient.ApiextensionsV1().CustomResourceDefinitions().Get(context.Background(), crd.Name, metav1.GetOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(current.Status.StoredVersions, tt.wantStored) {
+				t.Errorf("expected stored versions %v, got %v", tt.wantStored, current.Status.StoredVersions)
+			}
+		})
+	}
+}
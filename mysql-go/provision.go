@@ -0,0 +1,331 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"raihankhan/kubernetes-handbook/mysql-go/convert"
+	"sort"
+	"strings"
+	"time"
+)
+
+// dbSpec is the operator independent description of a database cluster
+type dbSpec struct {
+	name         string
+	namespace    string
+	version      string
+	replicas     int
+	storage      string
+	storageClass string
+	secret       string
+}
+
+// pvcSpec returns a persistentVolumeClaim spec requesting the storage of the database
+func (s dbSpec) pvcSpec() map[string]interface{} {
+	pvc := map[string]interface{}{
+		"accessModes": []string{"ReadWriteOnce"},
+		"resources":   map[string]interface{}{"requests": map[string]interface{}{"storage": s.storage}},
+	}
+	if s.storageClass != "" {
+		pvc["storageClassName"] = s.storageClass
+	}
+	return pvc
+}
+
+// profile describes how an operator provisions a database cluster: the custom resource it
+// watches, the credentials secret it expects and how to reach the database once it is ready
+type profile struct {
+	description    string
+	apiVersion     string
+	kind           string
+	scheme         string
+	port           int
+	defaultVersion string
+	// user is the database user of the credentials, userKey is the secret key holding it if any
+	user        string
+	userKey     string
+	passwordKey string
+	// passwordKeys are the keys of further generated passwords, like the root password or the
+	// system users the Percona operator refuses to start a cluster without
+	passwordKeys []string
+	secretType   string
+	// rotatable is set when the operator picks up a new password from the secret, other operators
+	// only read it when the cluster is bootstrapped
+	rotatable bool
+	// database is the database created by the operator, empty if none. databaseKey is the
+	// secret key the operator reads it from, if any.
+	database    string
+	databaseKey string
+	// ready is the -wait-for expression that matches once the cluster accepts connections
+	ready   string
+	service func(s dbSpec) string
+	spec    func(s dbSpec) map[string]interface{}
+}
+
+var profiles = map[string]profile{
+	"presslabs": {
+		description:    "Presslabs MySQL operator MysqlCluster",
+		apiVersion:     "mysql.presslabs.org/v1alpha1",
+		kind:           "MysqlCluster",
+		scheme:         "mysql",
+		port:           3306,
+		defaultVersion: "5.7",
+		user:           "app",
+		userKey:        "USER",
+		passwordKey:    "PASSWORD",
+		passwordKeys:   []string{"ROOT_PASSWORD"},
+		secretType:     "Opaque",
+		rotatable:      true,
+		database:       "app",
+		databaseKey:    "DATABASE",
+		ready:          "condition=Ready",
+		service:        func(s dbSpec) string { return s.name + "-mysql-master" },
+		spec: func(s dbSpec) map[string]interface{} {
+			return map[string]interface{}{
+				"replicas":     s.replicas,
+				"secretName":   s.secret,
+				"mysqlVersion": s.version,
+				"volumeSpec":   map[string]interface{}{"persistentVolumeClaim": s.pvcSpec()},
+			}
+		},
+	},
+	"kubedb-mysql": {
+		description:    "KubeDB MySQL",
+		apiVersion:     "kubedb.com/v1alpha2",
+		kind:           "MySQL",
+		scheme:         "mysql",
+		port:           3306,
+		defaultVersion: "8.0.35",
+		user:           "root",
+		userKey:        "username",
+		passwordKey:    "password",
+		secretType:     "kubernetes.io/basic-auth",
+		ready:          "jsonpath={.status.phase}=Ready",
+		service:        func(s dbSpec) string { return s.name },
+		spec: func(s dbSpec) map[string]interface{} {
+			spec := kubeDBSpec(s)
+			if s.replicas > 1 {
+				spec["topology"] = map[string]interface{}{"mode": "GroupReplication"}
+			}
+			return spec
+		},
+	},
+	"kubedb-postgres": {
+		description:    "KubeDB Postgres",
+		apiVersion:     "kubedb.com/v1alpha2",
+		kind:           "Postgres",
+		scheme:         "postgresql",
+		port:           5432,
+		defaultVersion: "16.1",
+		user:           "postgres",
+		userKey:        "username",
+		passwordKey:    "password",
+		secretType:     "kubernetes.io/basic-auth",
+		ready:          "jsonpath={.status.phase}=Ready",
+		service:        func(s dbSpec) string { return s.name },
+		spec:           kubeDBSpec,
+	},
+	"cnpg": {
+		description:    "CloudNativePG Cluster",
+		apiVersion:     "postgresql.cnpg.io/v1",
+		kind:           "Cluster",
+		scheme:         "postgresql",
+		port:           5432,
+		defaultVersion: "16.1",
+		user:           "app",
+		userKey:        "username",
+		passwordKey:    "password",
+		secretType:     "kubernetes.io/basic-auth",
+		database:       "app",
+		ready:          "condition=Ready",
+		service:        func(s dbSpec) string { return s.name + "-rw" },
+		spec: func(s dbSpec) map[string]interface{} {
+			storage := map[string]interface{}{"size": s.storage}
+			if s.storageClass != "" {
+				storage["storageClass"] = s.storageClass
+			}
+			return map[string]interface{}{
+				"instances": s.replicas,
+				"imageName": "ghcr.io/cloudnative-pg/postgresql:" + s.version,
+				"storage":   storage,
+				"bootstrap": map[string]interface{}{
+					"initdb": map[string]interface{}{
+						"database": "app",
+						"owner":    "app",
+						"secret":   map[string]interface{}{"name": s.secret},
+					},
+				},
+			}
+		},
+	},
+	"percona": {
+		description:    "Percona XtraDB Cluster",
+		apiVersion:     "pxc.percona.com/v1",
+		kind:           "PerconaXtraDBCluster",
+		scheme:         "mysql",
+		port:           3306,
+		defaultVersion: "8.0.33-25.1",
+		user:           "root",
+		passwordKey:    "root",
+		passwordKeys:   []string{"xtrabackup", "monitor", "proxyadmin", "operator", "replication"},
+		secretType:     "Opaque",
+		rotatable:      true,
+		ready:          "jsonpath={.status.state}=ready",
+		service:        func(s dbSpec) string { return s.name + "-haproxy" },
+		spec: func(s dbSpec) map[string]interface{} {
+			return map[string]interface{}{
+				"crVersion":   "1.13.0",
+				"secretsName": s.secret,
+				"pxc": map[string]interface{}{
+					"size":       s.replicas,
+					"image":      "percona/percona-xtradb-cluster:" + s.version,
+					"volumeSpec": map[string]interface{}{"persistentVolumeClaim": s.pvcSpec()},
+				},
+				"haproxy": map[string]interface{}{
+					"enabled": true,
+					"size":    2,
+					"image":   "percona/percona-xtradb-cluster-operator:1.13.0-haproxy",
+				},
+			}
+		},
+	},
+}
+
+// kubeDBSpec returns the spec shared by the KubeDB databases
+func kubeDBSpec(s dbSpec) map[string]interface{} {
+	return map[string]interface{}{
+		"version":           s.version,
+		"replicas":          s.replicas,
+		"storageType":       "Durable",
+		"storage":           s.pvcSpec(),
+		"authSecret":        map[string]interface{}{"name": s.secret},
+		"terminationPolicy": "Delete",
+	}
+}
+
+func profileNames() string {
+	names := make([]string, 0, len(profiles))
+	for name := range profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// render returns the custom resource of the database cluster
+func (p profile) render(s dbSpec) (*unstructured.Unstructured, error) {
+	return convert.FromMap(map[string]interface{}{
+		"apiVersion": p.apiVersion,
+		"kind":       p.kind,
+		"metadata": map[string]interface{}{
+			"name":      s.name,
+			"namespace": s.namespace,
+		},
+		"spec": p.spec(s),
+	})
+}
+
+// printConnection prints how to reach the database, the password is only referenced by its secret
+func printConnection(p profile, s dbSpec, user string) {
+	host := fmt.Sprintf("%s.%s.svc", p.service(s), s.namespace)
+	url := fmt.Sprintf("%s://%s@%s:%d/%s", p.scheme, user, host, p.port, p.database)
+	fmt.Printf("Host:     %s\n", host)
+	fmt.Printf("Port:     %d\n", p.port)
+	fmt.Printf("User:     %s\n", user)
+	fmt.Printf("Password: key %s of secret %s/%s\n", p.passwordKey, s.namespace, s.secret)
+	if p.database != "" {
+		fmt.Printf("Database: %s\n", p.database)
+	}
+	fmt.Printf("URL:      %s\n", url)
+}
+
+// runProvision implements the `provision` command which creates a database cluster with one of the
+// supported operators from a common spec
+func runProvision(args []string) error {
+	fs := flag.NewFlagSet("provision", flag.ExitOnError)
+	opts := addCommonFlags(fs)
+	profileName := fs.String("profile", "presslabs", "operator profile, one of "+profileNames())
+	s := dbSpec{}
+	fs.StringVar(&s.name, "name", "", "name of the database cluster")
+	fs.StringVar(&s.version, "version", "", "database version, defaults to a version supported by the operator")
+	fs.IntVar(&s.replicas, "replicas", 1, "number of database instances")
+	fs.StringVar(&s.storage, "storage", "1Gi", "storage requested by each instance")
+	fs.StringVar(&s.storageClass, "storage-class", "", "storage class of the volumes, the default class if empty")
+	fs.StringVar(&s.secret, "secret", "", "credentials secret, created with a generated password if missing (default <name>-credentials)")
+	wait := fs.Bool("wait", true, "wait until the cluster is ready and print the connection details")
+	timeout := fs.Duration("timeout", 15*time.Minute, "how long to wait for the cluster to be ready")
+	dryRun := fs.Bool("dry-run", false, "only validate the requests on the server")
+	validate := fs.Bool("validate", true, "validate the custom resource against the schema of its CRD first")
+	_ = fs.Parse(args)
+	if err := validateOutput(opts.output); err != nil {
+		return err
+	}
+
+	p, ok := profiles[*profileName]
+	if !ok {
+		return fmt.Errorf("unknown profile %q, use one of %s", *profileName, profileNames())
+	}
+	if s.name == "" {
+		return fmt.Errorf("-name is required")
+	}
+	if s.replicas < 1 {
+		return fmt.Errorf("-replicas must be at least 1")
+	}
+	if _, err := resource.ParseQuantity(s.storage); err != nil {
+		return fmt.Errorf("invalid -storage %q: %w", s.storage, err)
+	}
+	if s.version == "" {
+		s.version = p.defaultVersion
+	}
+	if s.secret == "" {
+		s.secret = s.name + "-credentials"
+	}
+	s.namespace = opts.namespace
+
+	obj, err := p.render(s)
+	if err != nil {
+		return err
+	}
+	ctx := context.TODO()
+	c, err := newClient(opts)
+	if err != nil {
+		return err
+	}
+	ri, mapping, err := c.resourceForObject(obj)
+	if err != nil {
+		return fmt.Errorf("%s is not installed: %w", p.description, err)
+	}
+	if err := validateBeforeSend(ctx, c, []*unstructured.Unstructured{obj}, *validate, true); err != nil {
+		return err
+	}
+
+	user, err := ensureCredentials(ctx, c, p, s, *dryRun)
+	if err != nil {
+		return err
+	}
+	applied, err := ri.Apply(ctx, obj.GetName(), obj, metav1.ApplyOptions{FieldManager: fieldManager, DryRun: dryRunOption(*dryRun)})
+	if err != nil {
+		return fmt.Errorf("failed to apply %s: %w", describe(mapping, obj), err)
+	}
+	result := target{obj: applied, mapping: mapping}
+	if err := report(opts, "applied", []target{result}); err != nil {
+		return err
+	}
+	if !*wait || *dryRun {
+		return nil
+	}
+
+	cond, err := parseWaitFor(p.ready)
+	if err != nil {
+		return err
+	}
+	if err := waitFor(ctx, c, result, cond, *timeout); err != nil {
+		return err
+	}
+	printConnection(p, s, user)
+	return nil
+}
@@ -0,0 +1,344 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/duration"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/metadata"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// searchFilter selects objects by their metadata, empty fields match every object
+type searchFilter struct {
+	// name is a glob pattern like mysql-*
+	name string
+	// annotation is an annotation key, or key=value
+	annotation string
+	// owner is Kind/name or the uid of an owner
+	owner string
+}
+
+func (f searchFilter) matches(obj metav1.Object) bool {
+	if f.name != "" {
+		if ok, _ := path.Match(f.name, obj.GetName()); !ok {
+			return false
+		}
+	}
+	if f.annotation != "" {
+		key, value, hasValue := strings.Cut(f.annotation, "=")
+		v, ok := obj.GetAnnotations()[key]
+		if !ok || (hasValue && v != value) {
+			return false
+		}
+	}
+	if f.owner != "" {
+		kind, name, _ := strings.Cut(f.owner, "/")
+		found := false
+		for _, ref := range obj.GetOwnerReferences() {
+			if string(ref.UID) == f.owner || (strings.EqualFold(ref.Kind, kind) && ref.Name == name) {
+				found = true
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// searchResult is an object found by a search, with the places it references the searched object
+type searchResult struct {
+	namespace  string
+	resource   string
+	name       string
+	created    time.Time
+	references []string
+}
+
+// listableResources returns the preferred version of every resource that can be listed. With
+// namespaced only the namespaced resources are returned.
+func listableResources(c *client, namespaced bool) ([]schema.GroupVersionResource, error) {
+	lists, err := c.discovery.ServerPreferredResources()
+	if err != nil && !discovery.IsGroupDiscoveryFailedError(err) {
+		return nil, err
+	} else if err != nil {
+		fmt.Fprintln(os.Stderr, "Warning:", err)
+	}
+	var resources []schema.GroupVersionResource
+	for _, list := range lists {
+		gv, err := schema.ParseGroupVersion(list.GroupVersion)
+		if err != nil {
+			return nil, err
+		}
+		for _, r := range list.APIResources {
+			if strings.Contains(r.Name, "/") || !sets.New(r.Verbs...).Has("list") || (namespaced && !r.Namespaced) {
+				continue
+			}
+			resources = append(resources, gv.WithResource(r.Name))
+		}
+	}
+	return resources, nil
+}
+
+// searchMetadata lists the metadata of every listable resource and returns the objects matching the
+// filter. Only the metadata is fetched, so that searching secrets or large custom resources is cheap.
+// Resources that can't be listed, usually for lack of permissions, are skipped with a warning.
+func searchMetadata(ctx context.Context, c *client, namespace, selector string, filter searchFilter) ([]searchResult, error) {
+	metadataClient, err := metadata.NewForConfig(c.config)
+	if err != nil {
+		return nil, err
+	}
+	// cluster scoped objects aren't in any namespace, they are only searched across all namespaces
+	resources, err := listableResources(c, namespace != "")
+	if err != nil {
+		return nil, err
+	}
+
+	var results []searchResult
+	for _, gvr := range resources {
+		if resourceName(gvr) == "events" || resourceName(gvr) == "events.events.k8s.io" {
+			continue
+		}
+		opts := metav1.ListOptions{LabelSelector: selector, Limit: 500}
+		for {
+			list, err := metadataClient.Resource(gvr).Namespace(namespace).List(ctx, opts)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Warning: failed to list %s: %v\n", resourceName(gvr), err)
+				break
+			}
+			for i := range list.Items {
+				obj := &list.Items[i]
+				if filter.matches(obj) {
+					results = append(results, searchResult{
+						namespace: obj.GetNamespace(),
+						resource:  resourceName(gvr),
+						name:      obj.GetName(),
+						created:   obj.GetCreationTimestamp().Time,
+					})
+				}
+			}
+			if opts.Continue = list.GetContinue(); opts.Continue == "" {
+				break
+			}
+		}
+	}
+	return results, nil
+}
+
+// podSpecPaths are the resources with a pod spec and where it is found
+var podSpecPaths = map[schema.GroupVersionResource][]string{
+	{Version: "v1", Resource: "pods"}:                        {"spec"},
+	{Version: "v1", Resource: "replicationcontrollers"}:      {"spec", "template", "spec"},
+	{Group: "apps", Version: "v1", Resource: "deployments"}:  {"spec", "template", "spec"},
+	{Group: "apps", Version: "v1", Resource: "statefulsets"}: {"spec", "template", "spec"},
+	{Group: "apps", Version: "v1", Resource: "daemonsets"}:   {"spec", "template", "spec"},
+	{Group: "apps", Version: "v1", Resource: "replicasets"}:  {"spec", "template", "spec"},
+	{Group: "batch", Version: "v1", Resource: "jobs"}:        {"spec", "template", "spec"},
+	{Group: "batch", Version: "v1", Resource: "cronjobs"}:    {"spec", "jobTemplate", "spec", "template", "spec"},
+}
+
+// podSpecReferences returns where a pod spec references the secret or config map: volumes,
+// projected volumes, envFrom, env and imagePullSecrets
+func podSpecReferences(spec map[string]interface{}, kind, name string) []string {
+	var refs []string
+	ref := func(obj map[string]interface{}, fields ...string) bool {
+		v, _, _ := unstructured.NestedString(obj, fields...)
+		return v == name
+	}
+	volumes, _, _ := unstructured.NestedSlice(spec, "volumes")
+	for _, v := range volumes {
+		volume, _ := v.(map[string]interface{})
+		volumeName, _, _ := unstructured.NestedString(volume, "name")
+		if (kind == "Secret" && ref(volume, "secret", "secretName")) || (kind == "ConfigMap" && ref(volume, "configMap", "name")) {
+			refs = append(refs, "volume "+volumeName)
+		}
+		sources, _, _ := unstructured.NestedSlice(volume, "projected", "sources")
+		for _, s := range sources {
+			source, _ := s.(map[string]interface{})
+			if (kind == "Secret" && ref(source, "secret", "name")) || (kind == "ConfigMap" && ref(source, "configMap", "name")) {
+				refs = append(refs, "projected volume "+volumeName)
+			}
+		}
+	}
+
+	for _, field := range []string{"initContainers", "containers", "ephemeralContainers"} {
+		containers, _, _ := unstructured.NestedSlice(spec, field)
+		for _, c := range containers {
+			container, _ := c.(map[string]interface{})
+			containerName, _, _ := unstructured.NestedString(container, "name")
+			envFrom, _, _ := unstructured.NestedSlice(container, "envFrom")
+			for _, e := range envFrom {
+				source, _ := e.(map[string]interface{})
+				if (kind == "Secret" && ref(source, "secretRef", "name")) || (kind == "ConfigMap" && ref(source, "configMapRef", "name")) {
+					refs = append(refs, "envFrom of container "+containerName)
+				}
+			}
+			env, _, _ := unstructured.NestedSlice(container, "env")
+			for _, e := range env {
+				variable, _ := e.(map[string]interface{})
+				if (kind == "Secret" && ref(variable, "valueFrom", "secretKeyRef", "name")) ||
+					(kind == "ConfigMap" && ref(variable, "valueFrom", "configMapKeyRef", "name")) {
+					variableName, _, _ := unstructured.NestedString(variable, "name")
+					refs = append(refs, fmt.Sprintf("env %s of container %s", variableName, containerName))
+				}
+			}
+		}
+	}
+
+	if kind == "Secret" {
+		pullSecrets, _, _ := unstructured.NestedSlice(spec, "imagePullSecrets")
+		for _, s := range pullSecrets {
+			if secret, _ := s.(map[string]interface{}); ref(secret, "name") {
+				refs = append(refs, "imagePullSecrets")
+			}
+		}
+	}
+	return refs
+}
+
+// searchReferences returns the pods and workloads whose pod spec references the secret or config map.
+// A pod spec references objects in its own namespace, so with an empty namespace the references to
+// the secrets or config maps of that name in every namespace are found.
+func searchReferences(ctx context.Context, c *client, namespace, selector, kind, name string, filter searchFilter) ([]searchResult, error) {
+	var results []searchResult
+	for gvr, fields := range podSpecPaths {
+		opts := metav1.ListOptions{LabelSelector: selector, Limit: 500}
+		for {
+			list, err := c.dynamic.Resource(gvr).Namespace(namespace).List(ctx, opts)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Warning: failed to list %s: %v\n", resourceName(gvr), err)
+				break
+			}
+			for i := range list.Items {
+				obj := &list.Items[i]
+				if !filter.matches(obj) {
+					continue
+				}
+				spec, found, _ := unstructured.NestedMap(obj.Object, fields...)
+				if !found {
+					continue
+				}
+				if refs := podSpecReferences(spec, kind, name); len(refs) > 0 {
+					results = append(results, searchResult{
+						namespace:  obj.GetNamespace(),
+						resource:   resourceName(gvr),
+						name:       obj.GetName(),
+						created:    obj.GetCreationTimestamp().Time,
+						references: refs,
+					})
+				}
+			}
+			if opts.Continue = list.GetContinue(); opts.Continue == "" {
+				break
+			}
+		}
+	}
+	return results, nil
+}
+
+// printSearchResults writes the results as a table sorted by namespace, resource and name
+func printSearchResults(out io.Writer, results []searchResult, withReferences bool, now time.Time) error {
+	sort.Slice(results, func(i, j int) bool {
+		a, b := results[i], results[j]
+		if a.namespace != b.namespace {
+			return a.namespace < b.namespace
+		}
+		if a.resource != b.resource {
+			return a.resource < b.resource
+		}
+		return a.name < b.name
+	})
+	w := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+	if withReferences {
+		fmt.Fprintln(w, "NAMESPACE\tRESOURCE\tNAME\tREFERENCES")
+	} else {
+		fmt.Fprintln(w, "NAMESPACE\tRESOURCE\tNAME\tAGE")
+	}
+	for _, r := range results {
+		namespace := r.namespace
+		if namespace == "" {
+			namespace = "-"
+		}
+		if withReferences {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", namespace, r.resource, r.name, strings.Join(r.references, ", "))
+		} else {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", namespace, r.resource, r.name, duration.HumanDuration(now.Sub(r.created)))
+		}
+	}
+	return w.Flush()
+}
+
+// runSearch implements the `search` command which finds objects of every resource type by name,
+// labels, annotations or owner, or the workloads referencing a secret or config map
+func runSearch(args []string) error {
+	fs := flag.NewFlagSet("search", flag.ExitOnError)
+	opts := addCommonFlags(fs)
+	filter := searchFilter{}
+	fs.StringVar(&filter.name, "name", "", "glob pattern the object names must match, like mysql-*")
+	selector := fs.String("l", "", "label selector")
+	fs.StringVar(&filter.annotation, "annotation", "", "annotation key, or key=value, the objects must have")
+	fs.StringVar(&filter.owner, "owner", "", "owner the objects must reference, as Kind/name or uid")
+	references := fs.String("references", "", "find the pods and workloads referencing secret/<name> or configmap/<name>")
+	allNamespaces := fs.Bool("A", false, "search all namespaces and the cluster scoped resources instead of the -namespace flag")
+	_ = fs.Parse(args)
+
+	kind, name := "", ""
+	if *references != "" {
+		resource, refName, _ := strings.Cut(*references, "/")
+		switch strings.ToLower(resource) {
+		case "secret", "secrets":
+			kind = "Secret"
+		case "configmap", "configmaps", "cm":
+			kind = "ConfigMap"
+		default:
+			return fmt.Errorf("invalid -references %q, use secret/<name> or configmap/<name>", *references)
+		}
+		if name = refName; name == "" {
+			return fmt.Errorf("invalid -references %q, the name is missing", *references)
+		}
+	} else if filter == (searchFilter{}) && *selector == "" {
+		return fmt.Errorf("give at least one of -name, -l, -annotation, -owner or -references")
+	}
+	if filter.name != "" {
+		if _, err := path.Match(filter.name, ""); err != nil {
+			return fmt.Errorf("invalid -name pattern %q: %w", filter.name, err)
+		}
+	}
+
+	namespace := ""
+	if !*allNamespaces {
+		namespace = opts.namespace
+	}
+	ctx := context.TODO()
+	c, err := newClient(opts)
+	if err != nil {
+		return err
+	}
+
+	var results []searchResult
+	if kind != "" {
+		results, err = searchReferences(ctx, c, namespace, *selector, kind, name, filter)
+	} else {
+		results, err = searchMetadata(ctx, c, namespace, *selector, filter)
+	}
+	if err != nil {
+		return err
+	}
+	if len(results) == 0 {
+		fmt.Fprintln(os.Stderr, "No objects found")
+		return nil
+	}
+	return printSearchResults(os.Stdout, results, kind != "", time.Now())
+}
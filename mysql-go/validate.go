@@ -0,0 +1,270 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"k8s.io/apiextensions-apiserver/pkg/apis/apiextensions"
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	structuralschema "k8s.io/apiextensions-apiserver/pkg/apiserver/schema"
+	"k8s.io/apiextensions-apiserver/pkg/apiserver/schema/cel"
+	"k8s.io/apiextensions-apiserver/pkg/apiserver/schema/defaulting"
+	"k8s.io/apiextensions-apiserver/pkg/apiserver/schema/listtype"
+	"k8s.io/apiextensions-apiserver/pkg/apiserver/schema/objectmeta"
+	"k8s.io/apiextensions-apiserver/pkg/apiserver/schema/pruning"
+	apiservervalidation "k8s.io/apiextensions-apiserver/pkg/apiserver/validation"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	celconfig "k8s.io/apiserver/pkg/apis/cel"
+	"os"
+)
+
+// schemaValidator validates custom resources against the openAPIV3Schema of their CRD version the
+// same way the API server does, so that invalid manifests are caught without a cluster
+type schemaValidator struct {
+	crds     map[schema.GroupKind]*apiextensionsv1.CustomResourceDefinition
+	compiled map[schema.GroupVersionKind]*compiledSchema
+}
+
+// compiledSchema is the schema of a CRD version prepared for validation
+type compiledSchema struct {
+	structural *structuralschema.Structural
+	validator  apiservervalidation.SchemaValidator
+	// cel evaluates the x-kubernetes-validations rules, it is nil when the schema has none
+	cel *cel.Validator
+}
+
+func newSchemaValidator(crds []*apiextensionsv1.CustomResourceDefinition) *schemaValidator {
+	v := &schemaValidator{
+		crds:     map[schema.GroupKind]*apiextensionsv1.CustomResourceDefinition{},
+		compiled: map[schema.GroupVersionKind]*compiledSchema{},
+	}
+	for _, crd := range crds {
+		v.crds[schema.GroupKind{Group: crd.Spec.Group, Kind: crd.Spec.Names.Kind}] = crd
+	}
+	return v
+}
+
+// loadCRDFiles reads the CustomResourceDefinitions from manifests, other objects are ignored
+func loadCRDFiles(filenames []string) ([]*apiextensionsv1.CustomResourceDefinition, error) {
+	var crds []*apiextensionsv1.CustomResourceDefinition
+	for _, filename := range filenames {
+		objs, err := readManifests(filename)
+		if err != nil {
+			return nil, err
+		}
+		for _, obj := range objs {
+			if obj.GroupVersionKind() != apiextensionsv1.SchemeGroupVersion.WithKind("CustomResourceDefinition") {
+				continue
+			}
+			crd := &apiextensionsv1.CustomResourceDefinition{}
+			if err := runtime.DefaultUnstructuredConverter.FromUnstructured(obj.Object, crd); err != nil {
+				return nil, fmt.Errorf("failed to decode CRD %s in %s: %w", obj.GetName(), filename, err)
+			}
+			crds = append(crds, crd)
+		}
+	}
+	if len(crds) == 0 {
+		return nil, fmt.Errorf("no apiextensions.k8s.io/v1 CustomResourceDefinition found in %v", filenames)
+	}
+	return crds, nil
+}
+
+// knows reports whether the kind of the object is defined by one of the CRDs
+func (v *schemaValidator) knows(obj *unstructured.Unstructured) bool {
+	_, ok := v.crds[obj.GroupVersionKind().GroupKind()]
+	return ok
+}
+
+func (v *schemaValidator) compile(gvk schema.GroupVersionKind) (*compiledSchema, error) {
+	if c, ok := v.compiled[gvk]; ok {
+		return c, nil
+	}
+	crd := v.crds[gvk.GroupKind()]
+	var version *apiextensionsv1.CustomResourceDefinitionVersion
+	for i := range crd.Spec.Versions {
+		if crd.Spec.Versions[i].Name == gvk.Version {
+			version = &crd.Spec.Versions[i]
+		}
+	}
+	if version == nil {
+		return nil, fmt.Errorf("CRD %s has no version %s", crd.Name, gvk.Version)
+	}
+	if version.Schema == nil || version.Schema.OpenAPIV3Schema == nil {
+		return nil, fmt.Errorf("version %s of CRD %s has no schema", gvk.Version, crd.Name)
+	}
+
+	internal := &apiextensions.JSONSchemaProps{}
+	if err := apiextensionsv1.Convert_v1_JSONSchemaProps_To_apiextensions_JSONSchemaProps(version.Schema.OpenAPIV3Schema, internal, nil); err != nil {
+		return nil, err
+	}
+	structural, err := structuralschema.NewStructural(internal)
+	if err != nil {
+		return nil, fmt.Errorf("the schema of version %s of CRD %s is not structural: %w", gvk.Version, crd.Name, err)
+	}
+	validator, _, err := apiservervalidation.NewSchemaValidator(internal)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &compiledSchema{
+		structural: structural,
+		validator:  validator,
+		cel:        cel.NewValidator(structural, true, celconfig.PerCallLimit),
+	}
+	v.compiled[gvk] = c
+	return c, nil
+}
+
+// validate returns every violation of the schema by the object. Fields the schema doesn't declare
+// are reported as well, unless they are below x-kubernetes-preserve-unknown-fields.
+// The CEL validation rules are evaluated too, transition rules only when the old object is given.
+func (v *schemaValidator) validate(ctx context.Context, obj, old *unstructured.Unstructured) field.ErrorList {
+	c, err := v.compile(obj.GroupVersionKind())
+	if err != nil {
+		return field.ErrorList{field.Invalid(field.NewPath("apiVersion"), obj.GetAPIVersion(), err.Error())}
+	}
+
+	var errs field.ErrorList
+	if obj.GetName() == "" && obj.GetGenerateName() == "" {
+		errs = append(errs, field.Required(field.NewPath("metadata", "name"), "name or generateName is required"))
+	}
+
+	// the API server prunes and defaults objects before validating them
+	content := runtime.DeepCopyJSON(obj.Object)
+	unknown := pruning.PruneWithOptions(content, c.structural, true, structuralschema.UnknownFieldPathOptions{
+		TrackUnknownFieldPaths: true,
+	})
+	// the API server silently drops unknown fields, report them as they are most likely typos
+	for _, path := range unknown {
+		errs = append(errs, field.Forbidden(field.NewPath(path), "unknown field, it is not declared in the schema"))
+	}
+	defaulting.Default(content, c.structural)
+
+	errs = append(errs, apiservervalidation.ValidateCustomResource(nil, content, c.validator)...)
+	errs = append(errs, objectmeta.Validate(nil, content, c.structural, true)...)
+	errs = append(errs, listtype.ValidateListSetsAndMaps(nil, c.structural, content)...)
+
+	if c.cel != nil {
+		var oldContent interface{}
+		if old != nil {
+			oldObj := runtime.DeepCopyJSON(old.Object)
+			pruning.Prune(oldObj, c.structural, true)
+			defaulting.Default(oldObj, c.structural)
+			oldContent = oldObj
+		}
+		celErrs, remaining := c.cel.Validate(ctx, nil, c.structural, content, oldContent, celconfig.RuntimeCELCostBudget)
+		errs = append(errs, celErrs...)
+		if remaining < 0 {
+			errs = append(errs, field.Invalid(nil, obj.GetName(), "the CEL rules exceed the runtime cost budget"))
+		}
+	}
+	return errs
+}
+
+// validateObjects validates the custom resources among objs and returns an error listing every
+// violation. Objects of kinds the validator doesn't know are skipped. oldFor returns the previous
+// version of an object for the transition rules, or nil.
+func (v *schemaValidator) validateObjects(ctx context.Context, objs []*unstructured.Unstructured, oldFor func(*unstructured.Unstructured) (*unstructured.Unstructured, error)) error {
+	invalid := 0
+	for _, obj := range objs {
+		if !v.knows(obj) {
+			continue
+		}
+		var old *unstructured.Unstructured
+		if oldFor != nil {
+			var err error
+			if old, err = oldFor(obj); err != nil {
+				return err
+			}
+		}
+		errs := v.validate(ctx, obj, old)
+		if len(errs) == 0 {
+			continue
+		}
+		invalid++
+		fmt.Fprintf(os.Stderr, "%s %s is invalid:\n", obj.GetKind(), obj.GetName())
+		for _, err := range errs {
+			fmt.Fprintf(os.Stderr, "  %s\n", err)
+		}
+	}
+	if invalid > 0 {
+		return fmt.Errorf("%d of %d objects are invalid", invalid, len(objs))
+	}
+	return nil
+}
+
+// clusterSchemaValidator returns a validator for the CRDs installed in the cluster
+func clusterSchemaValidator(ctx context.Context, c *client) (*schemaValidator, error) {
+	explorer, err := newCRDExplorer(ctx, c)
+	if err != nil {
+		return nil, err
+	}
+	crds := make([]*apiextensionsv1.CustomResourceDefinition, 0, len(explorer.crds))
+	for _, crd := range explorer.crds {
+		crds = append(crds, crd)
+	}
+	return newSchemaValidator(crds), nil
+}
+
+// runValidate implements the `validate` command. With -crd the manifest is validated offline against
+// the given CRD files, otherwise against the CRDs installed in the cluster.
+func runValidate(args []string) error {
+	fs := flag.NewFlagSet("validate", flag.ExitOnError)
+	opts := addCommonFlags(fs)
+	crdFiles := fs.String("crd", "", "comma separated CRD manifests to validate against instead of the cluster")
+	oldFile := fs.String("old", "", "manifest with the previous versions of the objects, used to evaluate CEL transition rules")
+	_ = fs.Parse(args)
+
+	objs, err := readManifests(opts.filename)
+	if err != nil {
+		return err
+	}
+	var oldFor func(*unstructured.Unstructured) (*unstructured.Unstructured, error)
+	if *oldFile != "" {
+		olds, err := readManifests(*oldFile)
+		if err != nil {
+			return err
+		}
+		oldFor = func(obj *unstructured.Unstructured) (*unstructured.Unstructured, error) {
+			for _, old := range olds {
+				if old.GroupVersionKind().GroupKind() == obj.GroupVersionKind().GroupKind() &&
+					old.GetNamespace() == obj.GetNamespace() && old.GetName() == obj.GetName() {
+					return old, nil
+				}
+			}
+			return nil, nil
+		}
+	}
+
+	var v *schemaValidator
+	if *crdFiles != "" {
+		crds, err := loadCRDFiles(splitList(*crdFiles))
+		if err != nil {
+			return err
+		}
+		v = newSchemaValidator(crds)
+	} else {
+		c, err := newClient(opts)
+		if err != nil {
+			return err
+		}
+		if v, err = clusterSchemaValidator(context.TODO(), c); err != nil {
+			return err
+		}
+	}
+
+	if err := v.validateObjects(context.TODO(), objs, oldFor); err != nil {
+		return err
+	}
+	for _, obj := range objs {
+		if v.knows(obj) {
+			fmt.Printf("%s %s is valid\n", obj.GetKind(), obj.GetName())
+		} else {
+			fmt.Printf("%s %s skipped, no CRD defines %s\n", obj.GetKind(), obj.GetName(), obj.GroupVersionKind().GroupKind())
+		}
+	}
+	return nil
+}
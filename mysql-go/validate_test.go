@@ -0,0 +1,221 @@
+package main
+
+import (
+	"context"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const widgetCRD = `
+apiVersion: apiextensions.k8s.io/v1
+kind: CustomResourceDefinition
+metadata:
+  name: widgets.example.com
+spec:
+  group: example.com
+  scope: Namespaced
+  names:
+    kind: Widget
+    plural: widgets
+  versions:
+  - name: v1
+    served: true
+    storage: true
+    schema:
+      openAPIV3Schema:
+        type: object
+        properties:
+          spec:
+            type: object
+            x-kubernetes-validations:
+            - rule: "!has(self.maxReplicas) || self.replicas <= self.maxReplicas"
+              message: replicas must not exceed maxReplicas
+            properties:
+              size:
+                type: string
+                enum: [small, large]
+              owner:
+                type: string
+                pattern: "^[a-z]+$"
+              replicas:
+                type: integer
+                default: 1
+              maxReplicas:
+                type: integer
+              storageClass:
+                type: string
+                x-kubernetes-validations:
+                - rule: self == oldSelf
+                  message: storageClass is immutable
+              config:
+                type: object
+                x-kubernetes-preserve-unknown-fields: true
+`
+
+// writeManifest writes content to a file in a temporary directory and returns its name
+func writeManifest(t *testing.T, content string) string {
+	t.Helper()
+	filename := filepath.Join(t.TempDir(), "manifest.yaml")
+	if err := os.WriteFile(filename, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return filename
+}
+
+// readManifest returns the single object of a manifest
+func readManifest(t *testing.T, content string) *unstructured.Unstructured {
+	t.Helper()
+	objs, err := readManifests(writeManifest(t, content))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(objs) != 1 {
+		t.Fatalf("expected a single object, got %d", len(objs))
+	}
+	return objs[0]
+}
+
+func newWidgetValidator(t *testing.T) *schemaValidator {
+	t.Helper()
+	crds, err := loadCRDFiles([]string{writeManifest(t, widgetCRD)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return newSchemaValidator(crds)
+}
+
+func widget(spec string) string {
+	return "apiVersion: example.com/v1\nkind: Widget\nmetadata:\n  name: w\nspec:\n" + spec
+}
+
+func TestSchemaValidatorValidate(t *testing.T) {
+	tests := []struct {
+		name string
+		obj  string
+		old  string
+		// want are the substrings of the expected errors, none if empty
+		want []string
+	}{
+		{
+			name: "valid",
+			obj:  widget("  size: small\n  owner: team\n  replicas: 2\n  maxReplicas: 3\n"),
+		},
+		{
+			name: "unknown field",
+			obj:  widget("  sise: small\n"),
+			want: []string{"spec.sise", "unknown field"},
+		},
+		{
+			name: "unknown field below preserve-unknown-fields",
+			obj:  widget("  config:\n    anything: true\n"),
+		},
+		{
+			name: "enum",
+			obj:  widget("  size: medium\n"),
+			want: []string{"spec.size", "Unsupported value", `"small", "large"`},
+		},
+		{
+			name: "pattern",
+			obj:  widget("  owner: Team\n"),
+			want: []string{"spec.owner", "should match '^[a-z]+$'"},
+		},
+		{
+			name: "CEL rule",
+			obj:  widget("  replicas: 5\n  maxReplicas: 3\n"),
+			want: []string{"spec", "replicas must not exceed maxReplicas"},
+		},
+		{
+			name: "CEL rule with a defaulted field",
+			obj:  widget("  maxReplicas: 0\n"),
+			want: []string{"replicas must not exceed maxReplicas"},
+		},
+		{
+			name: "transition rule without the old object",
+			obj:  widget("  storageClass: fast\n"),
+		},
+		{
+			name: "transition rule unchanged",
+			obj:  widget("  storageClass: fast\n"),
+			old:  widget("  storageClass: fast\n"),
+		},
+		{
+			name: "transition rule changed",
+			obj:  widget("  storageClass: fast\n"),
+			old:  widget("  storageClass: slow\n"),
+			want: []string{"spec.storageClass", "storageClass is immutable"},
+		},
+		{
+			name: "no name",
+			obj:  "apiVersion: example.com/v1\nkind: Widget\nspec:\n  size: small\n",
+			want: []string{"metadata.name", "name or generateName is required"},
+		},
+		{
+			name: "unknown version",
+			obj:  "apiVersion: example.com/v2\nkind: Widget\nmetadata:\n  name: w\n",
+			want: []string{"has no version v2"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := newWidgetValidator(t)
+			var old *unstructured.Unstructured
+			if tt.old != "" {
+				old = readManifest(t, tt.old)
+			}
+			errs := v.validate(context.Background(), readManifest(t, tt.obj), old)
+			if len(tt.want) == 0 {
+				if len(errs) > 0 {
+					t.Fatalf("expected no errors, got %v", errs)
+				}
+				return
+			}
+			if len(errs) != 1 {
+				t.Fatalf("expected a single error containing %q, got %v", tt.want, errs)
+			}
+			for _, want := range tt.want {
+				if !strings.Contains(errs[0].Error(), want) {
+					t.Errorf("expected the error to contain %q, got %q", want, errs[0].Error())
+				}
+			}
+		})
+	}
+}
+
+func TestSchemaValidatorValidateObjects(t *testing.T) {
+	configMap := "apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: settings\ndata:\n  unknown: field\n"
+	deployment := "apiVersion: apps/v1\nkind: Deployment\nmetadata:\n  name: app\nspec:\n  replicas: many\n"
+	tests := []struct {
+		name    string
+		objs    []string
+		wantErr string
+	}{
+		{name: "built-in kinds are skipped", objs: []string{configMap, deployment, widget("  size: small\n")}},
+		{name: "invalid widget", objs: []string{configMap, widget("  size: medium\n")}, wantErr: "1 of 2 objects are invalid"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := newWidgetValidator(t)
+			var objs []*unstructured.Unstructured
+			for _, obj := range tt.objs {
+				objs = append(objs, readManifest(t, obj))
+			}
+			if v.knows(objs[0]) {
+				t.Errorf("expected %s not to be known", objs[0].GetKind())
+			}
+
+			err := v.validateObjects(context.Background(), objs, nil)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("expected an error containing %q, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
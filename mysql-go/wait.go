@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/tools/cache"
+	watchtools "k8s.io/client-go/tools/watch"
+	"k8s.io/client-go/util/jsonpath"
+	"os"
+	"strings"
+	"time"
+)
+
+// waitOptions are the -wait-for and -timeout flags of the commands creating objects
+type waitOptions struct {
+	expr    string
+	timeout time.Duration
+}
+
+func addWaitFlags(fs *flag.FlagSet) *waitOptions {
+	opts := &waitOptions{}
+	fs.StringVar(&opts.expr, "wait-for", "", "wait until condition=<type>[=<status>] or jsonpath={<expression>}[=<value>] matches")
+	fs.DurationVar(&opts.timeout, "timeout", 5*time.Minute, "how long -wait-for waits for each object")
+	return opts
+}
+
+// condition returns the parsed -wait-for flag, nil when it isn't set
+func (o *waitOptions) condition(dryRun bool) (*waitCondition, error) {
+	if o.expr == "" {
+		return nil, nil
+	}
+	if dryRun {
+		return nil, fmt.Errorf("-wait-for can't be used with -dry-run")
+	}
+	return parseWaitFor(o.expr)
+}
+
+// waitCondition is the state an object is waited for, parsed from the -wait-for flag
+type waitCondition struct {
+	desc string
+	// check reports whether the object matches and a short description of its current state
+	check func(obj *unstructured.Unstructured) (bool, string, error)
+}
+
+// parseWaitFor parses `condition=<type>[=<status>]`, the status defaults to True, or
+// `jsonpath={<expression>}[=<value>]`, without a value any non-empty result matches
+func parseWaitFor(expr string) (*waitCondition, error) {
+	switch {
+	case strings.HasPrefix(expr, "condition="):
+		condType, status, found := strings.Cut(strings.TrimPrefix(expr, "condition="), "=")
+		if !found {
+			status = "True"
+		}
+		if condType == "" {
+			return nil, fmt.Errorf("invalid -wait-for %q, the condition type is missing", expr)
+		}
+		return &waitCondition{desc: condType + "=" + status, check: conditionCheck(condType, status)}, nil
+	case strings.HasPrefix(expr, "jsonpath="):
+		path, value := strings.TrimPrefix(expr, "jsonpath="), ""
+		hasValue := false
+		if i := strings.LastIndex(path, "}"); i >= 0 && strings.HasPrefix(path[i+1:], "=") {
+			path, value, hasValue = path[:i+1], path[i+2:], true
+		}
+		if !strings.HasPrefix(path, "{") {
+			path = "{" + path + "}"
+		}
+		parser := jsonpath.New("wait-for").AllowMissingKeys(true)
+		if err := parser.Parse(path); err != nil {
+			return nil, fmt.Errorf("invalid -wait-for %q: %w", expr, err)
+		}
+		desc := path
+		if hasValue {
+			desc += "=" + value
+		}
+		return &waitCondition{desc: desc, check: jsonPathCheck(parser, value, hasValue)}, nil
+	}
+	return nil, fmt.Errorf("invalid -wait-for %q, use condition=<type>[=<status>] or jsonpath={<expression>}[=<value>]", expr)
+}
+
+func conditionCheck(condType, status string) func(*unstructured.Unstructured) (bool, string, error) {
+	return func(obj *unstructured.Unstructured) (bool, string, error) {
+		conditions, _, err := unstructured.NestedSlice(obj.Object, "status", "conditions")
+		if err != nil {
+			return false, "", err
+		}
+		for _, c := range conditions {
+			condition, ok := c.(map[string]interface{})
+			if !ok || condition["type"] != condType {
+				continue
+			}
+			state := fmt.Sprintf("%s=%v", condType, condition["status"])
+			if reason, _ := condition["reason"].(string); reason != "" {
+				state += " (" + reason + ")"
+			}
+			if message, _ := condition["message"].(string); message != "" {
+				state += ": " + message
+			}
+			return strings.EqualFold(fmt.Sprint(condition["status"]), status), state, nil
+		}
+		return false, condType + " not reported yet", nil
+	}
+}
+
+func jsonPathCheck(parser *jsonpath.JSONPath, value string, hasValue bool) func(*unstructured.Unstructured) (bool, string, error) {
+	return func(obj *unstructured.Unstructured) (bool, string, error) {
+		results, err := parser.FindResults(obj.Object)
+		if err != nil {
+			return false, "", err
+		}
+		var values []string
+		for _, result := range results {
+			for _, v := range result {
+				values = append(values, fmt.Sprint(v.Interface()))
+			}
+		}
+		state := strings.Join(values, " ")
+		if len(values) == 0 {
+			return false, "not set", nil
+		}
+		if !hasValue {
+			return state != "", state, nil
+		}
+		for _, v := range values {
+			if v != value {
+				return false, state, nil
+			}
+		}
+		return true, state, nil
+	}
+}
+
+// waitFor watches the object of t until it matches the condition. Changes of its state are printed
+// to stderr, an error is returned when the object is deleted or the timeout expires.
+func waitFor(ctx context.Context, c *client, t target, cond *waitCondition, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	name := describe(t.mapping, t.obj)
+	ri := c.resourceFor(t.mapping, t.obj.GetNamespace())
+	fieldSelector := fields.OneTermEqualSelector("metadata.name", t.obj.GetName()).String()
+	lw := &cache.ListWatch{
+		ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+			options.FieldSelector = fieldSelector
+			return ri.List(ctx, options)
+		},
+		WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+			options.FieldSelector = fieldSelector
+			return ri.Watch(ctx, options)
+		},
+	}
+
+	last := ""
+	_, err := watchtools.UntilWithSync(ctx, lw, &unstructured.Unstructured{}, nil, func(event watch.Event) (bool, error) {
+		switch event.Type {
+		case watch.Deleted:
+			return false, fmt.Errorf("%s was deleted while waiting for %s", name, cond.desc)
+		case watch.Added, watch.Modified:
+			obj, ok := event.Object.(*unstructured.Unstructured)
+			if !ok {
+				return false, nil
+			}
+			matched, state, err := cond.check(obj)
+			if err != nil {
+				return false, err
+			}
+			if state != last {
+				fmt.Fprintf(os.Stderr, "%s: %s\n", name, state)
+				last = state
+			}
+			return matched, nil
+		}
+		return false, nil
+	})
+	if err != nil && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return fmt.Errorf("timed out after %s waiting for %s to be %s", timeout, name, cond.desc)
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "%s: condition met, %s\n", name, cond.desc)
+	return nil
+}
+
+// waitForAll waits for every object in turn, the timeout applies to each object
+func waitForAll(ctx context.Context, c *client, results []target, cond *waitCondition, timeout time.Duration) error {
+	if cond == nil {
+		return nil
+	}
+	for _, t := range results {
+		if err := waitFor(ctx, c, t, cond, timeout); err != nil {
+			return err
+		}
+	}
+	return nil
+}